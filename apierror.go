@@ -0,0 +1,29 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"net/http"
+)
+
+// writeAPIError writes an OpenAI shaped error body so that SDK clients can
+// surface the message instead of failing to parse a plain text response.
+func writeAPIError(w http.ResponseWriter, status int, errType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(unstream.OAIErrorResponse{
+		Error: unstream.OAIError{Message: message, Type: errType},
+	})
+}
+
+// writeParamError writes an OpenAI shaped error that names the offending
+// parameter and an error code.
+func writeParamError(w http.ResponseWriter, status int, errType, param, code, message string) {
+	apiErr := unstream.OAIError{Message: message, Type: errType, Code: code}
+	if param != "" {
+		apiErr.Param = &param
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(unstream.OAIErrorResponse{Error: apiErr})
+}
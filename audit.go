@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"copilot-proxy/unstream"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The audit log answers what was sent to Copilot from the network: every API
+// request body with the response the client got, streams reassembled, and who
+// sent it. Entries are JSON lines in daily files, rotated by size and pruned
+// after the retention period, optionally encrypted. Headers are never logged,
+// so neither the caller's Authorization nor Copilot tokens end up in it.
+
+const (
+	defaultAuditMaxFileBytes = 64 << 20
+	// auditMaxBodyBytes bounds the response captured for an entry.
+	auditMaxBodyBytes = 16 << 20
+)
+
+type auditConfig struct {
+	// Dir is where the audit files are written. The audit log is off when it
+	// is empty.
+	Dir string `json:"dir"`
+	// MaxFileBytes starts a new file once the current one is this large.
+	// Defaults to 64 MiB.
+	MaxFileBytes int64 `json:"max_file_bytes"`
+	// RetentionDays deletes files older than this many days. 0 keeps them.
+	RetentionDays int `json:"retention_days"`
+	// Redact lists the fields replaced with "[REDACTED]", as dotted paths
+	// into the entry where * matches any array element or object member,
+	// for example request.messages.*.content.
+	Redact []string `json:"redact"`
+	// EncryptionKey is a base64 AES-256 key. When set, each line is the
+	// base64 of a random 12 byte nonce followed by the AES-GCM sealed entry.
+	EncryptionKey string `json:"encryption_key"`
+	// OptOutKeys are key ids whose requests are not logged.
+	OptOutKeys []string `json:"opt_out_keys"`
+}
+
+type auditEntry struct {
+	Time      time.Time       `json:"time"`
+	RequestID string          `json:"request_id"`
+	Key       string          `json:"key"`
+	Team      string          `json:"team,omitempty"`
+	Method    string          `json:"method"`
+	Endpoint  string          `json:"endpoint"`
+	UserAgent string          `json:"user_agent,omitempty"`
+	Status    int             `json:"status"`
+	Request   json.RawMessage `json:"request,omitempty"`
+	Response  json.RawMessage `json:"response,omitempty"`
+	// Blocked lists the scrub detectors that blocked the request.
+	Blocked []string `json:"blocked,omitempty"`
+	// Truncated is set when the response was too large to be kept whole.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type requestIDContextKey struct{}
+
+// requestID returns the id the proxy gave the request, see withRequestID.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// withRequestID gives every request an id, reported to the client in the
+// X-Copilot-Proxy-Request-Id header, that ties its audit and ledger entries.
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := "req_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+		w.Header().Set("X-Copilot-Proxy-Request-Id", id)
+		next(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	}
+}
+
+type auditContextKey struct{}
+
+// auditRecord is the request body to record, when the proxy changed it, and
+// why the request was blocked.
+type auditRecord struct {
+	mu      sync.Mutex
+	body    []byte
+	blocked []string
+}
+
+// auditRequestBody records body as the request's, when what is sent upstream
+// must be recorded instead of what the client sent.
+func auditRequestBody(r *http.Request, body []byte) {
+	if rec, ok := r.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		rec.mu.Lock()
+		rec.body = body
+		rec.mu.Unlock()
+	}
+}
+
+// auditBlockedRequest records that scrubbing blocked a request, with body as
+// its request, redacted.
+func auditBlockedRequest(r *http.Request, body []byte, detectors []string) {
+	if rec, ok := r.Context().Value(auditContextKey{}).(*auditRecord); ok {
+		rec.mu.Lock()
+		rec.body, rec.blocked = body, detectors
+		rec.mu.Unlock()
+	}
+}
+
+// withAudit records the requests served by next in the audit log.
+func withAudit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := callerKeyID(r)
+		if config.Audit.Dir == "" || contains(config.Audit.OptOutKeys, key) {
+			next(w, r)
+			return
+		}
+		start, endpoint := time.Now(), r.URL.Path
+		var body []byte
+		if r.Body != nil {
+			body, _ = io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		rec := &auditRecord{body: body}
+		sw := &statusRecorder{ResponseWriter: w, capture: &bytes.Buffer{}, captureLimit: auditMaxBodyBytes}
+		next(sw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, rec)))
+		rec.mu.Lock()
+		body, blocked := rec.body, rec.blocked
+		rec.mu.Unlock()
+
+		entry := &auditEntry{
+			Time:      start.UTC(),
+			RequestID: requestID(r),
+			Key:       key,
+			Team:      callerTeam(key),
+			Method:    r.Method,
+			Endpoint:  endpoint,
+			UserAgent: r.UserAgent(),
+			Status:    sw.status,
+			Request:   auditBody(body),
+			Response:  auditResponse(w.Header().Get("Content-Type"), sw.capture.Bytes()),
+			Truncated: sw.truncated,
+			Blocked:   blocked,
+		}
+		audit.append(entry)
+	}
+}
+
+// auditBody returns a body as JSON: itself if it is JSON, a string otherwise.
+func auditBody(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return body
+	}
+	s, _ := json.Marshal(string(body))
+	return s
+}
+
+// auditResponse returns the response the client got as JSON. Streams are
+// reassembled into the complete response they amount to.
+func auditResponse(contentType string, body []byte) json.RawMessage {
+	if !strings.HasPrefix(contentType, "text/event-stream") {
+		return auditBody(body)
+	}
+	var (
+		payloads []json.RawMessage
+		chat     *unstream.OAIStreamCollector
+		text     *textStreamAssembly
+	)
+	reader := unstream.NewOAIStreamReader(bytes.NewReader(body))
+	for {
+		payload, err := reader.NextPayload()
+		if err != nil {
+			break
+		}
+		payloads = append(payloads, payload)
+		var head struct {
+			Object string `json:"object"`
+		}
+		json.Unmarshal(payload, &head)
+		switch head.Object {
+		case "text_completion":
+			if text == nil {
+				text = &textStreamAssembly{}
+			}
+			text.add(payload)
+		default:
+			var chunk unstream.OAIStreamChunk
+			if json.Unmarshal(payload, &chunk) == nil && (len(chunk.Choices) > 0 || chunk.Usage != nil) {
+				if chat == nil {
+					chat = unstream.NewOAIStreamCollector()
+				}
+				chat.AddChunk(&chunk)
+			}
+		}
+	}
+	var assembled any
+	switch {
+	case text != nil:
+		assembled = text.response()
+	case chat != nil:
+		final := chat.BuildResponse()
+		final.Object = "chat.completion"
+		assembled = final
+	default:
+		assembled = payloads
+	}
+	b, _ := json.Marshal(assembled)
+	return b
+}
+
+// textStreamAssembly reassembles streamed text completions.
+type textStreamAssembly struct {
+	head    map[string]any
+	choices map[int]*textCompletionChoice
+	usage   *unstream.OAIUsage
+}
+
+func (t *textStreamAssembly) add(payload []byte) {
+	var chunk textCompletion
+	if json.Unmarshal(payload, &chunk) != nil {
+		return
+	}
+	if t.head == nil {
+		t.head = map[string]any{"id": chunk.ID, "object": "text_completion", "created": chunk.Created, "model": chunk.Model}
+		t.choices = make(map[int]*textCompletionChoice)
+	}
+	if chunk.Usage != nil {
+		t.usage = chunk.Usage
+	}
+	for _, ch := range chunk.Choices {
+		c := t.choices[ch.Index]
+		if c == nil {
+			c = &textCompletionChoice{Index: ch.Index}
+			t.choices[ch.Index] = c
+		}
+		c.Text += ch.Text
+		if ch.FinishReason != nil {
+			c.FinishReason = ch.FinishReason
+		}
+	}
+}
+
+func (t *textStreamAssembly) response() map[string]any {
+	choices := make([]textCompletionChoice, 0, len(t.choices))
+	for _, c := range t.choices {
+		choices = append(choices, *c)
+	}
+	sort.Slice(choices, func(i, j int) bool { return choices[i].Index < choices[j].Index })
+	out := t.head
+	if out == nil {
+		out = map[string]any{"object": "text_completion"}
+	}
+	out["choices"] = choices
+	if t.usage != nil {
+		out["usage"] = t.usage
+	}
+	return out
+}
+
+// redactFields replaces the values at the given paths.
+func redactFields(v any, path []string) any {
+	if len(path) == 0 {
+		return "[REDACTED]"
+	}
+	switch node := v.(type) {
+	case map[string]any:
+		for k, child := range node {
+			if path[0] == "*" || path[0] == k {
+				node[k] = redactFields(child, path[1:])
+			}
+		}
+	case []any:
+		for i, child := range node {
+			if path[0] == "*" || path[0] == fmt.Sprint(i) {
+				node[i] = redactFields(child, path[1:])
+			}
+		}
+	}
+	return v
+}
+
+// auditLog writes the audit files.
+type auditLog struct {
+	mu   sync.Mutex
+	day  string
+	file *os.File
+	size int64
+}
+
+var audit = &auditLog{}
+
+func (a *auditLog) append(entry *auditEntry) {
+	line, err := encodeAuditEntry(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.rotate(entry.Time, int64(len(line))); err != nil {
+		log.Printf("Failed to open audit log: %v", err)
+		return
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// encodeAuditEntry returns the line for an entry, redacted and encrypted as
+// configured.
+func encodeAuditEntry(entry *auditEntry) ([]byte, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Audit.Redact) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+		for _, path := range config.Audit.Redact {
+			redactFields(m, strings.Split(path, "."))
+		}
+		if line, err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+	}
+	if config.Audit.EncryptionKey != "" {
+		gcm, err := auditCipher()
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		line = []byte(base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, line, nil)))
+	}
+	return append(line, '\n'), nil
+}
+
+func auditCipher() (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(config.Audit.EncryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("audit encryption_key must be 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptAuditFile writes the entries of an encrypted audit file to out.
+func decryptAuditFile(path string, out io.Writer) error {
+	gcm, err := auditCipher()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*auditMaxBodyBytes)
+	for scanner.Scan() {
+		sealed, err := base64.StdEncoding.DecodeString(scanner.Text())
+		if err != nil || len(sealed) < gcm.NonceSize() {
+			return errors.New("not an encrypted audit file")
+		}
+		plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+		if err != nil {
+			return err
+		}
+		out.Write(append(plain, '\n'))
+	}
+	return scanner.Err()
+}
+
+// rotate makes sure a file is open that the next n bytes fit in: a file per
+// day, and a new one when it is full. Callers hold a.mu.
+func (a *auditLog) rotate(now time.Time, n int64) error {
+	maxBytes := config.Audit.MaxFileBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultAuditMaxFileBytes
+	}
+	day := now.UTC().Format(time.DateOnly)
+	if a.file != nil && a.day == day && a.size+n <= maxBytes {
+		return nil
+	}
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	if err := os.MkdirAll(config.Audit.Dir, 0o700); err != nil {
+		return err
+	}
+	a.prune(now)
+	for i := 0; ; i++ {
+		name := "audit-" + day + ".jsonl"
+		if i > 0 {
+			name = fmt.Sprintf("audit-%s.%d.jsonl", day, i)
+		}
+		path := filepath.Join(config.Audit.Dir, name)
+		info, err := os.Stat(path)
+		if err == nil && info.Size()+n > maxBytes {
+			continue
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		a.file, a.day, a.size = f, day, 0
+		if info != nil {
+			a.size = info.Size()
+		}
+		return nil
+	}
+}
+
+// prune deletes the audit files past the retention period. Callers hold a.mu.
+func (a *auditLog) prune(now time.Time) {
+	days := config.Audit.RetentionDays
+	if days <= 0 {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(config.Audit.Dir, "audit-*.jsonl"))
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err == nil && now.Sub(info.ModTime()) > time.Duration(days)*24*time.Hour {
+			if err := os.Remove(path); err == nil {
+				log.Printf("Pruned audit file %s", filepath.Base(path))
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAuditEntries returns the entries of the audit files in dir, which must
+// not be encrypted.
+func readAuditEntries(t *testing.T, dir string) []auditEntry {
+	t.Helper()
+	paths, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	var entries []auditEntry
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var e auditEntry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("%s: %v", p, err)
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// useAuditLog gives the test an audit log of its own. The returned function
+// closes it.
+func useAuditLog() func() {
+	audit = &auditLog{}
+	return func() {
+		if audit.file != nil {
+			audit.file.Close()
+		}
+		audit = &auditLog{}
+		config = &Config{}
+	}
+}
+
+func TestAuditBlockedRequest(t *testing.T) {
+	dir := t.TempDir()
+	config = &Config{
+		Audit: auditConfig{Dir: dir},
+		Scrub: scrubConfig{Enabled: true, Detectors: map[string]string{"email": "block"}},
+	}
+	defer useAuditLog()()
+
+	handler := withAudit(func(w http.ResponseWriter, r *http.Request) {
+		body := []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"mail jane@example.com"}]}`)
+		if _, _, ok := scrubRequest(w, r, body); ok {
+			t.Error("request not blocked")
+		}
+	})
+	r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	r.Header.Set("Authorization", "Bearer alice")
+	handler(httptest.NewRecorder(), r)
+
+	entries := readAuditEntries(t, dir)
+	if len(entries) != 1 {
+		t.Fatalf("%d audit entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Status != http.StatusBadRequest || len(e.Blocked) != 1 || e.Blocked[0] != "email" {
+		t.Errorf("entry has status %d, blocked %v", e.Status, e.Blocked)
+	}
+	if strings.Contains(string(e.Request), "jane@example.com") || !strings.Contains(string(e.Request), "[REDACTED_EMAIL_1]") {
+		t.Errorf("blocked request recorded as %s", e.Request)
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"request.messages.*.content", `{"key":"k","request":{"messages":[{"content":"[REDACTED]","role":"user"},{"content":"[REDACTED]","role":"assistant"}]}}`},
+		{"request.messages.1.content", `{"key":"k","request":{"messages":[{"content":"hi","role":"user"},{"content":"[REDACTED]","role":"assistant"}]}}`},
+		{"request.messages.0", `{"key":"k","request":{"messages":["[REDACTED]",{"content":"hello","role":"assistant"}]}}`},
+		{"*.messages", `{"key":"k","request":{"messages":"[REDACTED]"}}`},
+		{"key", `{"key":"[REDACTED]","request":{"messages":[{"content":"hi","role":"user"},{"content":"hello","role":"assistant"}]}}`},
+		{"response.choices", `{"key":"k","request":{"messages":[{"content":"hi","role":"user"},{"content":"hello","role":"assistant"}]}}`},
+	}
+	for _, c := range cases {
+		var v map[string]any
+		json.Unmarshal([]byte(`{"key":"k","request":{"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"hello"}]}}`), &v)
+		got, _ := json.Marshal(redactFields(v, strings.Split(c.path, ".")))
+		if string(got) != c.want {
+			t.Errorf("redact %s = %s, want %s", c.path, got, c.want)
+		}
+	}
+}
+
+func TestAuditEncryption(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	dir := t.TempDir()
+	config = &Config{Audit: auditConfig{Dir: dir, EncryptionKey: key, Redact: []string{"request.secret"}}}
+	defer useAuditLog()()
+
+	for _, id := range []string{"r1", "r2"} {
+		audit.append(&auditEntry{Time: time.Now(), RequestID: id, Status: 200, Request: json.RawMessage(`{"secret":"s3cret","model":"gpt-4o"}`)})
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	if len(paths) != 1 {
+		t.Fatalf("audit files %v", paths)
+	}
+	data, _ := os.ReadFile(paths[0])
+	if bytes.Contains(data, []byte("gpt-4o")) {
+		t.Errorf("audit file is not encrypted: %s", data)
+	}
+
+	var out bytes.Buffer
+	if err := decryptAuditFile(paths[0], &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("decrypted %d entries: %s", len(lines), out.String())
+	}
+	for i, line := range lines {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"r1", "r2"}[i]; e.RequestID != want || string(e.Request) != `{"model":"gpt-4o","secret":"[REDACTED]"}` {
+			t.Errorf("entry %d decrypted as %s", i, line)
+		}
+	}
+
+	// A different key cannot read the file
+	config.Audit.EncryptionKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, 32))
+	if err := decryptAuditFile(paths[0], &out); err == nil {
+		t.Error("decrypted with the wrong key")
+	}
+	config.Audit.EncryptionKey = base64.StdEncoding.EncodeToString([]byte("short"))
+	if _, err := encodeAuditEntry(&auditEntry{}); err == nil {
+		t.Error("encrypted with a short key")
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	dir := t.TempDir()
+	config = &Config{Audit: auditConfig{Dir: dir, RetentionDays: 7}}
+	defer useAuditLog()()
+	entry := func(at time.Time) *auditEntry {
+		return &auditEntry{Time: at, RequestID: "r", Endpoint: "/v1/chat/completions", Status: 200}
+	}
+	line, _ := encodeAuditEntry(entry(time.Now()))
+	// Two entries fit in a file
+	maxBytes := int64(2*len(line) + 1)
+	config.Audit.MaxFileBytes = maxBytes
+
+	// Files past the retention period are pruned when a new file is opened
+	day := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	for name, age := range map[string]time.Duration{"audit-2026-02-21.jsonl": 8 * 24 * time.Hour, "audit-2026-02-23.jsonl": 6 * 24 * time.Hour} {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte("{}\n"), 0o600)
+		os.Chtimes(p, day.Add(-age), day.Add(-age))
+	}
+	for i := 0; i < 3; i++ {
+		audit.append(entry(day))
+	}
+	audit.append(entry(day.Add(2 * time.Hour)))
+
+	want := map[string]int{
+		"audit-2026-02-23.jsonl":   1,
+		"audit-2026-03-01.jsonl":   2,
+		"audit-2026-03-01.1.jsonl": 1,
+		"audit-2026-03-02.jsonl":   1,
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	got := map[string]int{}
+	for _, p := range paths {
+		data, _ := os.ReadFile(p)
+		got[filepath.Base(p)] = bytes.Count(data, []byte("\n"))
+		if info, _ := os.Stat(p); info.Size() > maxBytes {
+			t.Errorf("%s has %d bytes", filepath.Base(p), info.Size())
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("audit files %v, want %v", got, want)
+	}
+	for name, n := range want {
+		if got[name] != n {
+			t.Errorf("%s has %d entries, want %d", name, got[name], n)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"copilot-proxy/unstream"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The response cache answers repeated deterministic requests without calling
+// upstream. Entries are keyed on a canonical hash of the request body and the
+// caller, so that streaming and non-streaming variants of a request share an
+// entry, and are served as JSON or re-streamed as SSE.
+//
+// Clients control it with Cache-Control: no-cache fetches a fresh response and
+// replaces the entry, no-store bypasses the cache. The outcome is reported in
+// the X-Copilot-Proxy-Cache header: hit, miss, refresh or bypass.
+
+const (
+	defaultCacheTTL        = time.Hour
+	defaultCacheMaxEntries = 1000
+	defaultCacheMaxBytes   = 64 << 20
+)
+
+type responseCacheConfig struct {
+	// Enabled turns the cache on. It is off by default.
+	Enabled bool `json:"enabled"`
+	// Backend is "memory" (default) or "disk".
+	Backend string `json:"backend"`
+	// Dir is the directory of the disk backend.
+	Dir string `json:"dir"`
+	// TTLSeconds is how long entries are served. Defaults to an hour.
+	TTLSeconds int `json:"ttl_seconds"`
+	// MaxEntries and MaxBytes bound the size of the cache; the oldest entries
+	// are evicted first. Default to 1000 entries and 64 MiB.
+	MaxEntries int   `json:"max_entries"`
+	MaxBytes   int64 `json:"max_bytes"`
+	// AnyTemperature also caches chat requests that do not set temperature 0.
+	AnyTemperature bool `json:"any_temperature"`
+}
+
+// cacheBackend stores cached responses by key.
+type cacheBackend interface {
+	get(key string) (value []byte, stored time.Time, ok bool)
+	put(key string, value []byte)
+}
+
+var responseCache struct {
+	mu      sync.Mutex
+	config  *Config // the config the backend was built for
+	backend cacheBackend
+}
+
+// currentCache returns the backend for the current config, or nil if the
+// cache is disabled.
+func currentCache() cacheBackend {
+	c := config.Cache
+	if !c.Enabled {
+		return nil
+	}
+	responseCache.mu.Lock()
+	defer responseCache.mu.Unlock()
+	if responseCache.config == config {
+		return responseCache.backend
+	}
+	ttl := defaultCacheTTL
+	if c.TTLSeconds > 0 {
+		ttl = time.Duration(c.TTLSeconds) * time.Second
+	}
+	maxEntries, maxBytes := c.MaxEntries, c.MaxBytes
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheMaxBytes
+	}
+	switch c.Backend {
+	case "disk":
+		if err := os.MkdirAll(c.Dir, 0o700); err != nil || c.Dir == "" {
+			log.Printf("Response cache disabled, cannot use directory %q: %v", c.Dir, err)
+			responseCache.backend = nil
+		} else {
+			responseCache.backend = &diskCache{dir: c.Dir, ttl: ttl, maxEntries: maxEntries, maxBytes: maxBytes}
+		}
+	default:
+		responseCache.backend = newMemoryCache(ttl, maxEntries, maxBytes)
+	}
+	responseCache.config = config
+	return responseCache.backend
+}
+
+// cacheKey hashes the canonical form of a request body together with the
+// scope and the caller. ignore lists body fields that do not change the
+// response, such as stream.
+func cacheKey(r *http.Request, scope string, body []byte, ignore ...string) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var m map[string]any
+	if dec.Decode(&m) != nil {
+		return "", false
+	}
+	for _, k := range ignore {
+		delete(m, k)
+	}
+	canonical, err := json.Marshal(m) // map keys are sorted
+	if err != nil {
+		return "", false
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", callerKeyID(r), scope)
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// cacheMode reads the client's Cache-Control header.
+func cacheMode(r *http.Request) string {
+	cc := strings.ToLower(r.Header.Get("Cache-Control"))
+	switch {
+	case strings.Contains(cc, "no-store"):
+		return "bypass"
+	case strings.Contains(cc, "no-cache"):
+		return "refresh"
+	}
+	return "lookup"
+}
+
+// chatCacheable reports whether a chat request is deterministic enough to cache.
+func chatCacheable(body []byte) bool {
+	if config.Cache.AnyTemperature {
+		return true
+	}
+	var params struct {
+		Temperature *float64 `json:"temperature"`
+	}
+	return json.Unmarshal(body, &params) == nil && params.Temperature != nil && *params.Temperature == 0
+}
+
+// cacheLookup applies the client's Cache-Control to a cacheable request and
+// reports the outcome. It returns the key to store the response under, empty
+// if it must not be stored, and the cached response on a hit. scope holds
+// whatever besides the body distinguishes responses, such as the endpoint.
+func cacheLookup(w http.ResponseWriter, r *http.Request, scope string, body []byte, ignore ...string) (string, []byte, bool) {
+	cache := currentCache()
+	if cache == nil {
+		return "", nil, false
+	}
+	mode := cacheMode(r)
+	if mode == "bypass" {
+		w.Header().Set("X-Copilot-Proxy-Cache", mode)
+		return "", nil, false
+	}
+	key, ok := cacheKey(r, scope, body, ignore...)
+	if !ok {
+		return "", nil, false
+	}
+	w.Header().Set("X-Copilot-Proxy-Cache", mode)
+	if mode == "refresh" {
+		return key, nil, false
+	}
+	value, stored, hit := cache.get(key)
+	if !hit {
+		w.Header().Set("X-Copilot-Proxy-Cache", "miss")
+		return key, nil, false
+	}
+	w.Header().Set("X-Copilot-Proxy-Cache", "hit")
+	w.Header().Set("Age", fmt.Sprint(int(time.Since(stored).Seconds())))
+	return key, value, true
+}
+
+// cacheStore stores a response under a key returned by cacheLookup.
+func cacheStore(key string, value []byte) {
+	if cache := currentCache(); cache != nil && key != "" {
+		cache.put(key, value)
+	}
+}
+
+// serveCachedChat answers a chat request from the cache if possible. Otherwise
+// it records in cr whether the response should be stored.
+func serveCachedChat(w http.ResponseWriter, cr *chatRequest) bool {
+	// Responses to scrubbed requests may hold the redacted values
+	if currentCache() == nil || !chatCacheable(cr.body) || cr.scrubbed != nil {
+		return false
+	}
+	// Aliases of a model are cached apart since they may present the response
+	// under their own name
+	scope := "/chat/completions"
+	if cr.route != nil {
+		scope += "\x00" + cr.route.Requested
+	}
+	key, value, hit := cacheLookup(w, cr.r, scope, cr.body, "stream", "stream_options")
+	cr.cacheKey = key
+	if !hit {
+		return false
+	}
+	var final unstream.OAIChatResponse
+	if err := json.Unmarshal(value, &final); err != nil {
+		w.Header().Set("X-Copilot-Proxy-Cache", "miss")
+		return false
+	}
+	log.Printf("Serving %s from the response cache", cr.Model)
+	writeCompletion(w, cr, nil, &final)
+	return true
+}
+
+// storeCachedChat stores a complete response if the request asked for it.
+func storeCachedChat(cr *chatRequest, final *unstream.OAIChatResponse) {
+	if cr.cacheKey == "" || final == nil {
+		return
+	}
+	// Responses collected from a stream carry the chunk object type
+	stored := *final
+	stored.Object = "chat.completion"
+	if value, err := json.Marshal(&stored); err == nil {
+		cacheStore(cr.cacheKey, value)
+	}
+}
+
+// memoryCache is an in-memory LRU cache with a TTL.
+type memoryCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+	size       int64
+	order      *list.List // front is most recently used
+	entries    map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key    string
+	value  []byte
+	stored time.Time
+}
+
+func newMemoryCache(ttl time.Duration, maxEntries int, maxBytes int64) *memoryCache {
+	return &memoryCache{ttl: ttl, maxEntries: maxEntries, maxBytes: maxBytes, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *memoryCache) get(key string) ([]byte, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := e.Value.(*memoryEntry)
+	if time.Since(entry.stored) > c.ttl {
+		c.remove(e)
+		return nil, time.Time{}, false
+	}
+	c.order.MoveToFront(e)
+	return entry.value, entry.stored, true
+}
+
+func (c *memoryCache) put(key string, value []byte) {
+	if int64(len(value)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&memoryEntry{key: key, value: value, stored: time.Now()})
+	c.size += int64(len(value))
+	for c.order.Len() > c.maxEntries || c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *memoryCache) remove(e *list.Element) {
+	entry := e.Value.(*memoryEntry)
+	c.order.Remove(e)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.value))
+}
+
+// diskCache stores one file per entry. The file's modification time is the
+// time it was stored.
+type diskCache struct {
+	mu         sync.Mutex
+	dir        string
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *diskCache) get(key string) ([]byte, time.Time, bool) {
+	info, err := os.Stat(c.path(key))
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	if time.Since(info.ModTime()) > c.ttl {
+		os.Remove(c.path(key))
+		return nil, time.Time{}, false
+	}
+	value, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	return value, info.ModTime(), true
+}
+
+func (c *diskCache) put(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Write to a temporary file first so readers never see a partial entry
+	tmp := c.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, value, 0o600); err != nil {
+		log.Printf("Failed to write response cache entry: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, c.path(key)); err != nil {
+		log.Printf("Failed to write response cache entry: %v", err)
+		os.Remove(tmp)
+		return
+	}
+	c.evict()
+}
+
+// evict removes expired entries, then the oldest ones until the cache is
+// within its limits.
+func (c *diskCache) evict() {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	var total int64
+	for _, de := range dirEntries {
+		if !strings.HasSuffix(de.Name(), ".json") {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		p := filepath.Join(c.dir, de.Name())
+		if time.Since(info.ModTime()) > c.ttl {
+			os.Remove(p)
+			continue
+		}
+		files = append(files, file{p, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for len(files) > c.maxEntries || total > c.maxBytes {
+		os.Remove(files[0].path)
+		total -= files[0].size
+		files = files[1:]
+	}
+}
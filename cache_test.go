@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRelayCachesCompleteStreams(t *testing.T) {
+	config = &Config{Cache: responseCacheConfig{Enabled: true}}
+	defer func() { config = &Config{} }()
+
+	chunk := "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"It is sun\"}}]}\n\n"
+	stop := "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n"
+	cases := []struct {
+		name   string
+		body   string
+		stored bool
+	}{
+		{"broken off", chunk, false},
+		{"error", chunk + "event: error\ndata: {\"message\":\"overloaded\"}\n\n", false},
+		{"finish reason", chunk + stop, true},
+		{"done", chunk + "data: [DONE]\n\n", true},
+	}
+	for _, c := range cases {
+		cr := newChatRequest(callerRequest("a"), "ct", []byte(`{"model":"gpt-4o","stream":true,"temperature":0}`))
+		cr.cacheKey = c.name
+		relayStream(httptest.NewRecorder(), cr, upstreamStream(c.body))
+		if _, _, stored := currentCache().get(c.name); stored != c.stored {
+			t.Errorf("%s: stored = %v, want %v", c.name, stored, c.stored)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	base, _ := cacheKey(callerRequest("a"), "chat", []byte(`{"model":"gpt-4o","temperature":0,"messages":[]}`), "stream", "stream_options")
+	cases := []struct {
+		name  string
+		token string
+		scope string
+		body  string
+		same  bool
+	}{
+		{"field order", "a", "chat", `{"messages":[],"temperature":0,"model":"gpt-4o"}`, true},
+		{"whitespace", "a", "chat", "{ \"model\": \"gpt-4o\",\n\"temperature\": 0, \"messages\": [] }", true},
+		{"ignored fields", "a", "chat", `{"model":"gpt-4o","temperature":0,"messages":[],"stream":true,"stream_options":{"include_usage":true}}`, true},
+		{"other caller", "b", "chat", `{"model":"gpt-4o","temperature":0,"messages":[]}`, false},
+		{"other scope", "a", "completions", `{"model":"gpt-4o","temperature":0,"messages":[]}`, false},
+		{"other model", "a", "chat", `{"model":"gpt-4o-mini","temperature":0,"messages":[]}`, false},
+		// Numbers are kept as written
+		{"other number", "a", "chat", `{"model":"gpt-4o","temperature":0.0,"messages":[]}`, false},
+	}
+	for _, c := range cases {
+		key, ok := cacheKey(callerRequest(c.token), c.scope, []byte(c.body), "stream", "stream_options")
+		if !ok || (key == base) != c.same {
+			t.Errorf("%s: key %s, ok %v, same as base %v", c.name, key, ok, key == base)
+		}
+	}
+	if _, ok := cacheKey(callerRequest("a"), "chat", []byte(`[1]`)); ok {
+		t.Error("key for a body that is not an object")
+	}
+}
+
+func TestChatCacheable(t *testing.T) {
+	defer func() { config = &Config{} }()
+	cases := []struct {
+		body string
+		any  bool
+		want bool
+	}{
+		{`{"temperature":0}`, false, true},
+		{`{"temperature":0.0}`, false, true},
+		{`{"temperature":0.7}`, false, false},
+		{`{}`, false, false},
+		{`{"temperature":null}`, false, false},
+		{`{"temperature":0.7}`, true, true},
+		{`{}`, true, true},
+	}
+	for _, c := range cases {
+		config = &Config{Cache: responseCacheConfig{AnyTemperature: c.any}}
+		if got := chatCacheable([]byte(c.body)); got != c.want {
+			t.Errorf("chatCacheable(%s) with any_temperature %v = %v", c.body, c.any, got)
+		}
+	}
+}
+
+func TestCacheMode(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                   "lookup",
+		"max-age=60":         "lookup",
+		"no-cache":           "refresh",
+		"No-Cache":           "refresh",
+		"no-store":           "bypass",
+		"no-cache, no-store": "bypass",
+	} {
+		r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		r.Header.Set("Cache-Control", header)
+		if got := cacheMode(r); got != want {
+			t.Errorf("cacheMode(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	c := newMemoryCache(time.Hour, 2, 10)
+	c.put("a", []byte("1"))
+	c.put("b", []byte("2"))
+	c.get("a") // a is now used more recently than b
+	c.put("c", []byte("3"))
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, ok := c.get(key); ok != want {
+			t.Errorf("entry count: %s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	c = newMemoryCache(time.Hour, 3, 10)
+	c.put("a", []byte("1"))
+	c.put("b", []byte("22"))
+	c.put("d", []byte("12345678"))
+	for key, want := range map[string]bool{"a": false, "b": true, "d": true} {
+		if _, _, ok := c.get(key); ok != want {
+			t.Errorf("size: %s cached = %v, want %v", key, ok, want)
+		}
+	}
+	c.put("e", []byte("12345678901"))
+	if _, _, ok := c.get("e"); ok {
+		t.Error("size: entry larger than the cache was stored")
+	}
+
+	c = newMemoryCache(time.Minute, 2, 10)
+	c.put("a", []byte("1"))
+	c.entries["a"].Value.(*memoryEntry).stored = time.Now().Add(-2 * time.Minute)
+	if _, _, ok := c.get("a"); ok || c.size != 0 {
+		t.Errorf("expired entry served, size %d", c.size)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	c := &diskCache{dir: dir, ttl: time.Minute, maxEntries: 2, maxBytes: 10}
+	age := func(key string, d time.Duration) {
+		when := time.Now().Add(-d)
+		os.Chtimes(c.path(key), when, when)
+	}
+
+	c.put("a", []byte("1"))
+	if value, _, ok := c.get("a"); !ok || string(value) != "1" {
+		t.Errorf("a read back as %q, %v", value, ok)
+	}
+	age("a", 30*time.Second)
+	c.put("b", []byte("2"))
+	c.put("c", []byte("3"))
+	for key, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		if _, _, ok := c.get(key); ok != want {
+			t.Errorf("entry count: %s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	age("b", 2*time.Minute)
+	if _, _, ok := c.get("b"); ok {
+		t.Error("expired entry served")
+	}
+	if _, err := os.Stat(c.path("b")); !os.IsNotExist(err) {
+		t.Error("expired entry left on disk")
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) > 0 {
+		t.Errorf("temporary files left: %v", tmp)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// callerKeyID identifies the caller by its GitHub token without exposing it:
+// the first 12 hex digits of the token's SHA-256. Config rules refer to callers
+// by this id, which the proxy logs.
+func callerKeyID(r *http.Request) string {
+	hash := callerKeyHash(r)
+	if hash == "" {
+		return ""
+	}
+	return hash[:12]
+}
+
+// callerKeyHash is the full hex SHA-256 of the caller's token, empty without
+// one. Admin keys are given as such hashes, which are too long to guess.
+func callerKeyHash(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// admitCaller checks the caller's rate limits and quotas before a request is
+// served. On rejection the error has already been written to w. The returned
+// function must be called once the request is done.
+func admitCaller(w http.ResponseWriter, r *http.Request, stream bool) (func(), bool) {
+	return admitRequests(w, r, stream, 1)
+}
+
+// admitRequests is admitCaller for a request that is sent upstream as n
+// requests.
+func admitRequests(w http.ResponseWriter, r *http.Request, stream bool, n int) (func(), bool) {
+	release, ok := limiter.admitRequests(w, r, stream, n)
+	if !ok {
+		return nil, false
+	}
+	if !quotas.admit(w, r) {
+		release()
+		return nil, false
+	}
+	return release, true
+}
+
+// chargeUsage records what a served response cost the caller: its tokens and
+// the given number of requests to model.
+func chargeUsage(r *http.Request, model string, requests int, usage *unstream.OAIUsage) {
+	limiter.charge(r, usage)
+	if rec := requestLedgerRecord(r); rec != nil {
+		rec.addUsage(model, usage)
+	}
+	quotas.consume(r, usage, float64(requests)*premiumRequests(model))
+}
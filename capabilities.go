@@ -0,0 +1,48 @@
+package main
+
+import "strings"
+
+// modelCapabilities describes how the proxy has to talk to an upstream model.
+type modelCapabilities struct {
+	// ForceStream sends non-streaming requests upstream as streams and collects
+	// them into a single response.
+	ForceStream bool `json:"force_stream"`
+	// NoStream marks models that reject stream:true or answer with a single JSON
+	// body anyway. Streaming requests are sent upstream as non-streaming and the
+	// stream is synthesized for the client.
+	NoStream bool `json:"no_stream"`
+	// EmulateTools renders tools into the system prompt and parses tool calls
+	// out of the model's text, for models without native function calling.
+	EmulateTools bool `json:"emulate_tools"`
+	// NoResponseFormat replaces response_format with schema instructions in the
+	// system prompt, for models that ignore or reject it.
+	NoResponseFormat bool `json:"no_response_format"`
+	// Tokenizer names the encoding prompts are counted with, cl100k_base or
+	// o200k_base, in place of the one the catalog lists, see tokens.go.
+	Tokenizer string `json:"tokenizer"`
+}
+
+// defaultCapabilities is the built-in capability table, keyed by model prefix.
+var defaultCapabilities = map[string]modelCapabilities{
+	"gpt-4.1": {ForceStream: true},
+	"o1":      {NoStream: true},
+}
+
+// lookupCapabilities returns the capabilities of the longest prefix matching
+// model, with entries from the config taking precedence over the defaults.
+func lookupCapabilities(model string) modelCapabilities {
+	var (
+		best    modelCapabilities
+		bestLen = -1
+	)
+	match := func(table map[string]modelCapabilities) {
+		for prefix, caps := range table {
+			if strings.HasPrefix(model, prefix) && len(prefix) >= bestLen {
+				best, bestLen = caps, len(prefix)
+			}
+		}
+	}
+	match(defaultCapabilities)
+	match(config.Models)
+	return best
+}
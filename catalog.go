@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The model catalog serves /v1/models in the OpenAI shape. Copilot's own list
+// carries capabilities, limits and policies in a format of its own; it is
+// fetched per account, cached, and normalized here. Refresh is lazy: a stale
+// list is fetched again by the next request that needs it, with that request's
+// token.
+
+const defaultCatalogTTL = 10 * time.Minute
+
+type catalogConfig struct {
+	// TTLSeconds is how long an account's model list is cached before the
+	// next request that needs it fetches it again. Defaults to 600 seconds.
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+// copilotModel is an entry of Copilot's /models response.
+type copilotModel struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Vendor       string `json:"vendor"`
+	Version      string `json:"version"`
+	Preview      bool   `json:"preview"`
+	Capabilities struct {
+		Family    string `json:"family"`
+		Type      string `json:"type"`
+		Tokenizer string `json:"tokenizer"`
+		Limits    struct {
+			MaxContextWindowTokens int `json:"max_context_window_tokens"`
+			MaxOutputTokens        int `json:"max_output_tokens"`
+			MaxPromptTokens        int `json:"max_prompt_tokens"`
+		} `json:"limits"`
+		Supports struct {
+			Streaming         *bool `json:"streaming"`
+			ToolCalls         bool  `json:"tool_calls"`
+			ParallelToolCalls bool  `json:"parallel_tool_calls"`
+			Vision            bool  `json:"vision"`
+			StructuredOutputs bool  `json:"structured_outputs"`
+		} `json:"supports"`
+	} `json:"capabilities"`
+	Policy *struct {
+		State string `json:"state"`
+	} `json:"policy"`
+}
+
+// catalogModel is a model in the OpenAI shape. The extended fields are only
+// included when the client asks for them with ?extended=true.
+type catalogModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+
+	*catalogExtension
+}
+
+type catalogExtension struct {
+	Name              string `json:"name,omitempty"`
+	Type              string `json:"type,omitempty"`
+	Family            string `json:"family,omitempty"`
+	Version           string `json:"version,omitempty"`
+	Tokenizer         string `json:"tokenizer,omitempty"`
+	AliasFor          string `json:"alias_for,omitempty"`
+	Preview           bool   `json:"preview"`
+	Enabled           bool   `json:"enabled"`
+	ContextWindow     int    `json:"context_window,omitempty"`
+	MaxOutputTokens   int    `json:"max_output_tokens,omitempty"`
+	MaxPromptTokens   int    `json:"max_prompt_tokens,omitempty"`
+	Vision            bool   `json:"vision"`
+	ToolCalls         bool   `json:"tool_calls"`
+	ParallelToolCalls bool   `json:"parallel_tool_calls"`
+	StructuredOutputs bool   `json:"structured_outputs"`
+	Streaming         bool   `json:"streaming"`
+}
+
+// normalizeModel converts a Copilot model entry.
+func normalizeModel(m *copilotModel) catalogModel {
+	c := &m.Capabilities
+	streaming := c.Supports.Streaming == nil || *c.Supports.Streaming
+	caps := lookupCapabilities(m.ID)
+	ownedBy := m.Vendor
+	if ownedBy == "" {
+		ownedBy = "github-copilot"
+	}
+	return catalogModel{
+		ID:      m.ID,
+		Object:  "model",
+		OwnedBy: ownedBy,
+		catalogExtension: &catalogExtension{
+			Name:              m.Name,
+			Type:              c.Type,
+			Family:            c.Family,
+			Version:           m.Version,
+			Tokenizer:         c.Tokenizer,
+			Preview:           m.Preview,
+			Enabled:           m.Policy == nil || m.Policy.State == "" || m.Policy.State == "enabled",
+			ContextWindow:     c.Limits.MaxContextWindowTokens,
+			MaxOutputTokens:   c.Limits.MaxOutputTokens,
+			MaxPromptTokens:   c.Limits.MaxPromptTokens,
+			Vision:            c.Supports.Vision,
+			ToolCalls:         c.Supports.ToolCalls || caps.EmulateTools,
+			ParallelToolCalls: c.Supports.ParallelToolCalls,
+			StructuredOutputs: c.Supports.StructuredOutputs,
+			// The proxy synthesizes streams for models that cannot stream
+			Streaming: streaming || caps.NoStream,
+		},
+	}
+}
+
+// catalogEntry is the cached model list of one account.
+type catalogEntry struct {
+	models  []catalogModel
+	fetched time.Time
+}
+
+type modelCatalog struct {
+	mu       sync.Mutex
+	accounts map[string]*catalogEntry // by caller key id
+}
+
+var catalog = &modelCatalog{accounts: make(map[string]*catalogEntry)}
+
+func catalogTTL() time.Duration {
+	if config.Catalog.TTLSeconds > 0 {
+		return time.Duration(config.Catalog.TTLSeconds) * time.Second
+	}
+	return defaultCatalogTTL
+}
+
+// models returns the caller's models, fetching them if the cached list is
+// missing or stale. A failed fetch drops the cached list.
+func (mc *modelCatalog) models(r *http.Request, token string) ([]catalogModel, error) {
+	key := callerKeyID(r)
+	mc.mu.Lock()
+	entry, ok := mc.accounts[key]
+	mc.mu.Unlock()
+	if ok && time.Since(entry.fetched) < catalogTTL() {
+		return entry.models, nil
+	}
+
+	models, err := fetchModels(r, token)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err != nil {
+		delete(mc.accounts, key)
+		return nil, err
+	}
+	mc.accounts[key] = &catalogEntry{models: models, fetched: time.Now()}
+	return models, nil
+}
+
+// invalidate drops the caller's cached list, for example after upstream
+// rejected one of its models.
+func (mc *modelCatalog) invalidate(r *http.Request) {
+	mc.mu.Lock()
+	delete(mc.accounts, callerKeyID(r))
+	mc.mu.Unlock()
+}
+
+// noteChatError drops the caller's cached list when upstream rejects a chat
+// request in a way that suggests the list is out of date: a model that is
+// unknown or no longer available to the account. Other bad requests, such as
+// invalid parameters, leave it alone.
+func (mc *modelCatalog) noteChatError(r *http.Request, err *upstreamError) {
+	switch err.Status {
+	case http.StatusForbidden, http.StatusNotFound:
+		mc.invalidate(r)
+	case http.StatusBadRequest:
+		if code, _ := err.Err.Code.(string); strings.Contains(strings.ToLower(code), "model") {
+			mc.invalidate(r)
+		}
+	}
+}
+
+// noteChatResponse is noteChatError for an upstream response relayed as is.
+// The body of a bad request is read for its error code and put back.
+func (mc *modelCatalog) noteChatResponse(r *http.Request, resp *http.Response) {
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusNotFound:
+		mc.invalidate(r)
+	case http.StatusBadRequest:
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		mc.noteChatError(r, &upstreamError{Status: resp.StatusCode, Err: unstream.ParseOAIError(body)})
+	}
+}
+
+// lookup returns the caller's model with the given id, or an alias for one.
+func (mc *modelCatalog) lookup(r *http.Request, token, id string) (*catalogModel, error) {
+	models, err := mc.models(r, token)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range withAliases(models) {
+		if m.ID == id {
+			return &m, nil
+		}
+	}
+	return nil, nil
+}
+
+func fetchModels(r *http.Request, token string) ([]catalogModel, error) {
+	modelsR := r.Clone(r.Context())
+	modelsR.Method = http.MethodGet
+	modelsR.URL.Path = "/models"
+	modelsR.URL.RawPath = ""
+	req, err := newUpstreamRequest(modelsR, nil, token)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, newUpstreamError(http.StatusBadGateway, "upstream request failed: "+err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, readUpstreamError(resp)
+	}
+	var list struct {
+		Data []copilotModel `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, newUpstreamError(http.StatusBadGateway, "invalid upstream model list: "+err.Error())
+	}
+	models := make([]catalogModel, 0, len(list.Data))
+	seen := make(map[string]bool)
+	for i := range list.Data {
+		// Copilot lists some models once per endpoint they are served from
+		if id := list.Data[i].ID; id != "" && !seen[id] {
+			seen[id] = true
+			models = append(models, normalizeModel(&list.Data[i]))
+		}
+	}
+	log.Printf("Fetched %d models for key %s", len(models), callerKeyID(r))
+	return models, nil
+}
+
+// withAliases appends an entry for every route with an exact match that
+// points at a listed model. Glob routes cannot be listed.
+func withAliases(models []catalogModel) []catalogModel {
+	byID := make(map[string]*catalogModel, len(models))
+	for i := range models {
+		byID[models[i].ID] = &models[i]
+	}
+	out := append([]catalogModel(nil), models...)
+	for _, rule := range config.Routes {
+		if strings.ContainsAny(rule.Match, "*?[") || byID[rule.Match] != nil {
+			continue
+		}
+		target, ok := byID[rule.Model]
+		if !ok {
+			continue
+		}
+		alias := *target
+		ext := *target.catalogExtension
+		ext.AliasFor = target.ID
+		alias.ID, alias.catalogExtension = rule.Match, &ext
+		byID[alias.ID] = &alias
+		out = append(out, alias)
+	}
+	return out
+}
+
+// present strips the extended fields unless they were asked for.
+func (m catalogModel) present(extended bool) catalogModel {
+	if !extended {
+		m.catalogExtension = nil
+	}
+	return m
+}
+
+func wantsExtended(r *http.Request) bool {
+	v := r.URL.Query().Get("extended")
+	return v == "true" || v == "1"
+}
+
+// handleModels serves /v1/models and /v1/models/{id}.
+func handleModels(w http.ResponseWriter, r *http.Request) {
+	ct, ok := copilotToken(w, r)
+	if !ok {
+		return
+	}
+	extended := wantsExtended(r)
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1"), "/models")
+	id = strings.TrimPrefix(id, "/")
+
+	if id == "" {
+		models, err := catalog.models(r, ct.Token)
+		if err != nil {
+			log.Printf("Failed to fetch models: %v", err)
+			writeUpstreamError(w, err)
+			return
+		}
+		data := []catalogModel{}
+		for _, m := range withAliases(models) {
+			data = append(data, m.present(extended))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data})
+		return
+	}
+
+	m, err := catalog.lookup(r, ct.Token, id)
+	if err != nil {
+		log.Printf("Failed to fetch models: %v", err)
+		writeUpstreamError(w, err)
+		return
+	}
+	if m == nil {
+		writeAPIError(w, http.StatusNotFound, "invalid_request_error", "The model '"+id+"' does not exist")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.present(extended))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeModel(t *testing.T) {
+	cases := []struct {
+		raw       string
+		ownedBy   string
+		enabled   bool
+		streaming bool
+	}{
+		{`{"id":"gpt-4o","vendor":"Azure OpenAI"}`, "Azure OpenAI", true, true},
+		{`{"id":"gpt-4o","policy":{"state":"enabled"}}`, "github-copilot", true, true},
+		{`{"id":"claude-opus-4","policy":{"state":"disabled"}}`, "github-copilot", false, true},
+		{`{"id":"gpt-x","capabilities":{"supports":{"streaming":false}}}`, "github-copilot", true, false},
+		{`{"id":"gpt-x","capabilities":{"supports":{"streaming":true}}}`, "github-copilot", true, true},
+		// The proxy synthesizes the streams of models known not to stream
+		{`{"id":"o1","capabilities":{"supports":{"streaming":false}}}`, "github-copilot", true, true},
+	}
+	for _, c := range cases {
+		var m copilotModel
+		if err := json.Unmarshal([]byte(c.raw), &m); err != nil {
+			t.Fatal(err)
+		}
+		got := normalizeModel(&m)
+		if got.Object != "model" || got.OwnedBy != c.ownedBy || got.Enabled != c.enabled || got.Streaming != c.streaming {
+			t.Errorf("%s: owned by %s, enabled %v, streaming %v", c.raw, got.OwnedBy, got.Enabled, got.Streaming)
+		}
+	}
+}
+
+func TestWithAliases(t *testing.T) {
+	config = &Config{Routes: []routeRule{
+		{Match: "fast", Model: "gpt-4o-mini"},
+		{Match: "fast", Model: "gpt-4o"},
+		{Match: "smart*", Model: "gpt-4o"},
+		{Match: "gpt-4o", Model: "gpt-4o-mini"},
+		{Match: "missing", Model: "o9"},
+	}}
+	defer func() { config = &Config{} }()
+	models := []catalogModel{
+		{ID: "gpt-4o", catalogExtension: &catalogExtension{ContextWindow: 128000}},
+		{ID: "gpt-4o-mini", catalogExtension: &catalogExtension{ContextWindow: 64000}},
+	}
+
+	var got []string
+	for _, m := range withAliases(models) {
+		got = append(got, m.ID+">"+m.AliasFor)
+	}
+	// The first exact route wins; globs, listed models and routes to
+	// unknown models have no alias
+	want := []string{"gpt-4o>", "gpt-4o-mini>", "fast>gpt-4o-mini"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withAliases = %v, want %v", got, want)
+	}
+	if models[1].AliasFor != "" {
+		t.Error("alias changed the listed model")
+	}
+}
+
+func TestCatalogTTL(t *testing.T) {
+	defer func() { config = &Config{} }()
+	for ttl, want := range map[int]time.Duration{0: 10 * time.Minute, -5: 10 * time.Minute, 60: time.Minute} {
+		config = &Config{Catalog: catalogConfig{TTLSeconds: ttl}}
+		if got := catalogTTL(); got != want {
+			t.Errorf("ttl_seconds %d: TTL %v, want %v", ttl, got, want)
+		}
+	}
+
+	// A list younger than the TTL is served without asking upstream
+	config = &Config{}
+	r := callerRequest("a")
+	cached := []catalogModel{{ID: "gpt-4o"}}
+	mc := &modelCatalog{accounts: map[string]*catalogEntry{
+		callerKeyID(r): {models: cached, fetched: time.Now().Add(-9 * time.Minute)},
+	}}
+	if models, err := mc.models(r, "ct"); err != nil || !reflect.DeepEqual(models, cached) {
+		t.Errorf("cached list served as %v, %v", models, err)
+	}
+}
+
+func TestNoteChatError(t *testing.T) {
+	cases := []struct {
+		status      int
+		body        string
+		invalidates bool
+	}{
+		{http.StatusNotFound, `{"error":{"message":"Not Found"}}`, true},
+		{http.StatusForbidden, `{"error":{"message":"Model disabled for this account"}}`, true},
+		{http.StatusBadRequest, `{"error":{"message":"The requested model is not supported.","code":"model_not_supported"}}`, true},
+		{http.StatusBadRequest, `{"error":{"message":"Unknown model","code":"invalid_model"}}`, true},
+		// Bad requests that do not concern the model keep the list
+		{http.StatusBadRequest, `{"error":{"message":"Invalid temperature","param":"temperature","code":"invalid_value"}}`, false},
+		{http.StatusBadRequest, `{"error":{"message":"Invalid request"}}`, false},
+		{http.StatusTooManyRequests, `{"error":{"message":"Slow down"}}`, false},
+		{http.StatusOK, `{}`, false},
+	}
+	r := callerRequest("a")
+	fresh := func() *modelCatalog {
+		return &modelCatalog{accounts: map[string]*catalogEntry{callerKeyID(r): {fetched: time.Now()}}}
+	}
+	for _, c := range cases {
+		resp := &http.Response{StatusCode: c.status, Body: io.NopCloser(strings.NewReader(c.body))}
+		mc := fresh()
+		mc.noteChatResponse(r, resp)
+		_, kept := mc.accounts[callerKeyID(r)]
+		if kept == c.invalidates {
+			t.Errorf("%d %s: list kept %v", c.status, c.body, kept)
+		}
+		// The client still gets the whole error
+		if body, _ := io.ReadAll(resp.Body); string(body) != c.body {
+			t.Errorf("%d: body relayed as %s", c.status, body)
+		}
+
+		if c.status < http.StatusBadRequest {
+			continue
+		}
+		mc = fresh()
+		mc.noteChatError(r, readUpstreamError(&http.Response{StatusCode: c.status, Body: io.NopCloser(strings.NewReader(c.body))}))
+		if _, kept := mc.accounts[callerKeyID(r)]; kept == c.invalidates {
+			t.Errorf("%d %s: list kept %v after a buffered request", c.status, c.body, kept)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// chatRequest is a chat completion request as read by handleGitHubProxy, with
+// the fields the proxy needs to decide how to talk to upstream.
+type chatRequest struct {
+	r     *http.Request
+	token string // Copilot token
+	body  []byte
+	caps  modelCapabilities
+
+	// emulateTools is set when the request has tools but the model lacks
+	// native function calling, see toolemulation.go.
+	emulateTools bool
+	// route is how the requested model was resolved, see routing.go.
+	route *modelRoute
+	// fallbackFrom is the model the request was first sent to, when another
+	// one of its fallback chain served it, see fallback.go.
+	fallbackFrom string
+	// cacheKey is set when the response is to be stored in the response
+	// cache, see cache.go.
+	cacheKey string
+	// scrubbed holds what was redacted from the request, see scrub.go.
+	scrubbed *scrubbing
+
+	Stream         bool            `json:"stream"`
+	Model          string          `json:"model"`
+	N              int             `json:"n"`
+	Tools          []chatTool      `json:"tools"`
+	ToolChoice     json.RawMessage `json:"tool_choice"`
+	ResponseFormat *responseFormat `json:"response_format"`
+	StreamOptions  *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+type chatTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+func newChatRequest(r *http.Request, token string, body []byte) *chatRequest {
+	cr := &chatRequest{r: r, token: token, body: body}
+	_ = json.Unmarshal(body, cr)
+	cr.caps = lookupCapabilities(cr.Model)
+	cr.emulateTools = cr.caps.EmulateTools && len(cr.Tools) > 0
+	return cr
+}
+
+// adaptBody rewrites a request body for what the model supports: tool calling
+// emulation and response_format instructions in the prompt.
+func (cr *chatRequest) adaptBody(body map[string]any) map[string]any {
+	if cr.emulateTools {
+		body = emulateToolsBody(cr, body)
+	}
+	if cr.caps.NoResponseFormat && cr.ResponseFormat != nil && cr.ResponseFormat.Type != "text" {
+		body = injectSchemaBody(cr, body)
+	}
+	return body
+}
+
+// upstreamBody returns the body to forward as is, adapted to the model.
+func (cr *chatRequest) upstreamBody() []byte {
+	// Stream modes only differ from the client's after a fallback to a model
+	// with other capabilities; the response is then converted by the caller
+	noStream := cr.Stream && cr.caps.NoStream
+	forceStream := !cr.Stream && cr.caps.ForceStream && !cr.caps.NoStream
+	if !cr.emulateTools && !cr.caps.NoResponseFormat && !noStream && !forceStream && !cr.injectsUsage() {
+		return cr.body
+	}
+	body, err := cr.bodyMap()
+	if err != nil {
+		return cr.body
+	}
+	body = cr.adaptBody(body)
+	if noStream {
+		body["stream"] = false
+		delete(body, "stream_options")
+	} else if forceStream {
+		body["stream"] = true
+	}
+	if (forceStream && config.InjectStreamUsage) || (!noStream && cr.injectsUsage()) {
+		body["stream_options"] = map[string]any{"include_usage": true}
+	}
+	b, _ := json.Marshal(body)
+	return b
+}
+
+// needsBuffering reports whether the complete response has to be fetched
+// before the client can be answered.
+func (cr *chatRequest) needsBuffering() bool {
+	if cr.Stream {
+		return cr.caps.NoStream || cr.structuredOutput() || (cr.emulateTools && parseToolChoice(cr.ToolChoice).mustCall())
+	}
+	return cr.caps.ForceStream || cr.emulateTools || toolValidationEnabled(cr) || cr.structuredOutput() || cr.route.rewritesModel() || cr.cacheKey != "" || cr.restoresPlaceholders()
+}
+
+// needsRelay reports whether a streamed response has to be inspected chunk by
+// chunk instead of being copied through.
+func (cr *chatRequest) needsRelay() bool {
+	return cr.emulateTools || toolValidationEnabled(cr) || cr.route.rewritesModel() || cr.cacheKey != "" || cr.restoresPlaceholders()
+}
+
+// mergeChoices reports whether streamed choices should be folded into one.
+func (cr *chatRequest) mergeChoices() bool {
+	return cr.N <= 1
+}
+
+// bodyMap decodes a fresh copy of the request body for modification.
+func (cr *chatRequest) bodyMap() (map[string]any, error) {
+	var m map[string]any
+	if err := json.Unmarshal(cr.body, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// completeChat sends body upstream and returns the complete response. The
+// request is streamed or not as the model's capabilities require, and adapted
+// to the features the model lacks.
+func completeChat(cr *chatRequest, body map[string]any) (*unstream.OAIChatResponse, http.Header, error) {
+	original, _ := json.Marshal(body)
+	resp, err := sendChat(cr, func() []byte {
+		// Rebuilt for every model tried, since adapting depends on the model
+		var body map[string]any
+		json.Unmarshal(original, &body)
+		body["model"] = cr.Model
+		body = cr.adaptBody(body)
+		if cr.caps.ForceStream && !cr.caps.NoStream {
+			body["stream"] = true
+			if config.InjectStreamUsage {
+				body["stream_options"] = map[string]any{"include_usage": true}
+			}
+		} else {
+			body["stream"] = false
+			delete(body, "stream_options")
+		}
+		newBody, _ := json.Marshal(body)
+		return newBody
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	final, err := readCompletion(resp, cr.mergeChoices())
+	if err == nil && cr.emulateTools {
+		applyEmulatedToolCalls(cr, final)
+	}
+	return final, resp.Header, err
+}
+
+// finishCompletion applies the response processing shared by every path that
+// holds a complete response before the client sees it. It returns the number
+// of tool calls that are still invalid after validation.
+func finishCompletion(cr *chatRequest, final *unstream.OAIChatResponse) (*unstream.OAIChatResponse, int, error) {
+	if cr.emulateTools {
+		var err error
+		if final, err = enforceEmulatedToolChoice(cr, final); err != nil {
+			return nil, 0, err
+		}
+	}
+	final, invalid, err := applyToolValidation(cr, final)
+	if err != nil {
+		return nil, invalid, err
+	}
+	if final, err = applyStructuredOutput(cr, final); err != nil {
+		return nil, invalid, err
+	}
+	restorePlaceholders(cr, final)
+	cr.route.presentModel(final)
+	return final, invalid, nil
+}
+
+// handleBufferedCompletion fetches the complete response before answering,
+// for models whose streaming mode does not match the client's and for
+// responses that have to be checked before the client sees them. The result is
+// written as JSON or as a synthesized stream, whichever the client asked for.
+func handleBufferedCompletion(w http.ResponseWriter, cr *chatRequest) {
+	log.Printf("Buffering completion for %s (client stream=%v)", cr.Model, cr.Stream)
+	body, err := cr.bodyMap()
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON")
+		return
+	}
+	final, header, err := completeChat(cr, body)
+	cr.setServedHeaders(w)
+	if err != nil {
+		log.Printf("Buffered completion failed: %v", err)
+		var upErr *upstreamError
+		if errors.As(err, &upErr) {
+			catalog.noteChatError(cr.r, upErr)
+		}
+		writeUpstreamError(w, err)
+		return
+	}
+	final, invalid, err := finishCompletion(cr, final)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	if invalid > 0 {
+		w.Header().Set("X-Copilot-Proxy-Tool-Validation", "invalid")
+	}
+	publishCompletion(cr, final)
+	storeCachedChat(cr, final)
+	writeCompletion(w, cr, header, final)
+	log.Println("Copilot Request Completed (buffered)")
+}
+
+// writeCompletion writes a complete response in the form the client asked for.
+func writeCompletion(w http.ResponseWriter, cr *chatRequest, header http.Header, final *unstream.OAIChatResponse) {
+	if cr.Stream {
+		writeSynthesizedStream(w, header, final)
+		return
+	}
+	// Copy all headers except for the framing ones (since we're not streaming)
+	copyHeaders(w, header, bodyFramingHeaders)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(final)
+}
+
+// bodyFramingHeaders describe the upstream body and must not be copied when
+// the proxy writes a body of its own.
+var bodyFramingHeaders = map[string]struct{}{
+	"Content-Length":    {},
+	"Content-Type":      {},
+	"Transfer-Encoding": {},
+}
+
+// writeSynthesizedStream replays a complete response as chat.completion.chunk events.
+func writeSynthesizedStream(w http.ResponseWriter, header http.Header, final *unstream.OAIChatResponse) {
+	copyHeaders(w, header, bodyFramingHeaders)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	chunks := unstream.SynthesizeStream(final, unstream.SynthesizeOptions{
+		ContentChunkSize: config.StreamChunkSize,
+		IncludeUsage:     true,
+	})
+	for i := range chunks {
+		if err := unstream.WriteSSEChunk(w, &chunks[i]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	unstream.WriteSSEDone(w)
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Legacy text completions (/v1/completions) are served by the chat completions
+// API: every prompt becomes a conversation of its own, the prompts of a batch
+// are sent upstream a few at a time, and the answers are shaped back into
+// text_completion objects.
+
+const (
+	// maxCompletionPrompts is the largest number of prompts in one request.
+	maxCompletionPrompts = 32
+	// completionParallelism is how many prompts of a request are sent
+	// upstream at once.
+	completionParallelism = 4
+)
+
+type completionRequest struct {
+	Model         string          `json:"model"`
+	Prompt        json.RawMessage `json:"prompt"`
+	Suffix        string          `json:"suffix"`
+	Echo          bool            `json:"echo"`
+	Logprobs      *int            `json:"logprobs"`
+	N             int             `json:"n"`
+	Stream        bool            `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+// completionPassthrough lists the parameters that mean the same thing for
+// chat completions and are copied over as they are.
+var completionPassthrough = []string{
+	"max_tokens", "temperature", "top_p", "n", "stop", "presence_penalty",
+	"frequency_penalty", "seed", "user", "logit_bias", "stream", "stream_options",
+}
+
+// maxTopLogprobs is the largest top_logprobs the chat API accepts.
+const maxTopLogprobs = 20
+
+const completionInstructions = "Continue the text in the user's message. Reply with the continuation only, " +
+	"without repeating the text and without any commentary."
+
+type textCompletion struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []textCompletionChoice `json:"choices"`
+	Usage   *unstream.OAIUsage     `json:"usage,omitempty"`
+}
+
+type textCompletionChoice struct {
+	Text         string        `json:"text"`
+	Index        int           `json:"index"`
+	Logprobs     *textLogprobs `json:"logprobs"`
+	FinishReason *string       `json:"finish_reason"`
+}
+
+// textLogprobs is the legacy logprobs format, with one entry per token.
+type textLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
+}
+
+func handleCompletions(w http.ResponseWriter, r *http.Request) {
+	log.Println("Forwarding legacy completion request")
+	ct, ok := copilotToken(w, r)
+	if !ok {
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var req completionRequest
+	var raw map[string]any
+	if json.Unmarshal(body, &req) != nil || json.Unmarshal(body, &raw) != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON")
+		return
+	}
+	prompts, err := parsePrompts(req.Prompt)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	// Prompts are sent scrubbed, but echoed as the client sent them
+	scrubbedBody, scrubbed, ok := scrubRequest(w, r, body)
+	if !ok {
+		return
+	}
+	chatPrompts := prompts
+	if scrubbed != nil {
+		raw = nil
+		json.Unmarshal(scrubbedBody, &req)
+		json.Unmarshal(scrubbedBody, &raw)
+		chatPrompts, _ = parsePrompts(req.Prompt)
+	}
+	model := config.CompletionsModel
+	if model == "" {
+		model = req.Model
+	}
+	if model == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "model is required")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	chatR := r.Clone(ctx)
+	chatR.URL.Path = "/chat/completions"
+	chatR.URL.RawPath = ""
+	crs := make([]*chatRequest, len(prompts))
+	var labels []string
+	for i, prompt := range chatPrompts {
+		b, _ := json.Marshal(completionChatBody(raw, &req, model, prompt))
+		// The chat body has no prompt_template, so this cannot fail
+		b, labels, _ = applyPrompts(w, chatR, b)
+		b, route := routeChat(chatR, b)
+		crs[i] = newChatRequest(chatR, ct.Token, b)
+		crs[i].route = route
+		crs[i].scrubbed = scrubbed
+	}
+	crs[0].route.setModelHeader(w)
+	recordPrompts(w, r, labels)
+	// Every prompt is checked as the chat request it is sent as, against the
+	// model it is routed to
+	for _, cr := range crs {
+		if !enforcePolicy(w, r, cr.body, cr.route.upstreamModel()) {
+			return
+		}
+	}
+	// Every prompt is a request of its own upstream
+	release, ok := admitRequests(w, r, req.Stream, len(prompts))
+	if !ok {
+		return
+	}
+	defer release()
+	if req.Stream {
+		streamCompletions(w, &req, prompts, crs, cancel)
+	} else {
+		bufferCompletions(w, &req, prompts, crs)
+	}
+	log.Printf("Legacy completion request completed (%d prompts)", len(prompts))
+}
+
+// parsePrompts returns the prompts of a request. Token array prompts cannot be
+// expressed as chat messages and are rejected.
+func parsePrompts(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return []string{""}, nil
+	}
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return []string{single}, nil
+	}
+	var many []string
+	if json.Unmarshal(raw, &many) != nil {
+		return nil, errors.New("prompt must be a string or an array of strings; token prompts are not supported")
+	}
+	if len(many) == 0 {
+		return nil, errors.New("prompt must not be an empty array")
+	}
+	if len(many) > maxCompletionPrompts {
+		return nil, fmt.Errorf("prompt must not have more than %d entries", maxCompletionPrompts)
+	}
+	return many, nil
+}
+
+// completionChatBody builds the chat completion request for one prompt.
+func completionChatBody(raw map[string]any, req *completionRequest, model, prompt string) map[string]any {
+	body := map[string]any{"model": model}
+	for _, k := range completionPassthrough {
+		if v, ok := raw[k]; ok {
+			body[k] = v
+		}
+	}
+	instructions := completionInstructions
+	if req.Suffix != "" {
+		instructions += " The continuation is inserted before the following text and has to lead into it:\n\n" + req.Suffix
+	}
+	body["messages"] = []any{
+		map[string]any{"role": "system", "content": instructions},
+		map[string]any{"role": "user", "content": prompt},
+	}
+	if req.Logprobs != nil {
+		body["logprobs"] = true
+		body["top_logprobs"] = min(max(*req.Logprobs, 0), maxTopLogprobs)
+	}
+	return body
+}
+
+// choicesPerPrompt is the number of choices each prompt contributes, used to
+// number choices across the prompts of a batch.
+func (req *completionRequest) choicesPerPrompt() int {
+	return max(req.N, 1)
+}
+
+// bufferCompletions answers a non-streaming request once every prompt has
+// been completed.
+func bufferCompletions(w http.ResponseWriter, req *completionRequest, prompts []string, crs []*chatRequest) {
+	finals := make([]*unstream.OAIChatResponse, len(crs))
+	errs := make([]error, len(crs))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, completionParallelism)
+	for i, cr := range crs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			body, err := cr.bodyMap()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			final, _, err := completeChat(cr, body)
+			if err == nil {
+				final, _, err = finishCompletion(cr, final)
+			}
+			finals[i], errs[i] = final, err
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			log.Printf("Legacy completion failed: %v", err)
+			writeUpstreamError(w, err)
+			return
+		}
+	}
+
+	out := textCompletion{
+		ID:      "cmpl-" + uuid.New().String(),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   finals[0].Model,
+	}
+	for i, final := range finals {
+		for _, choice := range final.Choices {
+			text, offset := "", 0
+			if req.Echo {
+				text, offset = prompts[i], len(prompts[i])
+			}
+			if choice.Message.Content != nil {
+				text += *choice.Message.Content
+			}
+			finishReason := choice.FinishReason
+			out.Choices = append(out.Choices, textCompletionChoice{
+				Text:         text,
+				Index:        i*req.choicesPerPrompt() + choice.Index,
+				Logprobs:     textCompletionLogprobs(choice.Logprobs, offset),
+				FinishReason: &finishReason,
+			})
+		}
+		out.Usage = addUsage(out.Usage, final.Usage)
+	}
+	chargeUsage(crs[0].r, crs[0].Model, len(crs), out.Usage)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(out)
+}
+
+// chunkSource yields the chat completion chunks of one upstream call until io.EOF.
+type chunkSource func() (*unstream.OAIStreamChunk, error)
+
+// openChatStream starts a streaming chat completion. Upstream errors are
+// returned before the client has been answered, so they can still be relayed
+// with their status. Models that cannot stream are completed in full and
+// replayed as synthesized chunks.
+func openChatStream(cr *chatRequest) (chunkSource, io.Closer, error) {
+	if cr.caps.NoStream {
+		body, err := cr.bodyMap()
+		if err != nil {
+			return nil, nil, err
+		}
+		final, _, err := completeChat(cr, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return synthesizedSource(final), nil, nil
+	}
+	resp, err := sendChat(cr, cr.upstreamBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest || isJSONResponse(resp) {
+		defer resp.Body.Close()
+		final, err := readCompletion(resp, cr.mergeChoices())
+		if err != nil {
+			return nil, nil, err
+		}
+		return synthesizedSource(final), nil, nil
+	}
+	return unstream.NewOAIStreamReader(resp.Body).Next, resp.Body, nil
+}
+
+// restoringSource puts the redacted values back in the content of a source's
+// chunks.
+func restoringSource(cr *chatRequest, next chunkSource) chunkSource {
+	if !cr.restoresPlaceholders() {
+		return next
+	}
+	ph := newPlaceholderStream(cr.scrubbed)
+	return func() (*unstream.OAIStreamChunk, error) {
+		chunk, err := next()
+		if errors.Is(err, io.EOF) {
+			if held := ph.flush(); held != nil {
+				return held, nil
+			}
+		}
+		if err == nil {
+			ph.filter(chunk)
+		}
+		return chunk, err
+	}
+}
+
+func synthesizedSource(final *unstream.OAIChatResponse) chunkSource {
+	chunks := unstream.SynthesizeStream(final, unstream.SynthesizeOptions{
+		ContentChunkSize: config.StreamChunkSize,
+		IncludeUsage:     true,
+	})
+	return func() (*unstream.OAIStreamChunk, error) {
+		if len(chunks) == 0 {
+			return nil, io.EOF
+		}
+		chunk := &chunks[0]
+		chunks = chunks[1:]
+		return chunk, nil
+	}
+}
+
+// streamCompletions streams the completions of every prompt to the client as
+// they arrive, interleaved and numbered by prompt. A failure ends the whole
+// response and cancels the other prompts: with its status when nothing has
+// been written yet, with an error event otherwise.
+func streamCompletions(w http.ResponseWriter, req *completionRequest, prompts []string, crs []*chatRequest, cancel context.CancelFunc) {
+	flusher, _ := w.(http.Flusher)
+	var (
+		mu        sync.Mutex
+		usage     *unstream.OAIUsage
+		streamErr error
+		started   bool
+	)
+	// start writes the response headers. mu must be held.
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+	}
+	id := "cmpl-" + uuid.New().String()
+	created := time.Now().Unix()
+	write := func(chunk *textCompletion) {
+		mu.Lock()
+		defer mu.Unlock()
+		if streamErr != nil {
+			return
+		}
+		start()
+		unstream.WriteSSEJSON(w, chunk)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	fail := func(err error) {
+		mu.Lock()
+		if streamErr == nil {
+			streamErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return streamErr != nil
+	}
+	newChunk := func(model string, choices ...textCompletionChoice) *textCompletion {
+		return &textCompletion{ID: id, Object: "text_completion", Created: created, Model: model, Choices: choices}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, completionParallelism)
+	for i, cr := range crs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if failed() {
+				return
+			}
+			next, closer, err := openChatStream(cr)
+			if err != nil {
+				fail(err)
+				return
+			}
+			if closer != nil {
+				defer closer.Close()
+			}
+			next = restoringSource(cr, next)
+			base := i * req.choicesPerPrompt()
+			offsets := make(map[int]int)
+			if req.Echo {
+				for j := range req.choicesPerPrompt() {
+					write(newChunk(cr.route.responseModel(cr.Model), textCompletionChoice{Text: prompts[i], Index: base + j}))
+					offsets[j] = len(prompts[i])
+				}
+			}
+			for {
+				chunk, err := next()
+				if errors.Is(err, io.EOF) {
+					return
+				}
+				if err != nil {
+					fail(err)
+					return
+				}
+				if chunk.Usage != nil {
+					mu.Lock()
+					usage = addUsage(usage, chunk.Usage)
+					mu.Unlock()
+				}
+				var choices []textCompletionChoice
+				for _, ch := range chunk.Choices {
+					idx := ch.Index
+					if req.choicesPerPrompt() == 1 {
+						// Some models spread a single answer over several choices
+						idx = 0
+					}
+					text := ""
+					if ch.Delta.Content != nil {
+						text = *ch.Delta.Content
+					}
+					if text == "" && ch.FinishReason == nil && ch.Logprobs == nil {
+						continue
+					}
+					choices = append(choices, textCompletionChoice{
+						Text:         text,
+						Index:        base + idx,
+						Logprobs:     textCompletionLogprobs(ch.Logprobs, offsets[idx]),
+						FinishReason: ch.FinishReason,
+					})
+					offsets[idx] += len(text)
+				}
+				if len(choices) > 0 {
+					write(newChunk(cr.route.responseModel(chunk.Model), choices...))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if streamErr != nil && !started {
+		log.Printf("Legacy completion failed: %v", streamErr)
+		writeUpstreamError(w, streamErr)
+		return
+	}
+	chargeUsage(crs[0].r, crs[0].Model, len(crs), usage)
+
+	if streamErr != nil {
+		log.Printf("Legacy completion stream failed: %v", streamErr)
+		writeStreamError(w, streamErr)
+		return
+	}
+	start()
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage && usage != nil {
+		last := newChunk(crs[0].route.responseModel(crs[0].Model))
+		last.Choices = []textCompletionChoice{}
+		last.Usage = usage
+		unstream.WriteSSEJSON(w, last)
+	}
+	unstream.WriteSSEDone(w)
+}
+
+// textCompletionLogprobs converts chat logprobs into the legacy format. offset
+// is the position of the first token in the choice's text.
+func textCompletionLogprobs(lp *unstream.OAILogprobs, offset int) *textLogprobs {
+	if lp == nil {
+		return nil
+	}
+	out := &textLogprobs{}
+	for _, t := range lp.Content {
+		top := make(map[string]float64, len(t.TopLogprobs))
+		for _, alt := range t.TopLogprobs {
+			top[alt.Token] = alt.Logprob
+		}
+		out.Tokens = append(out.Tokens, t.Token)
+		out.TokenLogprobs = append(out.TokenLogprobs, t.Logprob)
+		out.TopLogprobs = append(out.TopLogprobs, top)
+		out.TextOffset = append(out.TextOffset, offset)
+		offset += len(t.Token)
+	}
+	return out
+}
+
+// addUsage adds u to total, either of which may be nil.
+func addUsage(total, u *unstream.OAIUsage) *unstream.OAIUsage {
+	if u == nil {
+		return total
+	}
+	if total == nil {
+		total = &unstream.OAIUsage{}
+	}
+	total.PromptTokens += u.PromptTokens
+	total.CompletionTokens += u.CompletionTokens
+	total.TotalTokens += u.TotalTokens
+	if u.PromptTokensDetails != nil {
+		if total.PromptTokensDetails == nil {
+			total.PromptTokensDetails = &unstream.OAIPromptTokensDetails{}
+		}
+		total.PromptTokensDetails.CachedTokens += u.PromptTokensDetails.CachedTokens
+	}
+	return total
+}
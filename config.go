@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Config is the optional proxy configuration, loaded from the JSON file given
+// with -config. Every field has a usable zero value so the proxy runs without one.
+type Config struct {
+	// Models overrides or extends the built-in capability table. Keys are model
+	// name prefixes; the longest matching prefix wins.
+	Models map[string]modelCapabilities `json:"models"`
+	// StreamChunkSize is the number of runes per content delta when a stream is
+	// synthesized from a non-streaming upstream response. 0 sends one delta.
+	StreamChunkSize int `json:"stream_chunk_size"`
+	// ToolValidation checks tool call arguments against the schemas declared in
+	// the request's tools, repairing them where possible. nil disables it.
+	ToolValidation *toolValidationConfig `json:"tool_validation"`
+	// StructuredOutputs controls validation of responses against the request's
+	// response_format. It is enabled unless disabled here.
+	StructuredOutputs structuredOutputConfig `json:"structured_outputs"`
+	// CompletionsModel is the chat model that serves legacy /completions
+	// requests. Empty uses the model named in the request.
+	CompletionsModel string `json:"completions_model"`
+	// FIM configures the code completion endpoint.
+	FIM fimConfig `json:"fim"`
+	// Embeddings configures batching and caching of embeddings requests.
+	Embeddings embeddingsConfig `json:"embeddings"`
+	// Routes map requested model names onto upstream models, see routing.go.
+	Routes []routeRule `json:"routes"`
+	// Catalog configures caching of the model list served at /v1/models.
+	Catalog catalogConfig `json:"catalog"`
+	// Fallbacks lists the models to try when a model fails, see fallback.go.
+	Fallbacks fallbackConfig `json:"fallbacks"`
+	// Cache configures the response cache, see cache.go.
+	Cache responseCacheConfig `json:"cache"`
+	// RateLimits limits what each caller can send, see ratelimit.go.
+	RateLimits rateLimitConfig `json:"rate_limits"`
+	// Quotas sets token and premium request budgets, see quota.go.
+	Quotas quotaConfig `json:"quotas"`
+	// Ledger records every request for usage reports, see ledger.go.
+	Ledger ledgerConfig `json:"ledger"`
+	// AdminKeys are the full SHA-256 hashes, in hex, of the tokens allowed to
+	// use the /admin endpoints.
+	AdminKeys []string `json:"admin_keys"`
+	// InjectStreamUsage asks upstream for the usage of every stream, see
+	// streamtee.go.
+	InjectStreamUsage bool `json:"inject_stream_usage"`
+	// Audit records request and response bodies, see audit.go.
+	Audit auditConfig `json:"audit"`
+	// Scrub scans chat requests for secrets and personal data, see scrub.go.
+	Scrub scrubConfig `json:"scrub"`
+	// Policies restrict what each caller may send, see policy.go.
+	Policies policyConfig `json:"policies"`
+	// Prompts are managed system prompts, see prompts.go.
+	Prompts promptsConfig `json:"prompts"`
+	// Tokenizer configures token counting and the context window check, see
+	// tokens.go.
+	Tokenizer tokenizerConfig `json:"tokenizer"`
+	// ContextWindow shortens prompts that do not fit the model, see
+	// contextwindow.go.
+	ContextWindow contextWindowConfig `json:"context_window"`
+	// Threads configures the storage of conversation threads, see threads.go.
+	Threads threadsConfig `json:"threads"`
+}
+
+var config = &Config{}
+
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Chat requests whose prompt does not fit the model can be shortened before
+// they are sent, by strategies applied in order until it fits: truncating
+// large tool outputs, dropping the oldest messages, and summarizing the early
+// conversation with another model.
+
+const (
+	defaultMaxToolOutputTokens = 1000
+	defaultSummaryModel        = "gpt-4o-mini"
+	defaultKeepRecent          = 6
+	// summaryMaxTokens caps the length of summaries.
+	summaryMaxTokens = 1024
+	// transcriptMessageRunes caps each message in the transcript that is
+	// summarized, so that the summary request fits the summary model.
+	transcriptMessageRunes = 8000
+)
+
+type contextWindowConfig struct {
+	// Enabled turns context management on.
+	Enabled bool `json:"enabled"`
+	// Strategies are applied in order until the prompt fits:
+	// "truncate_tool_outputs", "drop_oldest" and "summarize". Defaults to
+	// truncate_tool_outputs then drop_oldest.
+	Strategies []string `json:"strategies"`
+	// MaxToolOutputTokens is what tool outputs are truncated to. Defaults to
+	// 1000 tokens.
+	MaxToolOutputTokens int `json:"max_tool_output_tokens"`
+	// SummaryModel writes the summaries. Defaults to gpt-4o-mini.
+	SummaryModel string `json:"summary_model"`
+	// KeepRecent is the number of messages at the end of the conversation
+	// that are never summarized, counting a tool call with its results as
+	// one. Defaults to 6.
+	KeepRecent int `json:"keep_recent"`
+}
+
+func (c *contextWindowConfig) strategies() []string {
+	if len(c.Strategies) > 0 {
+		return c.Strategies
+	}
+	return []string{"truncate_tool_outputs", "drop_oldest"}
+}
+
+func (c *contextWindowConfig) maxToolOutputTokens() int {
+	if c.MaxToolOutputTokens > 0 {
+		return c.MaxToolOutputTokens
+	}
+	return defaultMaxToolOutputTokens
+}
+
+func (c *contextWindowConfig) summaryModel() string {
+	if c.SummaryModel != "" {
+		return c.SummaryModel
+	}
+	return defaultSummaryModel
+}
+
+func (c *contextWindowConfig) keepRecent() int {
+	if c.KeepRecent > 0 {
+		return c.KeepRecent
+	}
+	return defaultKeepRecent
+}
+
+// promptBudget returns the most prompt tokens a request may have, leaving
+// room for the completion it asks for, or 0 when the limits are unknown.
+func promptBudget(limits *catalogExtension, completion int) int {
+	budget := promptLimit(limits)
+	if limits.ContextWindow > 0 && completion > 0 {
+		if room := limits.ContextWindow - completion; budget == 0 || room < budget {
+			budget = room
+		}
+	}
+	return budget
+}
+
+// contextFit is a chat body being shortened to fit a prompt budget. prompt is
+// kept up to date as messages change, without recounting all of them.
+type contextFit struct {
+	cr      *chatRequest
+	counter tokenCounter
+	body    map[string]any
+	budget  int
+	prompt  promptCount
+}
+
+func (f *contextFit) fits() bool {
+	return f.prompt.total() <= f.budget
+}
+
+func (f *contextFit) messages() []any {
+	messages, _ := f.body["messages"].([]any)
+	return messages
+}
+
+// fitContext applies the configured strategies to a chat body whose prompt
+// exceeds the budget, until it fits. It returns the names of the strategies
+// that changed the body; the body is left as it is when none did.
+func fitContext(cr *chatRequest, counter tokenCounter, body map[string]any, prompt promptCount, budget int) []string {
+	if budget <= 0 {
+		return nil
+	}
+	f := &contextFit{cr: cr, counter: counter, body: body, budget: budget, prompt: prompt}
+	var applied []string
+	for _, strategy := range config.ContextWindow.strategies() {
+		if f.fits() {
+			break
+		}
+		var changed bool
+		switch strategy {
+		case "truncate_tool_outputs":
+			changed = f.truncateToolOutputs()
+		case "drop_oldest":
+			changed = f.dropOldest()
+		case "summarize":
+			changed = f.summarize()
+		default:
+			log.Printf("Ignoring unknown context strategy %q", strategy)
+		}
+		if changed {
+			applied = append(applied, strategy)
+		}
+	}
+	return applied
+}
+
+// truncateToolOutputs cuts the middle out of tool outputs longer than the
+// configured size, oldest first, since the latest ones matter most to the
+// model.
+func (f *contextFit) truncateToolOutputs() bool {
+	limit := config.ContextWindow.maxToolOutputTokens()
+	changed := false
+	truncate := func(text string) (string, bool) {
+		n := f.counter.count(text)
+		if n <= limit {
+			return text, false
+		}
+		text = truncateMiddle(text, n, limit)
+		f.prompt.Messages += f.counter.count(text) - n
+		return text, true
+	}
+	for _, msg := range f.messages() {
+		if f.fits() {
+			break
+		}
+		m, _ := msg.(map[string]any)
+		if role := m["role"]; role != "tool" && role != "function" {
+			continue
+		}
+		switch content := m["content"].(type) {
+		case string:
+			if text, ok := truncate(content); ok {
+				m["content"], changed = text, true
+			}
+		case []any:
+			for _, part := range content {
+				p, _ := part.(map[string]any)
+				if text, isText := p["text"].(string); isText {
+					if text, ok := truncate(text); ok {
+						p["text"], changed = text, true
+					}
+				}
+			}
+		}
+	}
+	return changed
+}
+
+// truncateMiddle shortens text of n tokens to about limit tokens, keeping its
+// beginning and end, where errors and results usually are.
+func truncateMiddle(text string, n, limit int) string {
+	runes := []rune(text)
+	keep := len(runes) * limit / n
+	head := keep * 2 / 3
+	tail := keep - head
+	return string(runes[:head]) +
+		fmt.Sprintf("\n[... %d tokens of output removed to fit the context window ...]\n", n-limit) +
+		string(runes[len(runes)-tail:])
+}
+
+// contextBlocks groups the messages that can be removed from a conversation.
+// Every message is a block of its own, except that an assistant message with
+// tool calls goes together with the tool results that follow it. System and
+// developer messages are in no block, so they are always kept.
+func contextBlocks(messages []any) [][]int {
+	var blocks [][]int
+	for i, msg := range messages {
+		m, _ := msg.(map[string]any)
+		switch m["role"] {
+		case "system", "developer":
+			continue
+		case "tool", "function":
+			if n := len(blocks); n > 0 && callsTools(messages[blocks[n-1][0]]) {
+				blocks[n-1] = append(blocks[n-1], i)
+				continue
+			}
+		}
+		blocks = append(blocks, []int{i})
+	}
+	return blocks
+}
+
+// callsTools reports whether a request message calls tools.
+func callsTools(msg any) bool {
+	m, _ := msg.(map[string]any)
+	calls, _ := m["tool_calls"].([]any)
+	_, function := m["function_call"]
+	return len(calls) > 0 || function
+}
+
+// dropOldest removes the oldest messages until the prompt fits, keeping the
+// system prompt, tool calls together with their results, and the latest
+// message.
+func (f *contextFit) dropOldest() bool {
+	messages := f.messages()
+	blocks := contextBlocks(messages)
+	drop := make(map[int]bool)
+	for _, block := range blocks[:max(len(blocks)-1, 0)] {
+		if f.fits() {
+			break
+		}
+		for _, i := range block {
+			drop[i] = true
+			f.prompt.Messages -= tokensPerMessage + f.counter.countChatMessage(messages[i])
+		}
+	}
+	if len(drop) == 0 {
+		return false
+	}
+	kept := make([]any, 0, len(messages)-len(drop))
+	for i, msg := range messages {
+		if !drop[i] {
+			kept = append(kept, msg)
+		}
+	}
+	f.body["messages"] = kept
+	log.Printf("Dropped the %d oldest messages of %d to fit the context window", len(drop), len(messages))
+	return true
+}
+
+const summaryInstructions = `You summarize the beginning of a conversation between a user and an AI assistant, so that the assistant can continue it without the original messages. Keep the user's goals and instructions, decisions made, facts learned, names of files, functions and other identifiers, results of tool calls that are still relevant, and open tasks. Leave out pleasantries and anything superseded. Write the summary as concise notes.`
+
+// summarize replaces all but the most recent messages with a summary written
+// by the summary model, through the same upstream. System messages among the
+// summarized ones are kept before the summary.
+func (f *contextFit) summarize() bool {
+	messages := f.messages()
+	blocks := contextBlocks(messages)
+	keep := config.ContextWindow.keepRecent()
+	if len(blocks) <= keep {
+		return false
+	}
+	start := blocks[len(blocks)-keep][0]
+	var head, old []any
+	for _, msg := range messages[:start] {
+		m, _ := msg.(map[string]any)
+		if role := m["role"]; role == "system" || role == "developer" {
+			head = append(head, msg)
+		} else {
+			old = append(old, msg)
+		}
+	}
+
+	summary, err := f.requestSummary(old)
+	if err != nil {
+		log.Printf("Failed to summarize the conversation: %v", err)
+		return false
+	}
+	note := map[string]any{
+		"role":    "system",
+		"content": "Summary of the earlier conversation, shortened to fit the context window:\n\n" + summary,
+	}
+	out := append(append(head, note), messages[start:]...)
+	f.body["messages"] = out
+	f.prompt = countChatPrompt(f.counter, f.body)
+	log.Printf("Summarized %d messages with %s to fit the context window", len(old), config.ContextWindow.summaryModel())
+	return true
+}
+
+// requestSummary asks the summary model to summarize messages, on the
+// caller's account.
+func (f *contextFit) requestSummary(messages []any) (string, error) {
+	model := config.ContextWindow.summaryModel()
+	if !policyAllowsModel(f.cr.r, model) {
+		return "", fmt.Errorf("the summary model %s is not allowed for this caller", model)
+	}
+	body := map[string]any{
+		"model": model,
+		"messages": []any{
+			map[string]any{"role": "system", "content": summaryInstructions},
+			map[string]any{"role": "user", "content": renderTranscript(messages)},
+		},
+		"max_tokens":  summaryMaxTokens,
+		"temperature": 0,
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	sub := newChatRequest(f.cr.r, f.cr.token, raw)
+	final, _, err := completeChat(sub, body)
+	if err != nil {
+		return "", err
+	}
+	chargeUsage(f.cr.r, model, 1, final.Usage)
+	if len(final.Choices) == 0 || final.Choices[0].Message.Content == nil || *final.Choices[0].Message.Content == "" {
+		return "", fmt.Errorf("%s returned no summary", model)
+	}
+	return *final.Choices[0].Message.Content, nil
+}
+
+// renderTranscript writes messages out as text, one per paragraph, with long
+// ones cut short.
+func renderTranscript(messages []any) string {
+	var b strings.Builder
+	for _, msg := range messages {
+		m, _ := msg.(map[string]any)
+		role, _ := m["role"].(string)
+		var text strings.Builder
+		switch content := m["content"].(type) {
+		case string:
+			text.WriteString(content)
+		case []any:
+			for _, part := range content {
+				p, _ := part.(map[string]any)
+				switch p["type"] {
+				case "text":
+					s, _ := p["text"].(string)
+					text.WriteString(s)
+				case "image_url":
+					text.WriteString("[image]")
+				}
+			}
+		}
+		calls, _ := m["tool_calls"].([]any)
+		for _, call := range calls {
+			fn, _ := call.(map[string]any)["function"].(map[string]any)
+			name, _ := fn["name"].(string)
+			args, _ := fn["arguments"].(string)
+			fmt.Fprintf(&text, "\n[called %s(%s)]", name, args)
+		}
+		s := text.String()
+		if runes := []rune(s); len(runes) > transcriptMessageRunes {
+			s = string(runes[:transcriptMessageRunes]) + " [...]"
+		}
+		fmt.Fprintf(&b, "%s: %s\n\n", role, strings.TrimSpace(s))
+	}
+	return b.String()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// contextBody decodes a chat body the way handlers see it.
+func contextBody(t *testing.T, messages ...map[string]any) map[string]any {
+	t.Helper()
+	raw, _ := json.Marshal(map[string]any{"model": "gpt-4o", "messages": messages})
+	var body map[string]any
+	if err := json.Unmarshal(raw, &body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func chatMsg(role, content string) map[string]any {
+	return map[string]any{"role": role, "content": content}
+}
+
+func toolCallMsg(id string) map[string]any {
+	return map[string]any{"role": "assistant", "tool_calls": []any{
+		map[string]any{"id": id, "type": "function", "function": map[string]any{"name": "read_file", "arguments": "{}"}},
+	}}
+}
+
+// contents lists the contents of a body's messages, with the role of those
+// that have none.
+func contents(body map[string]any) []string {
+	var out []string
+	for _, m := range body["messages"].([]any) {
+		m := m.(map[string]any)
+		if c, ok := m["content"].(string); ok {
+			out = append(out, c)
+		} else {
+			out = append(out, m["role"].(string))
+		}
+	}
+	return out
+}
+
+func TestContextBlocks(t *testing.T) {
+	body := contextBody(t,
+		chatMsg("system", "be brief"),
+		chatMsg("user", "read both files"),
+		toolCallMsg("a"),
+		chatMsg("tool", "file a"),
+		chatMsg("tool", "file b"),
+		chatMsg("assistant", "done"),
+		chatMsg("developer", "note"),
+		chatMsg("user", "thanks"),
+		chatMsg("tool", "orphan"),
+		map[string]any{"role": "assistant", "function_call": map[string]any{"name": "f", "arguments": "{}"}},
+		chatMsg("function", "result"),
+	)
+	want := [][]int{{1}, {2, 3, 4}, {5}, {7}, {8}, {9, 10}}
+	if got := contextBlocks(body["messages"].([]any)); !reflect.DeepEqual(got, want) {
+		t.Errorf("contextBlocks = %v, want %v", got, want)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	config = &Config{ContextWindow: contextWindowConfig{Enabled: true, Strategies: []string{"drop_oldest"}}}
+	defer func() { config = &Config{} }()
+	long := strings.Repeat("lorem ipsum dolor sit amet ", 50)
+	conversation := func() map[string]any {
+		return contextBody(t,
+			chatMsg("system", "be brief"),
+			chatMsg("user", long),
+			toolCallMsg("a"),
+			chatMsg("tool", long),
+			chatMsg("system", "late instructions"),
+			chatMsg("user", "latest "+long),
+		)
+	}
+	counter := tokenCounter{}
+
+	cases := []struct {
+		name   string
+		budget func(total int) int
+		want   []string
+	}{
+		{"first block", func(total int) int { return total - 1 }, []string{"be brief", "assistant", long, "late instructions", "latest " + long}},
+		// The tool call goes with its result, and the latest message stays
+		// even when the prompt still does not fit
+		{"all but the last", func(int) int { return 1 }, []string{"be brief", "late instructions", "latest " + long}},
+	}
+	for _, c := range cases {
+		body := conversation()
+		prompt := countChatPrompt(counter, body)
+		budget := c.budget(prompt.total())
+		applied := fitContext(nil, counter, body, prompt, budget)
+		if !reflect.DeepEqual(applied, []string{"drop_oldest"}) {
+			t.Errorf("%s: applied %v", c.name, applied)
+		}
+		if got := contents(body); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: kept %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	body := contextBody(t, chatMsg("system", "be brief"), chatMsg("user", long))
+	prompt := countChatPrompt(counter, body)
+	if applied := fitContext(nil, counter, body, prompt, 1); applied != nil || len(contents(body)) != 2 {
+		t.Errorf("dropped the only message: %v", applied)
+	}
+}
+
+func TestTruncateMiddle(t *testing.T) {
+	marker := func(removed int) string {
+		return "\n[... " + strconv.Itoa(removed) + " tokens of output removed to fit the context window ...]\n"
+	}
+	cases := []struct {
+		text     string
+		n, limit int
+		want     string
+	}{
+		{"abcdefghij", 10, 3, "ab" + marker(7) + "j"},
+		{"abcdefghij", 10, 9, "abcdef" + marker(1) + "hij"},
+		{"abcdefghij", 10, 1, marker(9) + "j"},
+		{"abcdefghij", 10, 0, marker(10)},
+		{"世界世界世界", 6, 3, "世界" + marker(3) + "界"},
+	}
+	for _, c := range cases {
+		if got := truncateMiddle(c.text, c.n, c.limit); got != c.want {
+			t.Errorf("truncateMiddle(%q, %d, %d) = %q, want %q", c.text, c.n, c.limit, got, c.want)
+		}
+	}
+}
+
+func TestFitContextOrder(t *testing.T) {
+	defer func() { config = &Config{} }()
+	output := strings.Repeat("line of tool output\n", 200)
+	conversation := func() map[string]any {
+		return contextBody(t,
+			chatMsg("system", "be brief"),
+			chatMsg("user", "hi"),
+			toolCallMsg("a"),
+			chatMsg("tool", output),
+			chatMsg("user", "next"),
+		)
+	}
+	counter := tokenCounter{}
+	toolTokens := counter.count(output)
+
+	cases := []struct {
+		strategies []string
+		applied    []string
+		messages   int
+		truncated  bool
+	}{
+		// Truncating the tool output is enough, so nothing is dropped
+		{[]string{"truncate_tool_outputs", "drop_oldest"}, []string{"truncate_tool_outputs"}, 5, true},
+		// Dropping comes first and takes the tool call with it
+		{[]string{"drop_oldest", "truncate_tool_outputs"}, []string{"drop_oldest"}, 2, false},
+		{[]string{"unknown", "truncate_tool_outputs"}, []string{"truncate_tool_outputs"}, 5, true},
+	}
+	for _, c := range cases {
+		config = &Config{ContextWindow: contextWindowConfig{Enabled: true, Strategies: c.strategies, MaxToolOutputTokens: 10}}
+		body := conversation()
+		prompt := countChatPrompt(counter, body)
+		applied := fitContext(nil, counter, body, prompt, prompt.total()-toolTokens/2)
+		if !reflect.DeepEqual(applied, c.applied) {
+			t.Errorf("%v: applied %v, want %v", c.strategies, applied, c.applied)
+		}
+		messages := body["messages"].([]any)
+		if len(messages) != c.messages {
+			t.Errorf("%v: %d messages left, want %d", c.strategies, len(messages), c.messages)
+		}
+		truncated := len(messages) == 5 && messages[3].(map[string]any)["content"] != output
+		if truncated != c.truncated {
+			t.Errorf("%v: tool output truncated = %v", c.strategies, truncated)
+		}
+	}
+
+	// A prompt that fits is left alone
+	config = &Config{ContextWindow: contextWindowConfig{Enabled: true}}
+	body := conversation()
+	prompt := countChatPrompt(counter, body)
+	if applied := fitContext(nil, counter, body, prompt, prompt.total()); applied != nil {
+		t.Errorf("fitting prompt changed by %v", applied)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"copilot-proxy/unstream"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+)
+
+// Embeddings requests are split into batches the upstream accepts and the
+// results reassembled in input order. Vectors are always fetched as floats and
+// encoded as the client asked, and identical inputs can be served from a cache.
+
+const (
+	defaultEmbeddingBatchSize = 128
+	embeddingParallelism      = 4
+)
+
+type embeddingsConfig struct {
+	// BatchSize is the largest number of inputs sent upstream in one request.
+	// Defaults to 128.
+	BatchSize int `json:"batch_size"`
+	// CacheSize is the number of embeddings kept in memory, keyed by caller,
+	// model, dimensions and input. 0 disables the cache.
+	CacheSize int `json:"cache_size"`
+}
+
+type embeddingRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`
+	EncodingFormat string          `json:"encoding_format"`
+	Dimensions     int             `json:"dimensions,omitempty"`
+}
+
+type embeddingResponse struct {
+	Object string          `json:"object"`
+	Data   []embeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  embeddingUsage  `json:"usage"`
+}
+
+type embeddingData struct {
+	Object    string `json:"object"`
+	Index     int    `json:"index"`
+	Embedding any    `json:"embedding"` // []float64, or a base64 string
+}
+
+type embeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// upstreamEmbeddings is an upstream response, whose vectors may come back as
+// float arrays or base64 whatever was asked for.
+type upstreamEmbeddings struct {
+	Data []struct {
+		Index     int             `json:"index"`
+		Embedding json.RawMessage `json:"embedding"`
+	} `json:"data"`
+	Model string          `json:"model"`
+	Usage *embeddingUsage `json:"usage"`
+}
+
+func handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	log.Println("Forwarding embeddings request")
+	ct, ok := copilotToken(w, r)
+	if !ok {
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	// Only the request is scrubbed: vectors have nothing to put back
+	body, _, ok = scrubRequest(w, r, body)
+	if !ok {
+		return
+	}
+	var req embeddingRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON")
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "encoding_format must be float or base64")
+		return
+	}
+	inputs, err := parseEmbeddingInputs(req.Input)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if !enforcePolicy(w, r, body, req.Model) {
+		return
+	}
+	release, ok := admitCaller(w, r, false)
+	if !ok {
+		return
+	}
+	defer release()
+	cacheKey, cached, hit := cacheLookup(w, r, "/embeddings", body)
+	if hit {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(cached)
+		log.Println("Embeddings request completed (response cache)")
+		return
+	}
+
+	vectors := make([][]float64, len(inputs))
+	keys := make([]string, len(inputs))
+	var missing []int
+	for i, input := range inputs {
+		keys[i] = embeddingCacheKey(r, &req, input)
+		if v, ok := embeddingCache.get(keys[i]); ok {
+			vectors[i] = v
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	embR := r.Clone(r.Context())
+	embR.URL.Path = "/embeddings"
+	embR.URL.RawPath = ""
+	model, usage, err := fetchEmbeddings(embR, ct.Token, &req, inputs, missing, vectors)
+	if err != nil {
+		log.Printf("Embeddings request failed: %v", err)
+		writeUpstreamError(w, err)
+		return
+	}
+	for _, i := range missing {
+		if vectors[i] == nil {
+			writeUpstreamError(w, newUpstreamError(http.StatusBadGateway, fmt.Sprintf("upstream returned no embedding for input %d", i)))
+			return
+		}
+		embeddingCache.put(keys[i], vectors[i])
+	}
+	if model == "" {
+		model = req.Model
+	}
+	chargeUsage(r, "", 0, &unstream.OAIUsage{PromptTokens: usage.PromptTokens})
+
+	out := embeddingResponse{Object: "list", Model: model, Usage: usage, Data: make([]embeddingData, len(inputs))}
+	for i, v := range vectors {
+		out.Data[i] = embeddingData{Object: "embedding", Index: i, Embedding: v}
+		if req.EncodingFormat == "base64" {
+			out.Data[i].Embedding = encodeEmbedding(v)
+		}
+	}
+	encoded, _ := json.Marshal(out)
+	encoded = append(encoded, '\n')
+	cacheStore(cacheKey, encoded)
+	w.Header().Set("Content-Type", "application/json")
+	if len(missing) < len(inputs) {
+		w.Header().Set("X-Copilot-Proxy-Embeddings-Cached", fmt.Sprint(len(inputs)-len(missing)))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(encoded)
+	log.Printf("Embeddings request completed (%d inputs, %d cached)", len(inputs), len(inputs)-len(missing))
+}
+
+// parseEmbeddingInputs splits input into the individual inputs: a string, an
+// array of strings, an array of tokens or an array of token arrays.
+func parseEmbeddingInputs(raw json.RawMessage) ([]json.RawMessage, error) {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return []json.RawMessage{raw}, nil
+	}
+	var tokens []int
+	if json.Unmarshal(raw, &tokens) == nil && len(tokens) > 0 {
+		return []json.RawMessage{raw}, nil
+	}
+	var many []json.RawMessage
+	if json.Unmarshal(raw, &many) != nil || len(many) == 0 {
+		return nil, errors.New("input must be a string, an array of strings or an array of token arrays")
+	}
+	return many, nil
+}
+
+// fetchEmbeddings fetches the vectors of the inputs listed in missing, in
+// batches of at most the configured size, and stores them in vectors.
+func fetchEmbeddings(r *http.Request, token string, req *embeddingRequest, inputs []json.RawMessage, missing []int, vectors [][]float64) (string, embeddingUsage, error) {
+	batchSize := config.Embeddings.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultEmbeddingBatchSize
+	}
+	var (
+		mu       sync.Mutex
+		model    string
+		usage    embeddingUsage
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	sem := make(chan struct{}, embeddingParallelism)
+	for start := 0; start < len(missing); start += batchSize {
+		batch := missing[start:min(start+batchSize, len(missing))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			batchInputs := make([]json.RawMessage, len(batch))
+			for i, idx := range batch {
+				batchInputs[i] = inputs[idx]
+			}
+			resp, err := fetchEmbeddingBatch(r, token, req, batchInputs)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for _, d := range resp.vectors {
+				vectors[batch[d.index]] = d.vector
+			}
+			model = resp.model
+			usage.PromptTokens += resp.usage.PromptTokens
+			usage.TotalTokens += resp.usage.TotalTokens
+		}()
+	}
+	wg.Wait()
+	return model, usage, firstErr
+}
+
+type embeddingBatch struct {
+	model   string
+	usage   embeddingUsage
+	vectors []indexedVector
+}
+
+// indexedVector is a vector with its index in the batch.
+type indexedVector struct {
+	index  int
+	vector []float64
+}
+
+func fetchEmbeddingBatch(r *http.Request, token string, req *embeddingRequest, inputs []json.RawMessage) (*embeddingBatch, error) {
+	body := map[string]any{"model": req.Model, "input": inputs, "encoding_format": "float"}
+	if req.Dimensions > 0 {
+		body["dimensions"] = req.Dimensions
+	}
+	b, _ := json.Marshal(body)
+	upReq, err := newUpstreamRequest(r, b, token)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(upReq)
+	if err != nil {
+		return nil, newUpstreamError(http.StatusBadGateway, "upstream request failed: "+err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, readUpstreamError(resp)
+	}
+	var up upstreamEmbeddings
+	if err := json.NewDecoder(resp.Body).Decode(&up); err != nil {
+		return nil, newUpstreamError(http.StatusBadGateway, "invalid upstream response: "+err.Error())
+	}
+	if len(up.Data) != len(inputs) {
+		return nil, newUpstreamError(http.StatusBadGateway, fmt.Sprintf("upstream returned %d embeddings for %d inputs", len(up.Data), len(inputs)))
+	}
+	out := &embeddingBatch{model: up.Model}
+	if up.Usage != nil {
+		out.usage = *up.Usage
+		// Some upstreams only report one of the two
+		if out.usage.TotalTokens == 0 {
+			out.usage.TotalTokens = out.usage.PromptTokens
+		}
+		if out.usage.PromptTokens == 0 {
+			out.usage.PromptTokens = out.usage.TotalTokens
+		}
+	}
+	for _, d := range up.Data {
+		if d.Index < 0 || d.Index >= len(inputs) {
+			return nil, newUpstreamError(http.StatusBadGateway, fmt.Sprintf("upstream returned embedding index %d out of range", d.Index))
+		}
+		v, err := decodeEmbedding(d.Embedding)
+		if err != nil {
+			return nil, newUpstreamError(http.StatusBadGateway, "invalid upstream embedding: "+err.Error())
+		}
+		out.vectors = append(out.vectors, indexedVector{d.Index, v})
+	}
+	return out, nil
+}
+
+// decodeEmbedding accepts a float array or base64 encoded little-endian float32s.
+func decodeEmbedding(raw json.RawMessage) ([]float64, error) {
+	var floats []float64
+	if err := json.Unmarshal(raw, &floats); err == nil {
+		return floats, nil
+	}
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err != nil {
+		return nil, errors.New("embedding is neither a float array nor a base64 string")
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(b)%4 != 0 {
+		return nil, errors.New("embedding is not valid base64 float32 data")
+	}
+	floats = make([]float64, len(b)/4)
+	for i := range floats {
+		floats[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:])))
+	}
+	return floats, nil
+}
+
+// encodeEmbedding encodes v as base64 little-endian float32s, as the OpenAI API
+// does for encoding_format base64.
+func encodeEmbedding(v []float64) string {
+	var buf bytes.Buffer
+	buf.Grow(len(v) * 4)
+	for _, f := range v {
+		binary.Write(&buf, binary.LittleEndian, math.Float32bits(float32(f)))
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// embeddingCacheKey keys an input's embedding by the caller too, like the
+// response cache, so that one account cannot tell what another embedded.
+func embeddingCacheKey(r *http.Request, req *embeddingRequest, input json.RawMessage) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00", callerKeyID(r), req.Model, req.Dimensions)
+	h.Write(input)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// embeddingLRU is a fixed size in-memory cache of embeddings. Its capacity is
+// read from the config on every call, so a zero size disables it.
+type embeddingLRU struct {
+	mu      sync.Mutex
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key    string
+	vector []float64
+}
+
+var embeddingCache = &embeddingLRU{order: list.New(), entries: make(map[string]*list.Element)}
+
+func (c *embeddingLRU) get(key string) ([]float64, bool) {
+	if config.Embeddings.CacheSize <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).vector, true
+}
+
+func (c *embeddingLRU) put(key string, vector []float64) {
+	size := config.Embeddings.CacheSize
+	if size <= 0 || vector == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry).vector = vector
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, vector: vector})
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
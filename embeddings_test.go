@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEmbeddingCacheKey(t *testing.T) {
+	req := &embeddingRequest{Model: "text-embedding-3-small"}
+	input := json.RawMessage(`"hello"`)
+	alice := embeddingCacheKey(callerRequest("alice"), req, input)
+	if again := embeddingCacheKey(callerRequest("alice"), req, input); again != alice {
+		t.Error("same caller and input keyed differently")
+	}
+	if bob := embeddingCacheKey(callerRequest("bob"), req, input); bob == alice {
+		t.Error("callers share cached embeddings")
+	}
+	if other := embeddingCacheKey(callerRequest("alice"), &embeddingRequest{Model: req.Model, Dimensions: 256}, input); other == alice {
+		t.Error("dimensions not in the key")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Fallback chains: when a model fails in a way another model would not, such
+// as a rate limit, a plan restriction or an upstream that does not answer, the
+// request is sent again to the next model of the chain before anything has
+// been written to the client.
+
+const defaultFirstByteTimeout = 30 * time.Second
+
+type fallbackConfig struct {
+	// Chains lists, by model name, the models to try in order when it fails.
+	Chains map[string][]string `json:"chains"`
+	// FirstByteTimeoutSeconds is how long a model with a fallback has to start
+	// answering before the next one is tried. Defaults to 30 seconds.
+	FirstByteTimeoutSeconds int `json:"first_byte_timeout_seconds"`
+}
+
+// fallbackStatuses are the statuses worth retrying with another model.
+var fallbackStatuses = map[int]bool{
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// quotaErrorMarkers identify errors caused by the account's plan or quota
+// rather than by the request, which Copilot reports as 400 or 403.
+var quotaErrorMarkers = []string{
+	"quota",
+	"not available for your plan",
+	"model_not_supported",
+	"model is not supported",
+	"not enabled",
+	"rate limit",
+}
+
+func firstByteTimeout() time.Duration {
+	if s := config.Fallbacks.FirstByteTimeoutSeconds; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultFirstByteTimeout
+}
+
+// switchModel points the request at another model, adapting everything that
+// depends on the model's capabilities.
+func (cr *chatRequest) switchModel(model string) {
+	if cr.fallbackFrom == "" {
+		cr.fallbackFrom = cr.Model
+	}
+	cr.Model = model
+	cr.caps = lookupCapabilities(model)
+	cr.emulateTools = cr.caps.EmulateTools && len(cr.Tools) > 0
+	if m, err := cr.bodyMap(); err == nil {
+		m["model"] = model
+		cr.body, _ = json.Marshal(m)
+	}
+}
+
+// setServedHeaders reports the model that served the request, and the one it
+// fell back from.
+func (cr *chatRequest) setServedHeaders(w http.ResponseWriter) {
+	if cr.Model == "" {
+		return
+	}
+	w.Header().Set("X-Copilot-Proxy-Model", cr.Model)
+	if cr.fallbackFrom != "" {
+		w.Header().Set("X-Copilot-Proxy-Fallback-From", cr.fallbackFrom)
+	}
+}
+
+// sendChat sends a chat completion upstream and returns the response of the
+// first model in the request's fallback chain that does not fail. build
+// returns the body for the request's current model. When every model fails,
+// the last failure is returned.
+func sendChat(cr *chatRequest, build func() []byte) (*http.Response, error) {
+	chain := fallbackChain(cr.r, cr.Model)
+	var (
+		resp *http.Response
+		err  error
+	)
+	for i, model := range chain {
+		if model != cr.Model {
+			log.Printf("Falling back from %s to %s", cr.Model, model)
+			cr.switchModel(model)
+		}
+		last := i == len(chain)-1
+		resp, err = sendChatOnce(cr, build(), !last)
+		if last || !shouldFallBack(resp, err) {
+			break
+		}
+		if resp != nil {
+			log.Printf("Model %s failed with status %d", model, resp.StatusCode)
+			resp.Body.Close()
+		} else {
+			log.Printf("Model %s failed: %v", model, err)
+		}
+	}
+	if err == nil && cr.fallbackFrom != "" {
+		log.Printf("Request for %s served by %s", cr.fallbackFrom, cr.Model)
+	}
+	return resp, err
+}
+
+// fallbackChain returns the models to try for model, in order: the model
+// itself, then each model of its chain that has not been tried yet and that
+// the caller's policy allows.
+func fallbackChain(r *http.Request, model string) []string {
+	chain := []string{model}
+	tried := map[string]bool{model: true}
+	for _, next := range config.Fallbacks.Chains[model] {
+		if tried[next] {
+			continue
+		}
+		tried[next] = true
+		if !policyAllowsModel(r, next) {
+			log.Printf("Skipping fallback %s for %s: not allowed by policy", next, model)
+			continue
+		}
+		chain = append(chain, next)
+	}
+	return chain
+}
+
+// errFirstByteTimeout is returned when a model does not start answering in time.
+var errFirstByteTimeout = errors.New("timed out waiting for the first byte")
+
+// sendChatOnce sends body to the request's current model. With timeout set,
+// the model has to start its body within the first byte timeout.
+func sendChatOnce(cr *chatRequest, body []byte, timeout bool) (*http.Response, error) {
+	req, err := newUpstreamRequest(cr.r, body, cr.token)
+	if err != nil {
+		return nil, err
+	}
+	if !timeout {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, newUpstreamError(http.StatusBadGateway, "upstream request failed: "+err.Error())
+		}
+		return resp, nil
+	}
+
+	ctx, cancel := context.WithCancel(cr.r.Context())
+	timer := time.AfterFunc(firstByteTimeout(), cancel)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err == nil {
+		body := bufio.NewReader(resp.Body)
+		if _, peekErr := body.Peek(1); peekErr != nil && !errors.Is(peekErr, io.EOF) {
+			resp.Body.Close()
+			resp, err = nil, peekErr
+		} else {
+			resp.Body = &cancelOnClose{Reader: body, body: resp.Body, cancel: cancel}
+		}
+	}
+	if !timer.Stop() {
+		cancel()
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, newUpstreamError(http.StatusGatewayTimeout, errFirstByteTimeout.Error())
+	}
+	if err != nil {
+		cancel()
+		return nil, newUpstreamError(http.StatusBadGateway, "upstream request failed: "+err.Error())
+	}
+	return resp, nil
+}
+
+// cancelOnClose releases the request context of a response when its body is closed.
+type cancelOnClose struct {
+	io.Reader
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.body.Close()
+}
+
+// shouldFallBack reports whether a failed attempt is worth retrying with the
+// next model. Error bodies that are kept are restored for the caller.
+func shouldFallBack(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if fallbackStatuses[resp.StatusCode] {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusPaymentRequired, http.StatusForbidden:
+	default:
+		return false
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if resp.StatusCode == http.StatusPaymentRequired {
+		return true
+	}
+	lower := strings.ToLower(string(body))
+	for _, marker := range quotaErrorMarkers {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFallbackChain(t *testing.T) {
+	a := callerRequest("a")
+	config = &Config{
+		Fallbacks: fallbackConfig{Chains: map[string][]string{
+			"gpt-4o":   {"gpt-4.1", "claude-3.5-sonnet", "gpt-4o", "gpt-4.1", "o3-mini"},
+			"o3-mini":  {"gpt-4o-mini"},
+			"isolated": nil,
+		}},
+		Policies: policyConfig{Keys: map[string]policyRules{
+			callerKeyID(a): {Models: []string{"gpt-*", "o3-mini"}},
+		}},
+	}
+	defer func() { config = &Config{} }()
+
+	cases := []struct {
+		token string
+		model string
+		want  []string
+	}{
+		{"a", "gpt-4o", []string{"gpt-4o", "gpt-4.1", "o3-mini"}},
+		{"b", "gpt-4o", []string{"gpt-4o", "gpt-4.1", "claude-3.5-sonnet", "o3-mini"}},
+		{"a", "o3-mini", []string{"o3-mini", "gpt-4o-mini"}},
+		{"a", "isolated", []string{"isolated"}},
+		{"a", "unknown", []string{"unknown"}},
+	}
+	for _, c := range cases {
+		if got := fallbackChain(callerRequest(c.token), c.model); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("key %s, %s: chain %v, want %v", c.token, c.model, got, c.want)
+		}
+	}
+}
+
+// upstreamFunc answers upstream requests in tests, in place of Copilot.
+type upstreamFunc func(*http.Request) (*http.Response, error)
+
+func (f upstreamFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// stubUpstream sends the requests of the default client to f until the
+// returned function is called.
+func stubUpstream(f upstreamFunc) func() {
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = f
+	return func() { http.DefaultClient.Transport = transport }
+}
+
+func TestSendChatFallback(t *testing.T) {
+	config = &Config{Fallbacks: fallbackConfig{Chains: map[string][]string{"a": {"b", "c"}}}}
+	defer func() { config = &Config{} }()
+
+	type answer struct {
+		status int
+		body   string
+	}
+	cases := []struct {
+		name    string
+		answers map[string]answer // by model; missing models fail to connect
+		tried   []string
+		served  string
+		status  int
+	}{
+		{"first model answers", map[string]answer{"a": {200, `{}`}}, []string{"a"}, "a", 200},
+		{"rate limited", map[string]answer{"a": {429, `{}`}, "b": {200, `{}`}}, []string{"a", "b"}, "b", 200},
+		{"not reachable", map[string]answer{"b": {200, `{}`}}, []string{"a", "b"}, "b", 200},
+		{"plan restriction", map[string]answer{"a": {403, `{"error":{"message":"Model not available for your plan"}}`}, "b": {502, `{}`}, "c": {200, `{}`}}, []string{"a", "b", "c"}, "c", 200},
+		{"payment required", map[string]answer{"a": {402, `{}`}, "b": {200, `{}`}}, []string{"a", "b"}, "b", 200},
+		// Errors caused by the request are the client's to see
+		{"bad request", map[string]answer{"a": {400, `{"error":{"message":"invalid temperature"}}`}}, []string{"a"}, "a", 400},
+		{"not found", map[string]answer{"a": {404, `{}`}}, []string{"a"}, "a", 404},
+		{"every model fails", map[string]answer{"a": {503, `{}`}, "b": {503, `{}`}, "c": {500, `{}`}}, []string{"a", "b", "c"}, "c", 500},
+	}
+	for _, c := range cases {
+		var tried []string
+		restore := stubUpstream(func(r *http.Request) (*http.Response, error) {
+			var body struct {
+				Model string `json:"model"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			tried = append(tried, body.Model)
+			a, ok := c.answers[body.Model]
+			if !ok {
+				return nil, errors.New("connection refused")
+			}
+			return &http.Response{StatusCode: a.status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(a.body))}, nil
+		})
+		cr := newChatRequest(callerRequest("a"), "ct", []byte(`{"model":"a","messages":[]}`))
+		resp, err := sendChat(cr, cr.upstreamBody)
+		restore()
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !reflect.DeepEqual(tried, c.tried) || cr.Model != c.served || resp.StatusCode != c.status {
+			t.Errorf("%s: tried %v, served by %s with %d, want %v, %s with %d", c.name, tried, cr.Model, resp.StatusCode, c.tried, c.served, c.status)
+		}
+		// Error bodies read to decide are kept for the client
+		if want := c.answers[c.served].body; string(body) != want {
+			t.Errorf("%s: body %q, want %q", c.name, body, want)
+		}
+		if from := cr.fallbackFrom; (from != "") != (c.served != "a") {
+			t.Errorf("%s: fallback from %q", c.name, from)
+		}
+	}
+}
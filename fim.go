@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Fill-in-the-middle code completion (/v1/fim/completions) for editors other
+// than VS Code. Requests carry the text before and after the cursor and are
+// sent to Copilot's code completion engine, the one behind inline suggestions,
+// rather than to the chat models. Answers use the text_completion shape of
+// OpenAI compatible FIM APIs.
+
+const (
+	defaultFIMEngine    = "copilot-codex"
+	defaultFIMProxy     = "https://copilot-proxy.githubusercontent.com"
+	defaultFIMMaxTokens = 500
+)
+
+type fimConfig struct {
+	// Engine is the code completion engine. Defaults to copilot-codex.
+	Engine string `json:"engine"`
+}
+
+type fimRequest struct {
+	Prompt      string          `json:"prompt"` // text before the cursor
+	Suffix      string          `json:"suffix"` // text after the cursor
+	Language    string          `json:"language"`
+	Path        string          `json:"path"`
+	MaxTokens   int             `json:"max_tokens"`
+	Temperature *float64        `json:"temperature"`
+	TopP        *float64        `json:"top_p"`
+	N           int             `json:"n"`
+	Stop        json.RawMessage `json:"stop"`
+	Stream      bool            `json:"stream"`
+}
+
+// fimLanguages maps file extensions to the language ids the engine expects.
+var fimLanguages = map[string]string{
+	".c": "c", ".h": "c", ".cc": "cpp", ".cpp": "cpp", ".hpp": "cpp", ".cs": "csharp",
+	".css": "css", ".dart": "dart", ".ex": "elixir", ".exs": "elixir", ".go": "go",
+	".hs": "haskell", ".html": "html", ".java": "java", ".js": "javascript",
+	".jsx": "javascriptreact", ".json": "json", ".kt": "kotlin", ".lua": "lua",
+	".md": "markdown", ".php": "php", ".pl": "perl", ".py": "python", ".r": "r",
+	".rb": "ruby", ".rs": "rust", ".scala": "scala", ".sh": "shellscript",
+	".sql": "sql", ".swift": "swift", ".toml": "toml", ".ts": "typescript",
+	".tsx": "typescriptreact", ".vue": "vue", ".xml": "xml", ".yaml": "yaml",
+	".yml": "yaml", ".zig": "zig",
+}
+
+// fimCommentPrefixes lists the line comment syntax of languages that do not
+// use //, for the path header of the prompt.
+var fimCommentPrefixes = map[string]string{
+	"python": "#", "ruby": "#", "shellscript": "#", "perl": "#", "r": "#",
+	"yaml": "#", "toml": "#", "elixir": "#", "dockerfile": "#", "makefile": "#",
+	"lua": "--", "sql": "--", "haskell": "--",
+	"html": "<!--", "xml": "<!--", "markdown": "<!--", "vue": "<!--",
+}
+
+// fimLanguage returns the language id for a request, from the request itself
+// or from the file extension.
+func fimLanguage(req *fimRequest) string {
+	if req.Language != "" {
+		return strings.ToLower(req.Language)
+	}
+	base := path.Base(req.Path)
+	switch strings.ToLower(base) {
+	case "dockerfile":
+		return "dockerfile"
+	case "makefile":
+		return "makefile"
+	}
+	if lang, ok := fimLanguages[strings.ToLower(path.Ext(base))]; ok {
+		return lang
+	}
+	return "plaintext"
+}
+
+// fimPrompt prepends the path header the engine was trained with, written as a
+// comment in the file's language.
+func fimPrompt(req *fimRequest, lang string) string {
+	if req.Path == "" {
+		return req.Prompt
+	}
+	prefix, ok := fimCommentPrefixes[lang]
+	if !ok {
+		prefix = "//"
+	}
+	header := prefix + " Path: " + req.Path
+	if prefix == "<!--" {
+		header += " -->"
+	}
+	return header + "\n" + req.Prompt
+}
+
+// parseStop accepts stop as a string or an array of strings.
+func parseStop(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return []string{single}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, errors.New("stop must be a string or an array of strings")
+	}
+	return many, nil
+}
+
+func handleFIM(w http.ResponseWriter, r *http.Request) {
+	log.Println("Forwarding code completion request")
+	ct, ok := copilotToken(w, r)
+	if !ok {
+		return
+	}
+	raw, _ := io.ReadAll(r.Body)
+	raw, scrubbed, ok := scrubRequest(w, r, raw)
+	if !ok {
+		return
+	}
+	var req fimRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON")
+		return
+	}
+	stops, err := parseStop(req.Stop)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	n := max(req.N, 1)
+	lang := fimLanguage(&req)
+	body := map[string]any{
+		"prompt":     fimPrompt(&req, lang),
+		"suffix":     req.Suffix,
+		"max_tokens": defaultFIMMaxTokens,
+		"n":          n,
+		"stream":     true,
+		"extra": map[string]any{
+			"language":            lang,
+			"trim_by_indentation": true,
+		},
+	}
+	if req.MaxTokens > 0 {
+		body["max_tokens"] = req.MaxTokens
+	}
+	// Like the editor plugins: deterministic for a single suggestion, varied
+	// when cycling through several
+	body["temperature"] = 0.0
+	if n > 1 {
+		body["temperature"] = 0.8
+	}
+	if req.Temperature != nil {
+		body["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		body["top_p"] = *req.TopP
+	}
+	if len(stops) > 0 {
+		body["stop"] = stops
+	}
+	b, _ := json.Marshal(body)
+
+	// The default max_tokens counts against the caller's cap like one they set
+	checked := raw
+	if req.MaxTokens <= 0 {
+		var m map[string]any
+		if json.Unmarshal(raw, &m) == nil {
+			m["max_tokens"] = defaultFIMMaxTokens
+			checked, _ = json.Marshal(m)
+		}
+	}
+	if !enforcePolicy(w, r, checked, fimEngine()) {
+		return
+	}
+	release, ok := admitCaller(w, r, req.Stream)
+	if !ok {
+		return
+	}
+	defer release()
+	upReq, err := newFIMRequest(r, b, ct)
+	if err != nil {
+		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		return
+	}
+	resp, err := http.DefaultClient.Do(upReq)
+	if err != nil {
+		writeUpstreamError(w, newUpstreamError(http.StatusBadGateway, "upstream request failed: "+err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		writeUpstreamError(w, readUpstreamError(resp))
+		return
+	}
+
+	fs := &fimStream{
+		id:      "cmpl-" + uuid.New().String(),
+		created: time.Now().Unix(),
+		stops:   stops,
+		n:       n,
+	}
+	if scrubbed != nil && !config.Scrub.KeepPlaceholders {
+		fs.scrubbed = scrubbed
+	}
+	if req.Stream {
+		fs.stream(w, resp.Body)
+	} else {
+		fs.buffer(w, resp.Body)
+	}
+	log.Println("Code completion request completed")
+}
+
+// fimEngine returns the code completion engine, which is the model of FIM
+// requests as far as policies are concerned.
+func fimEngine() string {
+	if config.FIM.Engine != "" {
+		return config.FIM.Engine
+	}
+	return defaultFIMEngine
+}
+
+// newFIMRequest builds the request to the code completion engine, with the
+// headers of the editor plugins instead of the chat ones.
+func newFIMRequest(r *http.Request, body []byte, ct CopilotToken) (*http.Request, error) {
+	base := ct.Endpoints.Proxy
+	if base == "" {
+		base = defaultFIMProxy
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(base, "/")+"/v1/engines/"+fimEngine()+"/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	copyRequestHeaders(req, r, ct.Token)
+	req.Header.Set("openai-intent", "copilot-ghost")
+	req.Header.Set("editor-plugin-version", "copilot/1.155.0")
+	req.Header.Set("user-agent", "GithubCopilot/1.155.0")
+	return req, nil
+}
+
+// fimStream turns the engine's stream of candidates into the client's answer:
+// stop sequences are applied locally, since the engine does not always honor
+// them, and duplicate candidates are dropped.
+type fimStream struct {
+	id      string
+	created int64
+	model   string
+	stops   []string
+	n       int
+	// scrubbed has the values to put back in place of placeholders, if any.
+	scrubbed *scrubbing
+}
+
+// fimCandidate is one candidate being received.
+type fimCandidate struct {
+	text         strings.Builder
+	sent         int // bytes of text already written to the client
+	finishReason *string
+}
+
+// readChunks reads the engine's text_completion chunks, calling fn for each
+// choice in them. Redacted values are put back, holding back text that may be
+// the start of a placeholder until the next chunk shows whether it is one.
+func (fs *fimStream) readChunks(body io.Reader, fn func(index int, text string, finishReason *string) bool) error {
+	reader := unstream.NewOAIStreamReader(body)
+	held := make(map[int]string)
+	for {
+		payload, err := reader.NextPayload()
+		if errors.Is(err, io.EOF) {
+			for index, text := range held {
+				if text != "" && !fn(index, text, nil) {
+					break
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var chunk textCompletion
+		if err := json.Unmarshal(payload, &chunk); err != nil {
+			return err
+		}
+		if chunk.Model != "" {
+			fs.model = chunk.Model
+		}
+		for _, ch := range chunk.Choices {
+			text := ch.Text
+			if fs.scrubbed != nil {
+				text = fs.scrubbed.restore(held[ch.Index]+text, false)
+				held[ch.Index] = ""
+				if ch.FinishReason == nil {
+					held[ch.Index] = placeholderPrefix(text)
+					text = text[:len(text)-len(held[ch.Index])]
+				}
+			}
+			if !fn(ch.Index, text, ch.FinishReason) {
+				return nil
+			}
+		}
+	}
+}
+
+// add appends text to a candidate and returns the part that can be sent. Text
+// that might be the start of a stop sequence is held back until it is known
+// not to be one. A candidate that reaches a stop sequence is finished.
+func (c *fimCandidate) add(text string, stops []string) string {
+	if c.finishReason != nil {
+		return ""
+	}
+	c.text.WriteString(text)
+	full := c.text.String()
+	safe := len(full)
+	for _, stop := range stops {
+		if stop == "" {
+			continue
+		}
+		if i := strings.Index(full[c.sent:], stop); i >= 0 && c.sent+i < safe {
+			safe = c.sent + i
+			reason := "stop"
+			c.finishReason = &reason
+		}
+	}
+	if c.finishReason != nil {
+		c.text.Reset()
+		c.text.WriteString(full[:safe])
+	} else {
+		safe -= heldStopPrefix(full, stops)
+	}
+	out := full[c.sent:safe]
+	c.sent = safe
+	return out
+}
+
+// rest returns the text still held back once the candidate has ended.
+func (c *fimCandidate) rest() string {
+	full := c.text.String()
+	out := full[c.sent:]
+	c.sent = len(full)
+	return out
+}
+
+// heldStopPrefix returns the length of the longest suffix of s that is a
+// proper prefix of one of stops.
+func heldStopPrefix(s string, stops []string) int {
+	held := 0
+	for _, stop := range stops {
+		for n := min(len(stop)-1, len(s)); n > held; n-- {
+			if strings.HasSuffix(s, stop[:n]) {
+				held = n
+				break
+			}
+		}
+	}
+	return held
+}
+
+func (fs *fimStream) chunk(choices ...textCompletionChoice) *textCompletion {
+	return &textCompletion{ID: fs.id, Object: "text_completion", Created: fs.created, Model: fs.model, Choices: choices}
+}
+
+// collect reads every candidate to the end, in the order of first appearance.
+func (fs *fimStream) collect(body io.Reader, done func(c *fimCandidate)) error {
+	candidates := make(map[int]*fimCandidate)
+	var order []int
+	err := fs.readChunks(body, func(index int, text string, finishReason *string) bool {
+		c, ok := candidates[index]
+		if !ok {
+			c = &fimCandidate{}
+			candidates[index] = c
+			order = append(order, index)
+		}
+		if c.finishReason != nil {
+			return true
+		}
+		c.add(text, fs.stops)
+		if c.finishReason == nil && finishReason != nil {
+			c.finishReason = finishReason
+		}
+		if c.finishReason != nil {
+			done(c)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, index := range order {
+		if c := candidates[index]; c.finishReason == nil {
+			reason := "stop"
+			c.finishReason = &reason
+			done(c)
+		}
+	}
+	return nil
+}
+
+// dedup tracks the candidates already sent. Candidates that differ only in
+// trailing whitespace count as duplicates, and empty ones are dropped.
+type dedup map[string]struct{}
+
+func (d dedup) add(text string) bool {
+	key := strings.TrimRight(text, " \t\r\n")
+	if key == "" {
+		return false
+	}
+	if _, seen := d[key]; seen {
+		return false
+	}
+	d[key] = struct{}{}
+	return true
+}
+
+// buffer answers with every distinct candidate in a single text_completion.
+func (fs *fimStream) buffer(w http.ResponseWriter, body io.Reader) {
+	seen := dedup{}
+	out := fs.chunk()
+	out.Choices = []textCompletionChoice{}
+	err := fs.collect(body, func(c *fimCandidate) {
+		if text := c.text.String(); seen.add(text) {
+			out.Choices = append(out.Choices, textCompletionChoice{Text: text, Index: len(out.Choices), FinishReason: c.finishReason})
+		}
+	})
+	if err != nil {
+		log.Printf("Code completion failed: %v", err)
+		writeUpstreamError(w, err)
+		return
+	}
+	out.Model = fs.model
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(out)
+}
+
+// stream answers as an SSE stream. A single candidate is streamed as it is
+// generated; with several, each distinct candidate is sent whole once it is
+// complete, since duplicates can only be recognized at the end.
+func (fs *fimStream) stream(w http.ResponseWriter, body io.Reader) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	write := func(choice textCompletionChoice) {
+		unstream.WriteSSEJSON(w, fs.chunk(choice))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	var err error
+	if fs.n == 1 {
+		c := &fimCandidate{}
+		err = fs.readChunks(body, func(index int, text string, finishReason *string) bool {
+			if index != 0 {
+				return true
+			}
+			if part := c.add(text, fs.stops); part != "" {
+				write(textCompletionChoice{Text: part})
+			}
+			if c.finishReason == nil && finishReason != nil {
+				c.finishReason = finishReason
+			}
+			return c.finishReason == nil
+		})
+		if err == nil {
+			if c.finishReason == nil {
+				reason := "stop"
+				c.finishReason = &reason
+			}
+			write(textCompletionChoice{Text: c.rest(), FinishReason: c.finishReason})
+		}
+	} else {
+		seen := dedup{}
+		index := 0
+		err = fs.collect(body, func(c *fimCandidate) {
+			if text := c.text.String(); seen.add(text) {
+				write(textCompletionChoice{Text: text, Index: index, FinishReason: c.finishReason})
+				index++
+			}
+		})
+	}
+	if err != nil {
+		log.Printf("Code completion stream failed: %v", err)
+		writeStreamError(w, err)
+		return
+	}
+	unstream.WriteSSEDone(w)
+}
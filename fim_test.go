@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFIMLanguage(t *testing.T) {
+	cases := []struct {
+		language, path string
+		want           string
+	}{
+		{"Go", "main.py", "go"},
+		{"", "src/app/main.PY", "python"},
+		{"", "web/index.tsx", "typescriptreact"},
+		{"", "build/Dockerfile", "dockerfile"},
+		{"", "Makefile", "makefile"},
+		{"", "notes.txt", "plaintext"},
+		{"", "", "plaintext"},
+	}
+	for _, c := range cases {
+		if got := fimLanguage(&fimRequest{Language: c.language, Path: c.path}); got != c.want {
+			t.Errorf("fimLanguage(%q, %q) = %q, want %q", c.language, c.path, got, c.want)
+		}
+	}
+}
+
+func TestFIMPrompt(t *testing.T) {
+	cases := []struct {
+		path, lang string
+		want       string
+	}{
+		{"", "go", "x := "},
+		{"main.go", "go", "// Path: main.go\nx := "},
+		{"app.py", "python", "# Path: app.py\nx := "},
+		{"q.sql", "sql", "-- Path: q.sql\nx := "},
+		{"index.html", "html", "<!-- Path: index.html -->\nx := "},
+	}
+	for _, c := range cases {
+		if got := fimPrompt(&fimRequest{Prompt: "x := ", Path: c.path}, c.lang); got != c.want {
+			t.Errorf("fimPrompt(%q, %q) = %q, want %q", c.path, c.lang, got, c.want)
+		}
+	}
+}
+
+func TestParseStop(t *testing.T) {
+	cases := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{``, nil, false},
+		{`null`, nil, false},
+		{`"\n\n"`, []string{"\n\n"}, false},
+		{`["}", "\nfunc"]`, []string{"}", "\nfunc"}, false},
+		{`5`, nil, true},
+	}
+	for _, c := range cases {
+		got, err := parseStop(json.RawMessage(c.raw))
+		if (err != nil) != c.wantErr || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseStop(%s) = %q, %v", c.raw, got, err)
+		}
+	}
+}
+
+func TestFIMCandidateStops(t *testing.T) {
+	stops := []string{"\n\n", "END"}
+	cases := []struct {
+		chunks []string
+		sent   []string
+		rest   string
+		done   bool
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}, "", false},
+		// A possible stop sequence is held back until it turns out not to be
+		{[]string{"a\n", "b"}, []string{"a", "\nb"}, "", false},
+		{[]string{"a\n", "\nb"}, []string{"a", ""}, "", true},
+		{[]string{"xEN", "Dy"}, []string{"x", ""}, "", true},
+		{[]string{"xEN"}, []string{"x"}, "EN", false},
+		// Nothing is added once a stop sequence was reached
+		{[]string{"aEND", "more"}, []string{"a", ""}, "", true},
+	}
+	for _, c := range cases {
+		var cand fimCandidate
+		var sent []string
+		for _, chunk := range c.chunks {
+			sent = append(sent, cand.add(chunk, stops))
+		}
+		done := cand.finishReason != nil
+		if rest := cand.rest(); !reflect.DeepEqual(sent, c.sent) || rest != c.rest || done != c.done {
+			t.Errorf("%q: sent %q, rest %q, done %v", c.chunks, sent, rest, done)
+		}
+	}
+}
+
+func TestFIMBufferDedup(t *testing.T) {
+	chunk := func(index int, text, finish string) string {
+		ch := map[string]any{"index": index, "text": text}
+		if finish != "" {
+			ch["finish_reason"] = finish
+		}
+		b, _ := json.Marshal(map[string]any{"model": "copilot-codex", "choices": []any{ch}})
+		return "data: " + string(b) + "\n\n"
+	}
+	body := chunk(0, "return x", "") + chunk(1, "return x  ", "") + chunk(2, "", "") +
+		chunk(0, "\n}", "stop") + chunk(1, "\n}", "stop") + chunk(2, "", "stop") +
+		chunk(3, "return y", "length") + "data: [DONE]\n\n"
+
+	fs := &fimStream{n: 4, stops: []string{"\n}"}}
+	w := httptest.NewRecorder()
+	fs.buffer(w, strings.NewReader(body))
+	var out textCompletion
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ch := range out.Choices {
+		got = append(got, ch.Text+" ("+*ch.FinishReason+")")
+	}
+	// The stop sequence is cut, trailing whitespace duplicates and empty
+	// candidates are dropped
+	want := []string{"return x (stop)", "return y (length)"}
+	if !reflect.DeepEqual(got, want) || out.Model != "copilot-codex" {
+		t.Errorf("buffered %q from %s, want %q", got, out.Model, want)
+	}
+}
+
+func TestFIMPolicyMaxTokens(t *testing.T) {
+	config = &Config{Policies: policyConfig{Keys: map[string]policyRules{"*": {MaxTokens: 100}}}}
+	defer func() { config = &Config{} }()
+	var sent []int
+	defer stubUpstream(func(r *http.Request) (*http.Response, error) {
+		var body struct {
+			MaxTokens int `json:"max_tokens"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		sent = append(sent, body.MaxTokens)
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("data: [DONE]\n\n"))}, nil
+	})()
+
+	cases := []struct {
+		body   string
+		status int
+	}{
+		// The default of 500 tokens is over the cap
+		{`{"prompt":"x := "}`, http.StatusBadRequest},
+		{`{"prompt":"x := ","max_tokens":0}`, http.StatusBadRequest},
+		{`{"prompt":"x := ","max_tokens":200}`, http.StatusBadRequest},
+		{`{"prompt":"x := ","max_tokens":100}`, http.StatusOK},
+	}
+	for _, c := range cases {
+		tokenCache.Set("fim", CopilotToken{Token: "ct", Expiry: time.Now().Add(time.Hour).Unix()})
+		r := httptest.NewRequest("POST", "/v1/fim/completions", strings.NewReader(c.body))
+		r.Header.Set("Authorization", "Bearer fim")
+		w := httptest.NewRecorder()
+		handleFIM(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: %d %s, want %d", c.body, w.Code, w.Body.String(), c.status)
+		}
+	}
+	if !reflect.DeepEqual(sent, []int{100}) {
+		t.Errorf("sent max_tokens %v upstream, want [100]", sent)
+	}
+}
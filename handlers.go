@@ -1,13 +1,11 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"copilot-proxy/unstream"
 	"embed"
 	"encoding/json"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -94,7 +92,11 @@ func copyRequestHeaders(dst *http.Request, src *http.Request, token string) {
 }
 
 func copyResponseHeaders(dst http.ResponseWriter, src *http.Response, skip map[string]struct{}) {
-	for k, v := range src.Header {
+	copyHeaders(dst, src.Header, skip)
+}
+
+func copyHeaders(dst http.ResponseWriter, src http.Header, skip map[string]struct{}) {
+	for k, v := range src {
 		if _, found := skip[k]; found {
 			continue
 		}
@@ -104,13 +106,15 @@ func copyResponseHeaders(dst http.ResponseWriter, src *http.Response, skip map[s
 	}
 }
 
-func handleGitHubProxy(w http.ResponseWriter, r *http.Request) {
-	log.Println("Forwarding GitHub Copilot Request")
+// copilotToken returns the Copilot token for the GitHub token in the request's
+// Authorization header, fetching it if it is not cached. On failure the error
+// has already been written to w.
+func copilotToken(w http.ResponseWriter, r *http.Request) (CopilotToken, bool) {
 	auth := r.Header.Get("Authorization")
 	if len(auth) < 8 || auth[:7] != "Bearer " {
 		log.Println("403: Missing Authoirzation header")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+		return CopilotToken{}, false
 	}
 	accessToken := auth[7:]
 	ct, ok := tokenCache.Get(accessToken)
@@ -121,10 +125,19 @@ func handleGitHubProxy(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Println("500: Failed to fetch copilot token")
 			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
+			return CopilotToken{}, false
 		}
 		tokenCache.Set(accessToken, ct)
 	}
+	return ct, true
+}
+
+func handleGitHubProxy(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Forwarding GitHub Copilot Request (key %s)", callerKeyID(r))
+	ct, ok := copilotToken(w, r)
+	if !ok {
+		return
+	}
 
 	if strings.HasPrefix(r.URL.Path, "/v1") {
 		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/v1")
@@ -137,83 +150,141 @@ func handleGitHubProxy(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 
-	// Detect if this is a non-streaming gpt-4.1 request
-	var reqBody struct {
-		Stream bool   `json:"stream"`
-		Model  string `json:"model"`
-	}
-	_ = json.Unmarshal(bodyBytes, &reqBody)
-	isGpt41 := strings.HasPrefix(reqBody.Model, "gpt-4.1")
-	if isGpt41 && !reqBody.Stream {
-		// Special handling: force streaming, collect, then return as non-stream
-		log.Println("Special handling: gpt-4.1 non-streaming request, using unstream/conversion.go")
-		// Clone the request, but set stream=true
-		var m map[string]any
-		if err := json.Unmarshal(bodyBytes, &m); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	// Resolve the model, then inspect it and the stream flag to pick how to
+	// talk to upstream
+	isChat := r.URL.Path == "/chat/completions"
+	if isChat && !validateChatBody(w, bodyBytes) {
+		return
+	}
+	var route *modelRoute
+	if isChat {
+		var prompts []string
+		if bodyBytes, prompts, ok = applyPrompts(w, r, bodyBytes); !ok {
 			return
 		}
-		m["stream"] = true
-		newBody, _ := json.Marshal(m)
-		proxyReq, err := http.NewRequest(r.Method, fmt.Sprintf("https://api.githubcopilot.com%s", r.URL.Path), bytes.NewReader(newBody))
+		bodyBytes, route = routeChat(r, bodyBytes)
+		route.setModelHeader(w)
+		recordPrompts(w, r, prompts)
+	}
+	if !enforcePolicy(w, r, bodyBytes, route.upstreamModel()) {
+		return
+	}
+	bodyBytes, scrubbed, ok := scrubRequest(w, r, bodyBytes)
+	if !ok {
+		return
+	}
+	cr := newChatRequest(r, ct.Token, bodyBytes)
+	cr.route = route
+	cr.scrubbed = scrubbed
+	if isChat && !preflightContext(w, cr) {
+		return
+	}
+	release, ok := admitCaller(w, r, isChat && cr.Stream)
+	if !ok {
+		return
+	}
+	defer release()
+	if isChat && serveCachedChat(w, cr) {
+		return
+	}
+	if isChat && cr.needsBuffering() {
+		handleBufferedCompletion(w, cr)
+		return
+	}
+
+	// Normal proxy behavior
+	var resp *http.Response
+	if isChat {
+		var err error
+		resp, err = sendChat(cr, cr.upstreamBody)
+		cr.setServedHeaders(w)
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+		catalog.noteChatResponse(r, resp)
+	} else {
+		req, err := newUpstreamRequest(r, bodyBytes, ct.Token)
 		if err != nil {
 			http.Error(w, "Failed to create request", http.StatusInternalServerError)
 			return
 		}
-		copyRequestHeaders(proxyReq, r, ct.Token)
-		resp, err := http.DefaultClient.Do(proxyReq)
+		resp, err = http.DefaultClient.Do(req)
 		if err != nil {
 			http.Error(w, "Upstream error", http.StatusBadGateway)
 			return
 		}
-		defer resp.Body.Close()
+	}
+	defer resp.Body.Close()
+
+	if isChat && !cr.Stream && resp.StatusCode == http.StatusOK && !isJSONResponse(resp) {
+		// A fallback model that has to stream answered a non-streaming request
+		final, err := readCompletion(resp, cr.mergeChoices())
+		if err == nil && cr.emulateTools {
+			applyEmulatedToolCalls(cr, final)
+		}
+		if err == nil {
+			final, _, err = finishCompletion(cr, final)
+		}
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+		publishCompletion(cr, final)
+		storeCachedChat(cr, final)
+		writeCompletion(w, cr, resp.Header, final)
+		log.Println("Copilot Request Completed (collected stream)")
+		return
+	}
 
-		// Collect the stream and convert to non-streaming response
-		collector := unstream.NewOAIStreamCollector()
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if !strings.HasPrefix(line, "data: ") {
-				continue
+	if isChat && cr.Stream && resp.StatusCode == http.StatusOK {
+		// Some models ignore stream:true and answer with a single JSON body
+		if isJSONResponse(resp) {
+			log.Printf("Upstream answered %s without streaming, synthesizing stream", cr.Model)
+			final, err := readCompletion(resp, cr.mergeChoices())
+			if err == nil && cr.emulateTools {
+				applyEmulatedToolCalls(cr, final)
 			}
-			payload := strings.TrimPrefix(line, "data: ")
-			if payload == "[DONE]" {
-				break
+			if err == nil {
+				final, _, err = finishCompletion(cr, final)
 			}
-			var chunk unstream.OAIStreamChunk
-			if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
-				continue
+			if err != nil {
+				writeUpstreamError(w, err)
+				return
 			}
-			collector.AddChunk(&chunk)
-		}
-		final := collector.BuildResponse()
-		// Copy all headers except for Transfer-Encoding (since we're not streaming)
-		copyResponseHeaders(w, resp, map[string]struct{}{"Transfer-Encoding": {}})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		json.NewEncoder(w).Encode(final)
-		log.Println("Copilot Request Completed (non-stream gpt-4.1)")
-		return
+			publishCompletion(cr, final)
+			storeCachedChat(cr, final)
+			writeSynthesizedStream(w, resp.Header, final)
+			log.Println("Copilot Request Completed (synthesized stream)")
+			return
+		}
+		if cr.needsRelay() {
+			relayStream(w, cr, resp)
+			log.Println("Copilot Request Completed (relayed stream)")
+			return
+		}
 	}
 
-	// Normal proxy behavior
-	req, err := http.NewRequest(r.Method, fmt.Sprintf("https://api.githubcopilot.com%s", r.URL.Path), bytes.NewReader(bodyBytes))
-	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
-	}
-	copyRequestHeaders(req, r, ct.Token)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		http.Error(w, "Upstream error", http.StatusBadGateway)
+	if isChat && cr.Stream && resp.StatusCode == http.StatusOK {
+		final, complete := teeStream(w, cr, resp)
+		publishStream(cr, final, complete)
+		log.Println("Copilot Request Completed (streamed)")
 		return
 	}
-	defer resp.Body.Close()
 
 	// Copy all headers
 	copyResponseHeaders(w, resp, nil)
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if isChat && resp.StatusCode == http.StatusOK {
+		var body bytes.Buffer
+		io.Copy(w, io.TeeReader(resp.Body, &body))
+		var final unstream.OAIChatResponse
+		if json.Unmarshal(body.Bytes(), &final) == nil {
+			publishCompletion(cr, &final)
+		}
+	} else {
+		io.Copy(w, resp.Body)
+	}
 	log.Println("Copilot Request Completed")
 }
 
@@ -0,0 +1,365 @@
+// Package jsonschema validates decoded JSON values against the subset of JSON
+// Schema that OpenAI tools and response_format schemas use in practice.
+//
+// Supported keywords: type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, minimum, maximum, exclusiveMinimum, exclusiveMaximum, anyOf,
+// oneOf, allOf and local $ref into $defs or definitions. Unknown keywords are
+// ignored so that schemas written for richer validators still pass.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationError describes the first violation found, with a JSON pointer
+// style path to the offending value.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Schema is a parsed schema document.
+type Schema struct {
+	root   map[string]any
+	reject bool // the boolean schema false
+}
+
+// Parse parses a schema document. A nil or empty document accepts everything.
+func Parse(raw []byte) (*Schema, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return &Schema{}, nil
+	}
+	var root any
+	if err := json.Unmarshal(raw, &root); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	switch v := root.(type) {
+	case map[string]any:
+		return &Schema{root: v}, nil
+	case bool:
+		return &Schema{reject: !v}, nil
+	}
+	return nil, fmt.Errorf("invalid schema: expected an object")
+}
+
+// Validate checks a value decoded with encoding/json against the schema.
+func (s *Schema) Validate(value any) error {
+	if s == nil {
+		return nil
+	}
+	if s.reject {
+		return &ValidationError{Message: "no value is allowed"}
+	}
+	if s.root == nil {
+		return nil
+	}
+	return s.validate(s.root, value, "", map[string]bool{})
+}
+
+// ValidateJSON decodes doc and validates it against the schema.
+func (s *Schema) ValidateJSON(doc []byte) error {
+	var value any
+	if err := json.Unmarshal(doc, &value); err != nil {
+		return &ValidationError{Message: "invalid JSON: " + err.Error()}
+	}
+	return s.Validate(value)
+}
+
+// validate checks value against schema. active holds the $ref and instance
+// path pairs currently being expanded, so a reference that reaches itself
+// without descending into the value is reported instead of recursing forever.
+func (s *Schema) validate(schema map[string]any, value any, path string, active map[string]bool) error {
+	fail := func(format string, args ...any) error {
+		return &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return fail("%v", err)
+		}
+		key := ref + "\x00" + path
+		if active[key] {
+			return fail("$ref %q refers to itself", ref)
+		}
+		active[key] = true
+		defer delete(active, key)
+		return s.validate(target, value, path, active)
+	}
+
+	if t, ok := schema["type"]; ok {
+		if !matchesType(t, value) {
+			return fail("expected %s, got %s", describeType(t), typeName(value))
+		}
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if equal(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("value %s is not one of %s", encode(value), encode(enum))
+		}
+	}
+	if c, ok := schema["const"]; ok && !equal(c, value) {
+		return fail("expected %s, got %s", encode(c), encode(value))
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		if err := s.validateObject(schema, v, path, active); err != nil {
+			return err
+		}
+	case []any:
+		if n, ok := number(schema["minItems"]); ok && float64(len(v)) < n {
+			return fail("expected at least %v items, got %d", n, len(v))
+		}
+		if n, ok := number(schema["maxItems"]); ok && float64(len(v)) > n {
+			return fail("expected at most %v items, got %d", n, len(v))
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := s.validate(items, item, fmt.Sprintf("%s/%d", path, i), active); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if n, ok := number(schema["minLength"]); ok && length < n {
+			return fail("expected at least %v characters", n)
+		}
+		if n, ok := number(schema["maxLength"]); ok && length > n {
+			return fail("expected at most %v characters", n)
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err == nil && !re.MatchString(v) {
+				return fail("value %q does not match pattern %q", v, p)
+			}
+		}
+	case float64:
+		if n, ok := number(schema["minimum"]); ok && v < n {
+			return fail("expected a value >= %v, got %v", n, v)
+		}
+		if n, ok := number(schema["maximum"]); ok && v > n {
+			return fail("expected a value <= %v, got %v", n, v)
+		}
+		if n, ok := number(schema["exclusiveMinimum"]); ok && v <= n {
+			return fail("expected a value > %v, got %v", n, v)
+		}
+		if n, ok := number(schema["exclusiveMaximum"]); ok && v >= n {
+			return fail("expected a value < %v, got %v", n, v)
+		}
+	}
+
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			if m, ok := sub.(map[string]any); ok {
+				if err := s.validate(m, value, path, active); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		var first error
+		matched := false
+		for _, sub := range anyOf {
+			if m, ok := sub.(map[string]any); ok {
+				err := s.validate(m, value, path, active)
+				if err == nil {
+					matched = true
+					break
+				}
+				if first == nil {
+					first = err
+				}
+			}
+		}
+		if !matched && first != nil {
+			return fail("value does not match any allowed schema (%v)", first)
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		matches := 0
+		for _, sub := range oneOf {
+			if m, ok := sub.(map[string]any); ok && s.validate(m, value, path, active) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("value matches %d schemas, expected exactly one", matches)
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(schema map[string]any, obj map[string]any, path string, active map[string]bool) error {
+	props, _ := schema["properties"].(map[string]any)
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				return &ValidationError{Path: path, Message: fmt.Sprintf("missing required property %q", name)}
+			}
+		}
+	}
+	// Iterate in a fixed order so the reported error is deterministic
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		childPath := path + "/" + escapePointer(k)
+		if sub, ok := props[k].(map[string]any); ok {
+			if err := s.validate(sub, obj[k], childPath, active); err != nil {
+				return err
+			}
+			continue
+		}
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				return &ValidationError{Path: path, Message: fmt.Sprintf("unexpected property %q", k)}
+			}
+		case map[string]any:
+			if err := s.validate(extra, obj[k], childPath, active); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) resolve(ref string) (map[string]any, error) {
+	if ref == "#" {
+		return s.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	var cur any = s.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		cur = m[part]
+	}
+	target, ok := cur.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %q", ref)
+	}
+	return target, nil
+}
+
+func matchesType(t any, value any) bool {
+	switch t := t.(type) {
+	case string:
+		return matchesSingleType(t, value)
+	case []any:
+		for _, tt := range t {
+			if name, ok := tt.(string); ok && matchesSingleType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesSingleType(t string, value any) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func describeType(t any) string {
+	if list, ok := t.([]any); ok {
+		names := make([]string, 0, len(list))
+		for _, n := range list {
+			names = append(names, fmt.Sprint(n))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func typeName(value any) string {
+	switch v := value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func number(v any) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func equal(a, b any) bool {
+	return encode(a) == encode(b)
+}
+
+func encode(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
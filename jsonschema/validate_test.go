@@ -0,0 +1,107 @@
+package jsonschema
+
+import (
+	"strings"
+	"testing"
+)
+
+const weatherSchema = `{
+	"type": "object",
+	"properties": {
+		"location": {"type": "string", "minLength": 1},
+		"unit": {"type": "string", "enum": ["celsius", "fahrenheit"]},
+		"days": {"type": "integer", "minimum": 1, "maximum": 7},
+		"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}}
+	},
+	"required": ["location"],
+	"additionalProperties": false,
+	"$defs": {"tag": {"type": "string", "pattern": "^[a-z]+$"}}
+}`
+
+func TestValidate(t *testing.T) {
+	schema, err := Parse([]byte(weatherSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		doc     string
+		wantErr string
+	}{
+		{`{"location":"Paris"}`, ""},
+		{`{"location":"Paris","unit":"celsius","days":3,"tags":["rain"]}`, ""},
+		{`{}`, `missing required property "location"`},
+		{`{"location":42}`, "/location: expected string, got integer"},
+		{`{"location":"Paris","unit":"kelvin"}`, "/unit: value \"kelvin\" is not one of"},
+		{`{"location":"Paris","days":1.5}`, "/days: expected integer, got number"},
+		{`{"location":"Paris","days":9}`, "/days: expected a value <= 7"},
+		{`{"location":"Paris","extra":true}`, `unexpected property "extra"`},
+		{`{"location":"Paris","tags":["ok","NOT"]}`, "/tags/1: value \"NOT\" does not match pattern"},
+		{`{"location":`, "invalid JSON"},
+	}
+	for _, c := range cases {
+		err := schema.ValidateJSON([]byte(c.doc))
+		if c.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.doc, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%s: expected error containing %q, got %v", c.doc, c.wantErr, err)
+		}
+	}
+}
+
+func TestValidate_Combinators(t *testing.T) {
+	schema, err := Parse([]byte(`{"anyOf":[{"type":"string"},{"type":"array","items":{"type":"string"}}],"oneOf":[{"type":"string","maxLength":3},{"type":"array"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for doc, ok := range map[string]bool{`"abc"`: true, `["x"]`: true, `"abcd"`: false, `5`: false} {
+		if err := schema.ValidateJSON([]byte(doc)); (err == nil) != ok {
+			t.Errorf("%s: expected valid=%v, got %v", doc, ok, err)
+		}
+	}
+}
+
+func TestParse_EmptyAndBoolean(t *testing.T) {
+	for raw, ok := range map[string]bool{``: true, `true`: true, `false`: false, `{}`: true} {
+		schema, err := Parse([]byte(raw))
+		if err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+		if err := schema.Validate(map[string]any{"a": 1.0}); (err == nil) != ok {
+			t.Errorf("%q: expected valid=%v, got %v", raw, ok, err)
+		}
+	}
+}
+
+func TestValidate_RecursiveRef(t *testing.T) {
+	cases := []struct {
+		schema  string
+		doc     string
+		wantErr string
+	}{
+		{`{"$ref":"#"}`, `{}`, `$ref "#" refers to itself`},
+		{`{"anyOf":[{"$ref":"#"}]}`, `1`, `refers to itself`},
+		{`{"$defs":{"a":{"$ref":"#/$defs/b"},"b":{"$ref":"#/$defs/a"}},"$ref":"#/$defs/a"}`, `{}`, `refers to itself`},
+		{`{"type":"object","properties":{"children":{"type":"array","items":{"$ref":"#"}}}}`, `{"children":[{"children":[{}]}]}`, ""},
+		{`{"type":"object","properties":{"children":{"type":"array","items":{"$ref":"#"}}}}`, `{"children":[{"children":[5]}]}`, "/children/0/children/0: expected object"},
+	}
+	for _, c := range cases {
+		schema, err := Parse([]byte(c.schema))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = schema.ValidateJSON([]byte(c.doc))
+		if c.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", c.schema, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Errorf("%s: expected error containing %q, got %v", c.schema, c.wantErr, err)
+		}
+	}
+}
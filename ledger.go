@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"copilot-proxy/unstream"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The usage ledger records every completed API request, one JSON line each,
+// for chargeback. /admin/usage reports it grouped by day, key, team and model,
+// as JSON or CSV.
+
+type ledgerConfig struct {
+	// Path is the ledger file. The ledger is off when it is empty.
+	Path string `json:"path"`
+}
+
+// ledgerEntry is one request in the ledger. Team is the caller's team in the
+// quotas config, the account its usage is charged to.
+type ledgerEntry struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id,omitempty"`
+	Key              string    `json:"key"`
+	Team             string    `json:"team,omitempty"`
+	Endpoint         string    `json:"endpoint"`
+	RequestedModel   string    `json:"requested_model,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	CachedTokens     int       `json:"cached_tokens"`
+	LatencyMS        int64     `json:"latency_ms"`
+	Status           int       `json:"status"`
+	Stream           bool      `json:"stream"`
+	CacheHit         bool      `json:"cache_hit,omitempty"`
+	Prompts          []string  `json:"prompts,omitempty"`
+}
+
+type ledgerContextKey struct{}
+
+// ledgerRecord is the entry being filled in for a request in flight.
+type ledgerRecord struct {
+	mu    sync.Mutex
+	entry ledgerEntry
+}
+
+func requestLedgerRecord(r *http.Request) *ledgerRecord {
+	rec, _ := r.Context().Value(ledgerContextKey{}).(*ledgerRecord)
+	return rec
+}
+
+// addPrompts records the managed prompts added to the request.
+func (rec *ledgerRecord) addPrompts(labels []string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.entry.Prompts = append(rec.entry.Prompts, labels...)
+}
+
+// addUsage adds the usage of a response served by model.
+func (rec *ledgerRecord) addUsage(model string, usage *unstream.OAIUsage) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if model != "" {
+		rec.entry.Model = model
+	}
+	if usage == nil {
+		return
+	}
+	rec.entry.PromptTokens += usage.PromptTokens
+	rec.entry.CompletionTokens += usage.CompletionTokens
+	if usage.PromptTokensDetails != nil {
+		rec.entry.CachedTokens += usage.PromptTokensDetails.CachedTokens
+	}
+}
+
+// callerTeam returns the first team, by name, that the key belongs to.
+func callerTeam(key string) string {
+	var teams []string
+	for name, team := range config.Quotas.Teams {
+		if contains(team.Keys, key) {
+			teams = append(teams, name)
+		}
+	}
+	if len(teams) == 0 {
+		return ""
+	}
+	sort.Strings(teams)
+	return teams[0]
+}
+
+// statusRecorder remembers the status written through it, and when capture is
+// set, up to captureLimit bytes of the body.
+type statusRecorder struct {
+	http.ResponseWriter
+	status       int
+	capture      *bytes.Buffer
+	captureLimit int
+	truncated    bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if s.capture != nil {
+		if room := s.captureLimit - s.capture.Len(); room < len(p) {
+			s.capture.Write(p[:max(room, 0)])
+			s.truncated = true
+		} else {
+			s.capture.Write(p)
+		}
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument wraps an API handler with the request records: a request id, the
+// usage ledger and the audit log.
+func instrument(next http.HandlerFunc) http.HandlerFunc {
+	return withRequestID(withLedger(withAudit(next)))
+}
+
+// withLedger records the requests served by next in the ledger.
+func withLedger(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.Ledger.Path == "" {
+			next(w, r)
+			return
+		}
+		start := time.Now()
+		var params struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		if r.Body != nil {
+			body, _ := io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			json.Unmarshal(body, &params)
+		}
+		key := callerKeyID(r)
+		rec := &ledgerRecord{entry: ledgerEntry{
+			Time:           start.UTC(),
+			RequestID:      requestID(r),
+			Key:            key,
+			Team:           callerTeam(key),
+			Endpoint:       strings.TrimPrefix(r.URL.Path, "/v1"),
+			RequestedModel: params.Model,
+			Stream:         params.Stream,
+		}}
+		sw := &statusRecorder{ResponseWriter: w}
+		next(sw, r.WithContext(context.WithValue(r.Context(), ledgerContextKey{}, rec)))
+
+		rec.mu.Lock()
+		entry := rec.entry
+		rec.mu.Unlock()
+		entry.LatencyMS = time.Since(start).Milliseconds()
+		entry.Status = sw.status
+		if model := w.Header().Get("X-Copilot-Proxy-Model"); model != "" {
+			entry.Model = model
+		}
+		if entry.Model == "" {
+			entry.Model = entry.RequestedModel
+		}
+		entry.CacheHit = w.Header().Get("X-Copilot-Proxy-Cache") == "hit"
+		ledger.append(&entry)
+	}
+}
+
+type usageLedger struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+var ledger = &usageLedger{}
+
+func (l *usageLedger) append(entry *ledgerEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil || l.path != config.Ledger.Path {
+		if l.file != nil {
+			l.file.Close()
+		}
+		l.path = config.Ledger.Path
+		l.file, err = os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			log.Printf("Failed to open usage ledger: %v", err)
+			l.file = nil
+			return
+		}
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write usage ledger: %v", err)
+	}
+}
+
+// read calls fn for every entry of the ledger. Entries are written whole
+// under the lock, so the file is scanned without it up to its size at the
+// start, and requests are not held up while a report is made.
+func (l *usageLedger) read(fn func(*ledgerEntry)) error {
+	f, err := os.Open(config.Ledger.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	l.mu.Lock()
+	info, err := f.Stat()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(io.LimitReader(f, info.Size()))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry ledgerEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			fn(&entry)
+		}
+	}
+	return scanner.Err()
+}
+
+// requireAdmin checks that the caller has a valid token whose full hash is
+// one of the admin keys. Otherwise it writes an error and returns false.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if _, ok := copilotToken(w, r); !ok {
+		return false
+	}
+	if !isAdminHash(callerKeyHash(r)) {
+		log.Printf("403: Key %s is not an admin key", callerKeyID(r))
+		writeAPIError(w, http.StatusForbidden, "permission_error", "This endpoint is restricted to admin keys")
+		return false
+	}
+	return true
+}
+
+// isAdminHash reports whether a token hash is one of the admin keys, in
+// constant time.
+func isAdminHash(hash string) bool {
+	admin := 0
+	for _, key := range config.AdminKeys {
+		admin |= subtle.ConstantTimeCompare([]byte(strings.ToLower(key)), []byte(hash))
+	}
+	return hash != "" && admin == 1
+}
+
+// usageGroup is a row of the usage report.
+type usageGroup struct {
+	Day              string `json:"day,omitempty"`
+	Key              string `json:"key,omitempty"`
+	Team             string `json:"team,omitempty"`
+	Model            string `json:"model,omitempty"`
+	Requests         int    `json:"requests"`
+	Errors           int    `json:"errors"`
+	Streamed         int    `json:"streamed"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	CachedTokens     int    `json:"cached_tokens"`
+	LatencyMS        int64  `json:"total_latency_ms"`
+}
+
+var usageGroupFields = []string{"day", "key", "team", "model"}
+
+// handleAdminUsage serves /admin/usage. Query parameters:
+//
+//	group_by  comma separated: day, key, team, model (none lists the entries)
+//	from, to  inclusive dates, YYYY-MM-DD
+//	key, team, model  filters
+//	format    json (default) or csv
+func handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	var groupBy []string
+	if g := q.Get("group_by"); g != "" {
+		for _, field := range strings.Split(g, ",") {
+			field = strings.TrimSpace(field)
+			if !contains(usageGroupFields, field) {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "group_by must list day, key, team or model")
+				return
+			}
+			groupBy = append(groupBy, field)
+		}
+	}
+	for _, param := range []string{"from", "to"} {
+		if v := q.Get(param); v != "" {
+			if _, err := time.Parse(time.DateOnly, v); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request_error", param+" must be a date (YYYY-MM-DD)")
+				return
+			}
+		}
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "format must be json or csv")
+		return
+	}
+
+	match := func(e *ledgerEntry) bool {
+		day := e.Time.Format(time.DateOnly)
+		return (q.Get("from") == "" || day >= q.Get("from")) &&
+			(q.Get("to") == "" || day <= q.Get("to")) &&
+			(q.Get("key") == "" || e.Key == q.Get("key")) &&
+			(q.Get("team") == "" || e.Team == q.Get("team")) &&
+			(q.Get("model") == "" || e.Model == q.Get("model"))
+	}
+	entries := []ledgerEntry{}
+	groups := make(map[usageGroup]*usageGroup)
+	err := ledger.read(func(e *ledgerEntry) {
+		if !match(e) {
+			return
+		}
+		if len(groupBy) == 0 {
+			entries = append(entries, *e)
+			return
+		}
+		var id usageGroup
+		for _, field := range groupBy {
+			switch field {
+			case "day":
+				id.Day = e.Time.Format(time.DateOnly)
+			case "key":
+				id.Key = e.Key
+			case "team":
+				id.Team = e.Team
+			case "model":
+				id.Model = e.Model
+			}
+		}
+		g := groups[id]
+		if g == nil {
+			g = &usageGroup{Day: id.Day, Key: id.Key, Team: id.Team, Model: id.Model}
+			groups[id] = g
+		}
+		g.Requests++
+		if e.Status >= http.StatusBadRequest {
+			g.Errors++
+		}
+		if e.Stream {
+			g.Streamed++
+		}
+		g.PromptTokens += e.PromptTokens
+		g.CompletionTokens += e.CompletionTokens
+		g.CachedTokens += e.CachedTokens
+		g.LatencyMS += e.LatencyMS
+	})
+	if err != nil {
+		log.Printf("Failed to read usage ledger: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "server_error", "Failed to read the usage ledger")
+		return
+	}
+
+	if len(groupBy) == 0 {
+		if format == "csv" {
+			writeUsageCSV(w, []string{"time", "key", "team", "endpoint", "requested_model", "model", "prompt_tokens", "completion_tokens", "cached_tokens", "latency_ms", "status", "stream", "cache_hit"}, len(entries), func(i int) []string {
+				e := &entries[i]
+				return []string{e.Time.Format(time.RFC3339), e.Key, e.Team, e.Endpoint, e.RequestedModel, e.Model,
+					strconv.Itoa(e.PromptTokens), strconv.Itoa(e.CompletionTokens), strconv.Itoa(e.CachedTokens),
+					strconv.FormatInt(e.LatencyMS, 10), strconv.Itoa(e.Status), strconv.FormatBool(e.Stream), strconv.FormatBool(e.CacheHit)}
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": entries})
+		return
+	}
+
+	rows := make([]usageGroup, 0, len(groups))
+	for _, g := range groups {
+		rows = append(rows, *g)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		for _, pair := range [][2]string{{a.Day, b.Day}, {a.Key, b.Key}, {a.Team, b.Team}, {a.Model, b.Model}} {
+			if pair[0] != pair[1] {
+				return pair[0] < pair[1]
+			}
+		}
+		return false
+	})
+	if format == "csv" {
+		header := append(append([]string(nil), groupBy...), "requests", "errors", "streamed", "prompt_tokens", "completion_tokens", "cached_tokens", "total_latency_ms")
+		writeUsageCSV(w, header, len(rows), func(i int) []string {
+			g := &rows[i]
+			var record []string
+			for _, field := range groupBy {
+				record = append(record, map[string]string{"day": g.Day, "key": g.Key, "team": g.Team, "model": g.Model}[field])
+			}
+			return append(record, strconv.Itoa(g.Requests), strconv.Itoa(g.Errors), strconv.Itoa(g.Streamed),
+				strconv.Itoa(g.PromptTokens), strconv.Itoa(g.CompletionTokens), strconv.Itoa(g.CachedTokens), strconv.FormatInt(g.LatencyMS, 10))
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "group_by": groupBy, "data": rows})
+}
+
+func writeUsageCSV(w http.ResponseWriter, header []string, n int, row func(int) []string) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for i := 0; i < n; i++ {
+		cw.Write(row(i))
+	}
+	cw.Flush()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLedgerReadSnapshot(t *testing.T) {
+	config = &Config{Ledger: ledgerConfig{Path: filepath.Join(t.TempDir(), "usage.jsonl")}}
+	defer func() { config = &Config{} }()
+	l := &usageLedger{}
+	defer func() { l.file.Close() }()
+	for _, id := range []string{"req_1", "req_2"} {
+		l.append(&ledgerEntry{RequestID: id})
+	}
+
+	done := make(chan []string)
+	go func() {
+		var read []string
+		l.read(func(e *ledgerEntry) {
+			read = append(read, e.RequestID)
+			// Requests keep being recorded while the ledger is read
+			l.append(&ledgerEntry{RequestID: e.RequestID + "_later"})
+		})
+		done <- read
+	}()
+	select {
+	case read := <-done:
+		if len(read) != 2 || read[0] != "req_1" || read[1] != "req_2" {
+			t.Errorf("read %v, want the entries written before the read", read)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("appending while the ledger is read blocks")
+	}
+
+	var n int
+	l.read(func(*ledgerEntry) { n++ })
+	if n != 4 {
+		t.Errorf("%d entries after the read, want 4", n)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	admin := callerRequest("admin")
+	config = &Config{AdminKeys: []string{callerKeyHash(admin), callerKeyID(callerRequest("short"))}}
+	defer func() { config = &Config{} }()
+	for _, token := range []string{"admin", "short", "other"} {
+		tokenCache.Set(token, CopilotToken{Token: "ct", Expiry: time.Now().Add(time.Hour).Unix()})
+	}
+
+	cases := []struct {
+		token string
+		want  int
+	}{
+		{"admin", http.StatusOK},
+		// A key id is not enough
+		{"short", http.StatusForbidden},
+		{"other", http.StatusForbidden},
+		{"", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/admin/metrics", nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		handleAdminMetrics(w, r)
+		if w.Code != c.want {
+			t.Errorf("token %q: status %d, want %d", c.token, w.Code, c.want)
+		}
+	}
+}
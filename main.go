@@ -26,8 +26,12 @@ type AccessTokenResponse struct {
 }
 
 type CopilotToken struct {
-	Token  string `json:"token"`
-	Expiry int64  `json:"expires_at"`
+	Token     string `json:"token"`
+	Expiry    int64  `json:"expires_at"`
+	Endpoints struct {
+		API   string `json:"api"`
+		Proxy string `json:"proxy"` // code completion engines
+	} `json:"endpoints"`
 }
 type TokenCache struct {
 	mu       sync.Mutex
@@ -118,16 +122,49 @@ func main() {
 			if arg == "-listen" && i+1 < len(os.Args) {
 				listenAddr = os.Args[i+1]
 			}
+			if arg == "-config" && i+1 < len(os.Args) {
+				c, err := loadConfig(os.Args[i+1])
+				if err != nil {
+					log.Fatalf("Failed to load config: %v", err)
+				}
+				config = c
+			}
+		}
+		for i, arg := range os.Args {
+			if arg == "-decrypt-audit" && i+1 < len(os.Args) {
+				if err := decryptAuditFile(os.Args[i+1], os.Stdout); err != nil {
+					log.Fatalf("Failed to decrypt audit file: %v", err)
+				}
+				return
+			}
 		}
 	}
 	http.HandleFunc("/", handleIndex)
 	http.HandleFunc("/login", handleLogin)
 	http.HandleFunc("/ws/poll", handleWebsocketPoll)
-	http.HandleFunc("/chat/completions", handleGitHubProxy)
-	http.HandleFunc("/models", handleGitHubProxy)
-	http.HandleFunc("/v1/chat/completions", handleGitHubProxy)
-	http.HandleFunc("/v1/models", handleGitHubProxy)
-	http.HandleFunc("/embeddings", handleGitHubProxy)
+	http.HandleFunc("/chat/completions", instrument(handleGitHubProxy))
+	http.HandleFunc("/models", handleModels)
+	http.HandleFunc("/models/", handleModels)
+	http.HandleFunc("/v1/chat/completions", instrument(handleGitHubProxy))
+	http.HandleFunc("/v1/models", handleModels)
+	http.HandleFunc("/v1/models/", handleModels)
+	http.HandleFunc("/embeddings", instrument(handleEmbeddings))
+	http.HandleFunc("/v1/embeddings", instrument(handleEmbeddings))
+	http.HandleFunc("/completions", instrument(handleCompletions))
+	http.HandleFunc("/v1/completions", instrument(handleCompletions))
+	http.HandleFunc("/fim/completions", instrument(handleFIM))
+	http.HandleFunc("/v1/fim/completions", instrument(handleFIM))
+	http.HandleFunc("/tokenize", handleTokenize)
+	http.HandleFunc("/v1/tokenize", handleTokenize)
+	http.HandleFunc("/v1/messages/count_tokens", handleCountTokens)
+	http.HandleFunc("/threads", handleThreads)
+	http.HandleFunc("/threads/", handleThreads)
+	http.HandleFunc("/v1/threads", handleThreads)
+	http.HandleFunc("/v1/threads/", handleThreads)
+	http.HandleFunc("/quota", handleQuota)
+	http.HandleFunc("/v1/quota", handleQuota)
+	http.HandleFunc("/admin/usage", handleAdminUsage)
+	http.HandleFunc("/admin/metrics", handleAdminMetrics)
 	log.Printf("Listening at http://%s\n", listenAddr)
 	log.Fatal(http.ListenAndServe(listenAddr, nil))
 }
\ No newline at end of file
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"copilot-proxy/jsonschema"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Policies restrict what callers may send, by key and by team, before the
+// proxy forwards anything. Chat requests are also checked against the OpenAI
+// request schema so that malformed ones fail here, naming the offending field,
+// rather than upstream.
+
+type policyConfig struct {
+	// Keys maps key ids to their rules. "*" applies to keys without rules of
+	// their own.
+	Keys map[string]policyRules `json:"keys"`
+	// Teams maps the teams of the quotas config to rules that apply to all of
+	// their keys, on top of the key's own.
+	Teams map[string]policyRules `json:"teams"`
+	// SkipValidation turns off the schema check of chat requests.
+	SkipValidation bool `json:"skip_validation"`
+}
+
+// policyRules are the limits of one key or team. Zero values do not limit.
+type policyRules struct {
+	// Models are the models that may be used, exact or as globs. For chat
+	// requests this is the upstream model after routing.
+	Models []string `json:"models"`
+	// MaxTokens caps max_tokens and max_completion_tokens.
+	MaxTokens int `json:"max_tokens"`
+	// MaxN caps the number of choices asked for.
+	MaxN int `json:"max_n"`
+	// MaxMessages caps the number of messages of a chat request.
+	MaxMessages int `json:"max_messages"`
+	// MaxImages caps the number of image inputs of a chat request.
+	MaxImages int `json:"max_images"`
+	// MaxBodyBytes caps the size of the request body.
+	MaxBodyBytes int `json:"max_body_bytes"`
+	// Required and Forbidden are top level parameters that must or must not
+	// be in the request.
+	Required  []string `json:"required"`
+	Forbidden []string `json:"forbidden"`
+}
+
+// policyViolation is why a request was refused.
+type policyViolation struct {
+	status  int
+	errType string
+	param   string
+	code    string
+	message string
+}
+
+type policySubject struct {
+	kind  string
+	name  string
+	rules policyRules
+}
+
+// policySubjects returns the key and teams whose rules apply to a caller.
+func policySubjects(key string) []policySubject {
+	var subjects []policySubject
+	rules, ok := config.Policies.Keys[key]
+	if !ok {
+		rules, ok = config.Policies.Keys["*"]
+	}
+	if ok {
+		subjects = append(subjects, policySubject{"key", key, rules})
+	}
+	var teams []string
+	for name := range config.Policies.Teams {
+		if team, ok := config.Quotas.Teams[name]; ok && contains(team.Keys, key) {
+			teams = append(teams, name)
+		}
+	}
+	sort.Strings(teams)
+	for _, name := range teams {
+		subjects = append(subjects, policySubject{"team", name, config.Policies.Teams[name]})
+	}
+	return subjects
+}
+
+// enforcePolicy checks a request body against the caller's rules. model is
+// the model the request is to be served by, empty when it has none. It
+// writes an error and returns false when a rule is broken.
+func enforcePolicy(w http.ResponseWriter, r *http.Request, body []byte, model string) bool {
+	key := callerKeyID(r)
+	subjects := policySubjects(key)
+	if len(subjects) == 0 {
+		return true
+	}
+	// Bodies that are not JSON are left to the handler to refuse
+	var m map[string]any
+	json.Unmarshal(body, &m)
+	for _, s := range subjects {
+		v := s.rules.check(body, m, model)
+		if v == nil {
+			continue
+		}
+		if s.kind == "team" {
+			v.message += " for team " + s.name
+		} else {
+			v.message += " for this key"
+		}
+		log.Printf("Refused request of key %s: %s", key, v.message)
+		writeParamError(w, v.status, v.errType, v.param, v.code, v.message)
+		return false
+	}
+	return true
+}
+
+func (rules *policyRules) check(body []byte, m map[string]any, model string) *policyViolation {
+	invalid := func(param, format string, args ...any) *policyViolation {
+		return &policyViolation{http.StatusBadRequest, "invalid_request_error", param, "policy_violation", fmt.Sprintf(format, args...)}
+	}
+	if rules.MaxBodyBytes > 0 && len(body) > rules.MaxBodyBytes {
+		return &policyViolation{http.StatusRequestEntityTooLarge, "invalid_request_error", "", "request_too_large",
+			fmt.Sprintf("The request body is %d bytes, more than the %d allowed", len(body), rules.MaxBodyBytes)}
+	}
+	if model != "" && len(rules.Models) > 0 && !modelAllowed(rules.Models, model) {
+		return &policyViolation{http.StatusForbidden, "permission_error", "model", "model_not_allowed",
+			fmt.Sprintf("The model %s is not allowed", model)}
+	}
+	for _, name := range rules.Required {
+		if _, ok := m[name]; !ok {
+			return invalid(name, "%s is required", name)
+		}
+	}
+	for _, name := range rules.Forbidden {
+		if _, ok := m[name]; ok {
+			return invalid(name, "%s is not allowed", name)
+		}
+	}
+	if rules.MaxTokens > 0 {
+		for _, name := range []string{"max_tokens", "max_completion_tokens"} {
+			if n, ok := m[name].(float64); ok && n > float64(rules.MaxTokens) {
+				return invalid(name, "%s is %g, more than the %d allowed", name, n, rules.MaxTokens)
+			}
+		}
+	}
+	if n, ok := m["n"].(float64); ok && rules.MaxN > 0 && n > float64(rules.MaxN) {
+		return invalid("n", "n is %g, more than the %d allowed", n, rules.MaxN)
+	}
+	messages, _ := m["messages"].([]any)
+	if rules.MaxMessages > 0 && len(messages) > rules.MaxMessages {
+		return invalid("messages", "The request has %d messages, more than the %d allowed", len(messages), rules.MaxMessages)
+	}
+	if images := countImageInputs(messages); rules.MaxImages > 0 && images > rules.MaxImages {
+		return invalid("messages", "The request has %d images, more than the %d allowed", images, rules.MaxImages)
+	}
+	return nil
+}
+
+// policyAllowsModel reports whether the caller's rules allow a model, for the
+// requests the proxy makes on the caller's behalf.
+func policyAllowsModel(r *http.Request, model string) bool {
+	for _, s := range policySubjects(callerKeyID(r)) {
+		if len(s.rules.Models) > 0 && !modelAllowed(s.rules.Models, model) {
+			return false
+		}
+	}
+	return true
+}
+
+func modelAllowed(patterns []string, model string) bool {
+	for _, p := range patterns {
+		if p == model {
+			return true
+		}
+		if ok, _ := path.Match(p, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// countImageInputs counts the image content parts of the messages.
+func countImageInputs(messages []any) int {
+	n := 0
+	for _, msg := range messages {
+		m, _ := msg.(map[string]any)
+		parts, _ := m["content"].([]any)
+		for _, part := range parts {
+			if p, _ := part.(map[string]any); p["type"] == "image_url" {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// chatRequestSchema is the part of the OpenAI chat completion request schema
+// the proxy checks. Parameters it does not know are let through.
+var chatRequestSchema = mustParseSchema(`{
+	"type": "object",
+	"required": ["model", "messages"],
+	"properties": {
+		"model": {"type": "string", "minLength": 1},
+		"messages": {"type": "array", "minItems": 1, "items": {"$ref": "#/$defs/message"}},
+		"stream": {"type": ["boolean", "null"]},
+		"stream_options": {"type": ["object", "null"], "properties": {"include_usage": {"type": "boolean"}}},
+		"n": {"type": ["integer", "null"], "minimum": 1, "maximum": 128},
+		"max_tokens": {"type": ["integer", "null"], "minimum": 1},
+		"max_completion_tokens": {"type": ["integer", "null"], "minimum": 1},
+		"temperature": {"type": ["number", "null"], "minimum": 0, "maximum": 2},
+		"top_p": {"type": ["number", "null"], "minimum": 0, "maximum": 1},
+		"presence_penalty": {"type": ["number", "null"], "minimum": -2, "maximum": 2},
+		"frequency_penalty": {"type": ["number", "null"], "minimum": -2, "maximum": 2},
+		"logprobs": {"type": ["boolean", "null"]},
+		"top_logprobs": {"type": ["integer", "null"], "minimum": 0, "maximum": 20},
+		"seed": {"type": ["integer", "null"]},
+		"user": {"type": "string"},
+		"parallel_tool_calls": {"type": "boolean"},
+		"stop": {"anyOf": [
+			{"type": ["string", "null"]},
+			{"type": "array", "maxItems": 4, "items": {"type": "string"}}
+		]},
+		"tools": {"type": "array", "items": {
+			"type": "object",
+			"required": ["type", "function"],
+			"properties": {
+				"type": {"const": "function"},
+				"function": {
+					"type": "object",
+					"required": ["name"],
+					"properties": {
+						"name": {"type": "string", "pattern": "^[a-zA-Z0-9_-]{1,64}$"},
+						"description": {"type": "string"},
+						"parameters": {"type": "object"},
+						"strict": {"type": ["boolean", "null"]}
+					}
+				}
+			}
+		}},
+		"tool_choice": {"anyOf": [
+			{"enum": ["none", "auto", "required"]},
+			{"type": "object", "required": ["type", "function"], "properties": {
+				"type": {"const": "function"},
+				"function": {"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}}}
+			}}
+		]},
+		"response_format": {"type": "object", "required": ["type"], "properties": {
+			"type": {"enum": ["text", "json_object", "json_schema"]}
+		}}
+	},
+	"$defs": {
+		"message": {
+			"type": "object",
+			"required": ["role"],
+			"properties": {
+				"role": {"enum": ["system", "developer", "user", "assistant", "tool", "function"]},
+				"content": {"anyOf": [
+					{"type": ["string", "null"]},
+					{"type": "array", "items": {"$ref": "#/$defs/part"}}
+				]},
+				"name": {"type": "string"},
+				"tool_call_id": {"type": "string"},
+				"tool_calls": {"type": "array", "items": {
+					"type": "object",
+					"required": ["id", "type", "function"],
+					"properties": {
+						"id": {"type": "string"},
+						"type": {"const": "function"},
+						"function": {"type": "object", "required": ["name", "arguments"], "properties": {
+							"name": {"type": "string"},
+							"arguments": {"type": "string"}
+						}}
+					}
+				}}
+			}
+		},
+		"part": {
+			"type": "object",
+			"required": ["type"],
+			"properties": {
+				"type": {"enum": ["text", "image_url", "input_audio", "file", "refusal"]},
+				"text": {"type": "string"},
+				"image_url": {"type": "object", "required": ["url"], "properties": {"url": {"type": "string"}}}
+			}
+		}
+	}
+}`)
+
+func mustParseSchema(raw string) *jsonschema.Schema {
+	schema, err := jsonschema.Parse([]byte(raw))
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// validateChatBody checks a chat completion body against the request schema.
+// It writes an error naming the offending field and returns false when the
+// body does not conform.
+func validateChatBody(w http.ResponseWriter, body []byte) bool {
+	if config.Policies.SkipValidation {
+		return true
+	}
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON: "+err.Error())
+		return false
+	}
+	err := chatRequestSchema.Validate(value)
+	if err == nil {
+		return true
+	}
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return false
+	}
+	param := pointerParam(verr.Path)
+	if quoted, ok := strings.CutPrefix(verr.Message, "missing required property "); ok {
+		name, _ := strconv.Unquote(quoted)
+		if param != "" {
+			name = param + "." + name
+		}
+		writeParamError(w, http.StatusBadRequest, "invalid_request_error", name, "missing_required_parameter",
+			fmt.Sprintf("Missing required parameter: '%s'.", name))
+		return false
+	}
+	message := "Invalid request: " + verr.Message
+	if param != "" {
+		message = fmt.Sprintf("Invalid value for %s: %s", param, verr.Message)
+	}
+	writeParamError(w, http.StatusBadRequest, "invalid_request_error", param, "invalid_value", message)
+	return false
+}
+
+// pointerParam turns a JSON pointer into a parameter name the way OpenAI
+// reports them, such as messages[1].content.
+func pointerParam(pointer string) string {
+	var b strings.Builder
+	for _, seg := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		if seg == "" {
+			continue
+		}
+		seg = strings.ReplaceAll(strings.ReplaceAll(seg, "~1", "/"), "~0", "~")
+		if _, err := strconv.Atoi(seg); err == nil {
+			b.WriteString("[" + seg + "]")
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(seg)
+	}
+	return b.String()
+}
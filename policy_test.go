@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestModelAllowed(t *testing.T) {
+	patterns := []string{"gpt-4o", "claude-*", "o[13]-mini"}
+	for model, want := range map[string]bool{
+		"gpt-4o":          true,
+		"gpt-4o-mini":     false,
+		"claude-sonnet-4": true,
+		"o1-mini":         true,
+		"o3-mini":         true,
+		"o4-mini":         false,
+		"":                false,
+	} {
+		if got := modelAllowed(patterns, model); got != want {
+			t.Errorf("modelAllowed(%q) = %v, want %v", model, got, want)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	image := `{"role":"user","content":[{"type":"text","text":"look"},{"type":"image_url","image_url":{"url":"x"}}]}`
+	cases := []struct {
+		name   string
+		rules  policyRules
+		body   string
+		model  string
+		status int // 0 when allowed
+		param  string
+	}{
+		{"no rules", policyRules{}, `{"max_tokens":100000,"n":50}`, "gpt-4o", 0, ""},
+		{"body size", policyRules{MaxBodyBytes: 10}, `{"model":"gpt-4o"}`, "gpt-4o", http.StatusRequestEntityTooLarge, ""},
+		{"allowed model", policyRules{Models: []string{"gpt-*"}}, `{}`, "gpt-4o", 0, ""},
+		{"other model", policyRules{Models: []string{"gpt-*"}}, `{}`, "claude-sonnet-4", http.StatusForbidden, "model"},
+		{"request without a model", policyRules{Models: []string{"gpt-*"}}, `{}`, "", 0, ""},
+		{"required present", policyRules{Required: []string{"user"}}, `{"user":"u1"}`, "", 0, ""},
+		{"required missing", policyRules{Required: []string{"user"}}, `{}`, "", http.StatusBadRequest, "user"},
+		{"forbidden", policyRules{Forbidden: []string{"logprobs"}}, `{"logprobs":true}`, "", http.StatusBadRequest, "logprobs"},
+		{"max tokens", policyRules{MaxTokens: 100}, `{"max_tokens":100}`, "", 0, ""},
+		{"too many tokens", policyRules{MaxTokens: 100}, `{"max_tokens":101}`, "", http.StatusBadRequest, "max_tokens"},
+		{"too many completion tokens", policyRules{MaxTokens: 100}, `{"max_completion_tokens":200}`, "", http.StatusBadRequest, "max_completion_tokens"},
+		{"choices", policyRules{MaxN: 2}, `{"n":2}`, "", 0, ""},
+		{"too many choices", policyRules{MaxN: 2}, `{"n":3}`, "", http.StatusBadRequest, "n"},
+		{"too many messages", policyRules{MaxMessages: 1}, `{"messages":[{"role":"user"},{"role":"user"}]}`, "", http.StatusBadRequest, "messages"},
+		{"images", policyRules{MaxImages: 1}, `{"messages":[` + image + `]}`, "", 0, ""},
+		{"too many images", policyRules{MaxImages: 1}, `{"messages":[` + image + `,` + image + `]}`, "", http.StatusBadRequest, "messages"},
+	}
+	for _, c := range cases {
+		var m map[string]any
+		json.Unmarshal([]byte(c.body), &m)
+		v := c.rules.check([]byte(c.body), m, c.model)
+		switch {
+		case c.status == 0 && v != nil:
+			t.Errorf("%s: refused with %q", c.name, v.message)
+		case c.status != 0 && v == nil:
+			t.Errorf("%s: allowed", c.name)
+		case v != nil && (v.status != c.status || v.param != c.param):
+			t.Errorf("%s: refused with %d for %q, want %d for %q", c.name, v.status, v.param, c.status, c.param)
+		}
+	}
+}
+
+func TestEnforcePolicy(t *testing.T) {
+	alice, bob := callerKeyID(callerRequest("alice")), callerKeyID(callerRequest("bob"))
+	config = &Config{
+		Policies: policyConfig{
+			Keys: map[string]policyRules{
+				alice: {Models: []string{"gpt-*", "claude-*"}},
+				"*":   {MaxTokens: 1000},
+			},
+			Teams: map[string]policyRules{
+				"interns": {Models: []string{"gpt-4o-mini"}, MaxN: 1},
+			},
+		},
+		Quotas: quotaConfig{Teams: map[string]teamConfig{"interns": {Keys: []string{bob}}}},
+	}
+	defer func() { config = &Config{} }()
+
+	cases := []struct {
+		name    string
+		token   string
+		body    string
+		model   string
+		status  int
+		message string
+	}{
+		{"own rules", "alice", `{"max_tokens":5000}`, "claude-sonnet-4", http.StatusOK, ""},
+		{"own rules refuse", "alice", `{}`, "o3-mini", http.StatusForbidden, "The model o3-mini is not allowed for this key"},
+		// Keys without rules of their own get the default ones
+		{"default rules", "carol", `{"max_tokens":5000}`, "o3-mini", http.StatusBadRequest, "max_tokens is 5000, more than the 1000 allowed for this key"},
+		// Team rules apply on top of the key's
+		{"team rules", "bob", `{"max_tokens":500}`, "gpt-4o-mini", http.StatusOK, ""},
+		{"key rules of a team member", "bob", `{"max_tokens":5000}`, "gpt-4o-mini", http.StatusBadRequest, "for this key"},
+		{"team model", "bob", `{}`, "gpt-4o", http.StatusForbidden, "The model gpt-4o is not allowed for team interns"},
+		{"team choices", "bob", `{"n":2}`, "gpt-4o-mini", http.StatusBadRequest, "for team interns"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		ok := enforcePolicy(w, callerRequest(c.token), []byte(c.body), c.model)
+		if ok != (c.status == http.StatusOK) || w.Code != c.status || !strings.Contains(w.Body.String(), c.message) {
+			t.Errorf("%s: allowed %v, %d %s", c.name, ok, w.Code, w.Body.String())
+		}
+	}
+
+	if policyAllowsModel(callerRequest("bob"), "gpt-4o") || !policyAllowsModel(callerRequest("bob"), "gpt-4o-mini") {
+		t.Error("policyAllowsModel ignores team rules")
+	}
+	if !policyAllowsModel(callerRequest("carol"), "o3-mini") {
+		t.Error("policyAllowsModel refuses a key without model rules")
+	}
+}
+
+func TestValidateChatBody(t *testing.T) {
+	defer func() { config = &Config{} }()
+	cases := []struct {
+		body  string
+		param string // empty when valid
+		code  string
+	}{
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"unknown":1}`, "", ""},
+		{`{"model":"gpt-4o"}`, "messages", "missing_required_parameter"},
+		{`{"model":"gpt-4o","messages":[{"content":"hi"}]}`, "messages[0].role", "missing_required_parameter"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"temperature":3}`, "temperature", "invalid_value"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":[{"type":"image_url","image_url":{}}]}]}`, "messages[0].content", "invalid_value"},
+	}
+	for _, c := range cases {
+		config = &Config{}
+		w := httptest.NewRecorder()
+		ok := validateChatBody(w, []byte(c.body))
+		if ok != (c.param == "") {
+			t.Errorf("%s: valid %v, %s", c.body, ok, w.Body.String())
+			continue
+		}
+		if ok {
+			continue
+		}
+		var e struct {
+			Error struct {
+				Param string `json:"param"`
+				Code  string `json:"code"`
+			} `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &e)
+		if w.Code != http.StatusBadRequest || e.Error.Param != c.param || e.Error.Code != c.code {
+			t.Errorf("%s: %d %s", c.body, w.Code, w.Body.String())
+		}
+
+		// Validation can be turned off
+		config = &Config{Policies: policyConfig{SkipValidation: true}}
+		if !validateChatBody(httptest.NewRecorder(), []byte(c.body)) {
+			t.Errorf("%s: refused with skip_validation", c.body)
+		}
+	}
+}
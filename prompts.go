@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Managed prompts are system prompts kept in the config and added to chat
+// requests server side, before routing so that routing rules see them:
+// attached by key or by model, route aliases included, or asked for by
+// clients by template id with variables of their own.
+
+type promptsConfig struct {
+	// Templates are the managed prompts by id.
+	Templates map[string]promptTemplate `json:"templates"`
+	// Attach adds templates to the requests they match, in order.
+	Attach []promptAttachment `json:"attach"`
+}
+
+type promptTemplate struct {
+	// Text may refer to variables as {{name}}.
+	Text string `json:"text"`
+	// Version is recorded with every request the template is used in.
+	Version string `json:"version"`
+	// Variables are the defaults of the template's variables.
+	Variables map[string]string `json:"variables"`
+}
+
+type promptAttachment struct {
+	// Prompt is the id of the template.
+	Prompt string `json:"prompt"`
+	// Mode is prepend (the default), append or replace, see
+	// promptInjection.inject.
+	Mode string `json:"mode"`
+	// Keys and Models restrict the attachment to callers with these key ids
+	// and to requests for these models, exact or as globs, as the client
+	// named them, so a route is matched by its alias. Empty matches all.
+	Keys   []string `json:"keys"`
+	Models []string `json:"models"`
+	// Variables are given to the template.
+	Variables map[string]string `json:"variables"`
+}
+
+// clientPromptTemplate is the prompt_template parameter by which clients ask
+// for a template. It is not forwarded upstream.
+type clientPromptTemplate struct {
+	ID        string            `json:"id"`
+	Variables map[string]string `json:"variables"`
+}
+
+var promptVariable = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// renderPrompt substitutes the variables of a template. vars are looked up in
+// order, then in the template's defaults. It returns the names of variables
+// without a value, which are left empty.
+func renderPrompt(t promptTemplate, vars ...map[string]string) (string, []string) {
+	vars = append(vars, t.Variables)
+	var missing []string
+	text := promptVariable.ReplaceAllStringFunc(t.Text, func(ref string) string {
+		name := promptVariable.FindStringSubmatch(ref)[1]
+		for _, v := range vars {
+			if value, ok := v[name]; ok {
+				return value
+			}
+		}
+		if !contains(missing, name) {
+			missing = append(missing, name)
+		}
+		return ""
+	})
+	return text, missing
+}
+
+// promptLabel names a template and its version for logs.
+func promptLabel(id string, t promptTemplate) string {
+	if t.Version == "" {
+		return id
+	}
+	return id + "@" + t.Version
+}
+
+// builtinPromptVariables are the variables every template can use.
+func builtinPromptVariables(r *http.Request, model string) map[string]string {
+	key := callerKeyID(r)
+	return map[string]string{
+		"key":   key,
+		"team":  callerTeam(key),
+		"model": model,
+		"date":  time.Now().UTC().Format(time.DateOnly),
+	}
+}
+
+// promptInjection adds managed prompts to the messages of a chat body, as
+// system messages among those the conversation starts with. It keeps count of
+// the ones it put before and after the client's own.
+type promptInjection struct {
+	body        map[string]any
+	front, back int
+}
+
+// inject adds a prompt. prepend puts it before all messages, append after the
+// system and developer messages the conversation starts with, and replace puts
+// it in place of those of the client.
+func (p *promptInjection) inject(text, mode string) {
+	messages, _ := p.body["messages"].([]any)
+	lead := 0
+	for lead < len(messages) {
+		m, _ := messages[lead].(map[string]any)
+		if role := m["role"]; role != "system" && role != "developer" {
+			break
+		}
+		lead++
+	}
+	prompt := map[string]any{"role": "system", "content": text}
+	var out []any
+	switch mode {
+	case "append":
+		out = append(append(append(out, messages[:lead]...), prompt), messages[lead:]...)
+		p.back++
+	case "replace":
+		out = append(append(append(out, messages[:p.front]...), prompt), messages[lead-p.back:]...)
+		p.front++
+	default:
+		out = append(append(out, prompt), messages...)
+		p.front++
+	}
+	p.body["messages"] = out
+}
+
+// applyPrompts adds the managed prompts of a chat request: the template the
+// client asked for, then the attached ones. It returns the new body and the
+// labels of the templates used, or writes an error and returns false when
+// the client's template cannot be used.
+func applyPrompts(w http.ResponseWriter, r *http.Request, body []byte) ([]byte, []string, bool) {
+	var m map[string]any
+	if json.Unmarshal(body, &m) != nil {
+		return body, nil, true
+	}
+	_, asked := m["prompt_template"]
+	if !asked && len(config.Prompts.Attach) == 0 {
+		return body, nil, true
+	}
+	model, _ := m["model"].(string)
+	builtins := builtinPromptVariables(r, model)
+	injection := &promptInjection{body: m}
+	var labels []string
+
+	if asked {
+		var ref clientPromptTemplate
+		raw, _ := json.Marshal(m["prompt_template"])
+		if json.Unmarshal(raw, &ref) != nil || ref.ID == "" {
+			writeParamError(w, http.StatusBadRequest, "invalid_request_error", "prompt_template", "invalid_value",
+				"prompt_template must be an object with an id and optional variables")
+			return nil, nil, false
+		}
+		t, ok := config.Prompts.Templates[ref.ID]
+		if !ok {
+			writeParamError(w, http.StatusBadRequest, "invalid_request_error", "prompt_template.id", "invalid_value",
+				fmt.Sprintf("Unknown prompt template %q", ref.ID))
+			return nil, nil, false
+		}
+		text, missing := renderPrompt(t, ref.Variables, builtins)
+		if len(missing) > 0 {
+			writeParamError(w, http.StatusBadRequest, "invalid_request_error", "prompt_template.variables."+missing[0], "missing_required_parameter",
+				fmt.Sprintf("Prompt template %q needs the variables %s", ref.ID, strings.Join(missing, ", ")))
+			return nil, nil, false
+		}
+		delete(m, "prompt_template")
+		injection.inject(text, "prepend")
+		labels = append(labels, promptLabel(ref.ID, t))
+	}
+
+	key := callerKeyID(r)
+	for _, a := range config.Prompts.Attach {
+		if len(a.Keys) > 0 && !contains(a.Keys, key) {
+			continue
+		}
+		if len(a.Models) > 0 && !modelAllowed(a.Models, model) {
+			continue
+		}
+		t, ok := config.Prompts.Templates[a.Prompt]
+		if !ok {
+			log.Printf("Ignoring attachment of unknown prompt template %q", a.Prompt)
+			continue
+		}
+		text, missing := renderPrompt(t, a.Variables, builtins)
+		if len(missing) > 0 {
+			log.Printf("Prompt template %s has no value for %s", a.Prompt, strings.Join(missing, ", "))
+		}
+		injection.inject(text, a.Mode)
+		labels = append(labels, promptLabel(a.Prompt, t))
+	}
+	newBody, err := json.Marshal(m)
+	if err != nil {
+		return body, nil, true
+	}
+	return newBody, labels, true
+}
+
+// recordPrompts reports the managed prompts used for a request in the
+// X-Copilot-Proxy-Prompts header, the log and the ledger.
+func recordPrompts(w http.ResponseWriter, r *http.Request, labels []string) {
+	if len(labels) == 0 {
+		return
+	}
+	w.Header().Set("X-Copilot-Proxy-Prompts", strings.Join(labels, ","))
+	log.Printf("Added prompts %s", strings.Join(labels, ", "))
+	if rec := requestLedgerRecord(r); rec != nil {
+		rec.addPrompts(labels)
+	}
+}
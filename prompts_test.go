@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRenderPrompt(t *testing.T) {
+	tmpl := promptTemplate{Text: "You help {{team}} with {{ topic }}. Be {{tone}}.", Variables: map[string]string{"tone": "brief", "topic": "Go"}}
+	cases := []struct {
+		vars    []map[string]string
+		want    string
+		missing []string
+	}{
+		{[]map[string]string{{"team": "infra"}}, "You help infra with Go. Be brief.", nil},
+		// Earlier variables win over later ones and over the defaults
+		{[]map[string]string{{"team": "infra", "tone": "formal"}, {"team": "web", "topic": "Rust"}}, "You help infra with Rust. Be formal.", nil},
+		{[]map[string]string{{"tone": ""}}, "You help  with Go. Be .", []string{"team"}},
+		{nil, "You help  with Go. Be brief.", []string{"team"}},
+	}
+	for _, c := range cases {
+		got, missing := renderPrompt(tmpl, c.vars...)
+		if got != c.want || !reflect.DeepEqual(missing, c.missing) {
+			t.Errorf("vars %v: %q missing %v, want %q missing %v", c.vars, got, missing, c.want, c.missing)
+		}
+	}
+}
+
+// promptMessages returns the messages of a chat body as role:content.
+func promptMessages(body map[string]any) []string {
+	var out []string
+	for _, msg := range body["messages"].([]any) {
+		m := msg.(map[string]any)
+		out = append(out, m["role"].(string)+":"+m["content"].(string))
+	}
+	return out
+}
+
+func TestPromptInjection(t *testing.T) {
+	cases := []struct {
+		modes []string
+		want  []string
+	}{
+		{[]string{"prepend"}, []string{"system:P0", "system:client", "user:hi"}},
+		{[]string{""}, []string{"system:P0", "system:client", "user:hi"}},
+		{[]string{"append"}, []string{"system:client", "system:P0", "user:hi"}},
+		{[]string{"replace"}, []string{"system:P0", "user:hi"}},
+		{[]string{"prepend", "append"}, []string{"system:P0", "system:client", "system:P1", "user:hi"}},
+		// Replacing drops only the client's messages, not managed ones
+		{[]string{"prepend", "append", "replace"}, []string{"system:P0", "system:P2", "system:P1", "user:hi"}},
+		{[]string{"replace", "replace"}, []string{"system:P0", "system:P1", "user:hi"}},
+	}
+	for _, c := range cases {
+		var body map[string]any
+		json.Unmarshal([]byte(`{"messages":[{"role":"system","content":"client"},{"role":"user","content":"hi"}]}`), &body)
+		p := &promptInjection{body: body}
+		for i, mode := range c.modes {
+			p.inject("P"+string(rune('0'+i)), mode)
+		}
+		if got := promptMessages(body); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: %v, want %v", c.modes, got, c.want)
+		}
+	}
+}
+
+func TestApplyPrompts(t *testing.T) {
+	config = &Config{Prompts: promptsConfig{
+		Templates: map[string]promptTemplate{
+			"review": {Text: "Review {{language}} code for {{key}}.", Version: "3"},
+			"house":  {Text: "Follow the house style of {{model}}."},
+			"mini":   {Text: "Keep it short."},
+		},
+		Attach: []promptAttachment{
+			{Prompt: "house", Mode: "append"},
+			{Prompt: "mini", Models: []string{"fast", "*-mini"}},
+			{Prompt: "mini", Keys: []string{callerKeyID(callerRequest("vip"))}, Mode: "replace"},
+			{Prompt: "missing"},
+		},
+	}}
+	defer func() { config = &Config{} }()
+	key := callerKeyID(callerRequest("a"))
+
+	cases := []struct {
+		name     string
+		token    string
+		body     string
+		messages []string
+		labels   []string
+		param    string // of the error, if the request is refused
+	}{
+		{"attached", "a", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`,
+			[]string{"system:Follow the house style of gpt-4o.", "user:hi"}, []string{"house"}, ""},
+		{"attached by alias", "a", `{"model":"fast","messages":[{"role":"user","content":"hi"}]}`,
+			[]string{"system:Keep it short.", "system:Follow the house style of fast.", "user:hi"}, []string{"house", "mini"}, ""},
+		{"attached by key", "vip", `{"model":"gpt-4o","messages":[{"role":"system","content":"mine"},{"role":"user","content":"hi"}]}`,
+			[]string{"system:Keep it short.", "system:Follow the house style of gpt-4o.", "user:hi"}, []string{"house", "mini"}, ""},
+		{"asked for", "a", `{"model":"gpt-4o","prompt_template":{"id":"review","variables":{"language":"Go"}},"messages":[{"role":"user","content":"hi"}]}`,
+			[]string{"system:Review Go code for " + key + ".", "system:Follow the house style of gpt-4o.", "user:hi"}, []string{"review@3", "house"}, ""},
+		{"unknown template", "a", `{"model":"gpt-4o","prompt_template":{"id":"nope"},"messages":[]}`, nil, nil, "prompt_template.id"},
+		{"missing variable", "a", `{"model":"gpt-4o","prompt_template":{"id":"review"},"messages":[]}`, nil, nil, "prompt_template.variables.language"},
+		{"no id", "a", `{"model":"gpt-4o","prompt_template":"review","messages":[]}`, nil, nil, "prompt_template"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		body, labels, ok := applyPrompts(w, callerRequest(c.token), []byte(c.body))
+		if c.param != "" {
+			var e struct {
+				Error struct {
+					Param string `json:"param"`
+				} `json:"error"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &e)
+			if ok || w.Code != http.StatusBadRequest || e.Error.Param != c.param {
+				t.Errorf("%s: ok %v, %d %s", c.name, ok, w.Code, w.Body.String())
+			}
+			continue
+		}
+		var m map[string]any
+		if !ok || json.Unmarshal(body, &m) != nil {
+			t.Errorf("%s: ok %v, body %s", c.name, ok, body)
+			continue
+		}
+		if _, ok := m["prompt_template"]; ok {
+			t.Errorf("%s: prompt_template forwarded", c.name)
+		}
+		if got := promptMessages(m); !reflect.DeepEqual(got, c.messages) || !reflect.DeepEqual(labels, c.labels) {
+			t.Errorf("%s: %q with %v, want %q with %v", c.name, got, labels, c.messages, c.labels)
+		}
+	}
+
+	// Requests are left alone when nothing applies
+	config = &Config{}
+	body := `{"model":"gpt-4o", "messages":[]}`
+	if got, labels, ok := applyPrompts(httptest.NewRecorder(), callerRequest("a"), []byte(body)); !ok || string(got) != body || labels != nil {
+		t.Errorf("body without prompts became %s, %v", got, labels)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quotas are budgets of tokens or premium requests that a key, or a team of
+// keys, may spend per day or per month. Consumption is taken from the usage of
+// each response. Past the soft limit responses carry a warning header and the
+// webhook is told; at the hard limit requests are rejected until the budget
+// resets.
+
+const defaultSoftLimit = 0.8
+
+// webhookClient sends the quota notifications. A webhook that does not answer
+// in time is given up on.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type quotaConfig struct {
+	// Keys lists the budgets of callers by key id. "*" applies to every key
+	// without budgets of its own.
+	Keys map[string][]budget `json:"keys"`
+	// Teams groups keys under shared budgets, by team name.
+	Teams map[string]teamConfig `json:"teams"`
+
+	// SoftLimit is the fraction of a budget past which callers are warned.
+	// Defaults to 0.8.
+	SoftLimit float64 `json:"soft_limit"`
+	// Webhook is a URL notified when a budget passes its soft or hard limit.
+	Webhook string `json:"webhook"`
+	// PremiumMultipliers is the number of premium requests a request costs,
+	// by model name prefix. Unlisted models cost 1.
+	PremiumMultipliers map[string]float64 `json:"premium_multipliers"`
+
+	// Budgets reset at ResetHour (0-23) in Timezone (default UTC), every day
+	// for daily budgets and on ResetDay (1-28, default 1) for monthly ones.
+	ResetHour int    `json:"reset_hour"`
+	ResetDay  int    `json:"reset_day"`
+	Timezone  string `json:"timezone"`
+
+	// StateFile keeps consumption across restarts.
+	StateFile string `json:"state_file"`
+}
+
+type teamConfig struct {
+	Keys    []string `json:"keys"`
+	Budgets []budget `json:"budgets"`
+}
+
+// budget is what may be spent per period: "daily" or "monthly". 0 means no
+// limit.
+type budget struct {
+	Period          string  `json:"period"`
+	Tokens          int64   `json:"tokens"`
+	PremiumRequests float64 `json:"premium_requests"`
+}
+
+// quotaUsage is what a key or team has spent in the current period.
+type quotaUsage struct {
+	Start           time.Time `json:"start"`
+	Tokens          int64     `json:"tokens"`
+	PremiumRequests float64   `json:"premium_requests"`
+	// Notified records the limits the webhook has been told about.
+	Notified map[string]bool `json:"notified,omitempty"`
+}
+
+// quotaSubject is a key or team with budgets.
+type quotaSubject struct {
+	Scope   string // "key" or "team"
+	Name    string
+	Budgets []budget
+}
+
+func (s *quotaSubject) id(period string) string {
+	return s.Scope + ":" + s.Name + "/" + period
+}
+
+type quotaTracker struct {
+	mu     sync.Mutex
+	config *Config // the config the state was loaded for
+	usage  map[string]*quotaUsage
+}
+
+var quotas = &quotaTracker{}
+
+func quotasEnabled() bool {
+	return len(config.Quotas.Keys) > 0 || len(config.Quotas.Teams) > 0
+}
+
+// quotaSubjects returns the key and teams whose budgets apply to a caller.
+func quotaSubjects(key string) []quotaSubject {
+	var subjects []quotaSubject
+	budgets, ok := config.Quotas.Keys[key]
+	if !ok {
+		budgets = config.Quotas.Keys["*"]
+	}
+	if len(budgets) > 0 {
+		subjects = append(subjects, quotaSubject{"key", key, budgets})
+	}
+	for name, team := range config.Quotas.Teams {
+		if contains(team.Keys, key) && len(team.Budgets) > 0 {
+			subjects = append(subjects, quotaSubject{"team", name, team.Budgets})
+		}
+	}
+	return subjects
+}
+
+func quotaLocation() *time.Location {
+	if tz := config.Quotas.Timezone; tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			return loc
+		}
+		log.Printf("Unknown quota timezone %q, using UTC", tz)
+	}
+	return time.UTC
+}
+
+// periodBounds returns when the current period started and when it ends.
+func periodBounds(period string, now time.Time) (time.Time, time.Time) {
+	loc := quotaLocation()
+	now = now.In(loc)
+	hour := config.Quotas.ResetHour
+	if period == "monthly" {
+		day := config.Quotas.ResetDay
+		if day < 1 || day > 28 {
+			day = 1
+		}
+		start := time.Date(now.Year(), now.Month(), day, hour, 0, 0, 0, loc)
+		if start.After(now) {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, loc)
+	if start.After(now) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start, start.AddDate(0, 0, 1)
+}
+
+// premiumRequests returns the premium requests a request to model costs.
+func premiumRequests(model string) float64 {
+	if model == "" {
+		return 0
+	}
+	cost, bestLen := 1.0, -1
+	for prefix, m := range config.Quotas.PremiumMultipliers {
+		if strings.HasPrefix(model, prefix) && len(prefix) > bestLen {
+			cost, bestLen = m, len(prefix)
+		}
+	}
+	return cost
+}
+
+// current returns the consumption of a subject in the current period, which
+// starts afresh when the period has rolled over. Callers hold q.mu.
+func (q *quotaTracker) current(s *quotaSubject, period string, now time.Time) *quotaUsage {
+	if q.config != config {
+		q.load()
+	}
+	start, _ := periodBounds(period, now)
+	u := q.usage[s.id(period)]
+	if u == nil || !u.Start.Equal(start) {
+		u = &quotaUsage{Start: start}
+		q.usage[s.id(period)] = u
+	}
+	return u
+}
+
+func (q *quotaTracker) load() {
+	q.config = config
+	q.usage = make(map[string]*quotaUsage)
+	path := config.Quotas.StateFile
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read quota state: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &q.usage); err != nil {
+		log.Printf("Failed to read quota state: %v", err)
+		q.usage = make(map[string]*quotaUsage)
+	}
+}
+
+// save writes the state file. Callers hold q.mu.
+func (q *quotaTracker) save() {
+	path := config.Quotas.StateFile
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(q.usage)
+	if err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("Failed to write quota state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("Failed to write quota state: %v", err)
+	}
+}
+
+// quotaLimit is one limit of a budget with what has been spent against it.
+type quotaLimit struct {
+	Scope     string    `json:"scope"`
+	Name      string    `json:"name"`
+	Period    string    `json:"period"`
+	Metric    string    `json:"metric"` // "tokens" or "premium_requests"
+	Limit     float64   `json:"limit"`
+	Used      float64   `json:"used"`
+	Remaining float64   `json:"remaining"`
+	SoftLimit bool      `json:"soft_limit_reached"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+func (l *quotaLimit) exhausted() bool {
+	return l.Used >= l.Limit
+}
+
+func (l *quotaLimit) describe() string {
+	metric := "token"
+	if l.Metric == "premium_requests" {
+		metric = "premium request"
+	}
+	return fmt.Sprintf("%s %s budget of %s %s", l.Period, metric, l.Scope, l.Name)
+}
+
+// limits returns every limit that applies to the caller. Callers hold q.mu.
+func (q *quotaTracker) limits(key string, now time.Time) []quotaLimit {
+	soft := config.Quotas.SoftLimit
+	if soft <= 0 {
+		soft = defaultSoftLimit
+	}
+	var out []quotaLimit
+	for _, s := range quotaSubjects(key) {
+		for _, b := range s.Budgets {
+			u := q.current(&s, b.Period, now)
+			_, end := periodBounds(b.Period, now)
+			add := func(metric string, limit, used float64) {
+				if limit <= 0 {
+					return
+				}
+				out = append(out, quotaLimit{
+					Scope: s.Scope, Name: s.Name, Period: b.Period, Metric: metric,
+					Limit: limit, Used: used, Remaining: math.Max(limit-used, 0),
+					SoftLimit: used >= soft*limit, ResetsAt: end,
+				})
+			}
+			add("tokens", float64(b.Tokens), float64(u.Tokens))
+			add("premium_requests", b.PremiumRequests, u.PremiumRequests)
+		}
+	}
+	return out
+}
+
+// admit rejects the request if one of the caller's budgets is exhausted, and
+// warns through response headers about those past their soft limit.
+func (q *quotaTracker) admit(w http.ResponseWriter, r *http.Request) bool {
+	if !quotasEnabled() {
+		return true
+	}
+	key := callerKeyID(r)
+	q.mu.Lock()
+	limits := q.limits(key, time.Now())
+	q.mu.Unlock()
+	for i := range limits {
+		l := &limits[i]
+		if l.exhausted() {
+			log.Printf("429: Key %s exhausted the %s", key, l.describe())
+			retry := time.Until(l.ResetsAt)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(unstream.OAIErrorResponse{
+				Error: unstream.OAIError{
+					Message: fmt.Sprintf("The %s is exhausted (%g of %g used). It resets at %s.", l.describe(), l.Used, l.Limit, l.ResetsAt.Format(time.RFC3339)),
+					Type:    "insufficient_quota",
+					Code:    "insufficient_quota",
+				},
+			})
+			return false
+		}
+		if l.SoftLimit {
+			w.Header().Add("X-Copilot-Proxy-Quota-Warning", fmt.Sprintf("%s %s %s %s: %g of %g used", l.Scope, l.Name, l.Period, l.Metric, l.Used, l.Limit))
+		}
+	}
+	return true
+}
+
+// consume records the tokens of a response and the premium requests it cost
+// against the caller's budgets.
+func (q *quotaTracker) consume(r *http.Request, usage *unstream.OAIUsage, premium float64) {
+	if !quotasEnabled() {
+		return
+	}
+	var tokens int64
+	if usage != nil {
+		tokens = int64(usage.PromptTokens + usage.CompletionTokens)
+	}
+	if tokens == 0 && premium == 0 {
+		return
+	}
+	key := callerKeyID(r)
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, s := range quotaSubjects(key) {
+		seen := make(map[string]bool)
+		for _, b := range s.Budgets {
+			if seen[b.Period] {
+				continue
+			}
+			seen[b.Period] = true
+			u := q.current(&s, b.Period, now)
+			u.Tokens += tokens
+			u.PremiumRequests += premium
+		}
+	}
+	for _, l := range q.limits(key, now) {
+		q.notify(&l, now)
+	}
+	q.save()
+}
+
+// notify tells the webhook, once per period, that a limit has been passed.
+// Callers hold q.mu.
+func (q *quotaTracker) notify(l *quotaLimit, now time.Time) {
+	event := ""
+	switch {
+	case l.exhausted():
+		event = "hard_limit"
+	case l.SoftLimit:
+		event = "soft_limit"
+	default:
+		return
+	}
+	s := quotaSubject{Scope: l.Scope, Name: l.Name}
+	u := q.current(&s, l.Period, now)
+	mark := l.Metric + ":" + event
+	if u.Notified[mark] {
+		return
+	}
+	if u.Notified == nil {
+		u.Notified = make(map[string]bool)
+	}
+	u.Notified[mark] = true
+	log.Printf("Quota %s reached for the %s (%g of %g used)", strings.ReplaceAll(event, "_", " "), l.describe(), l.Used, l.Limit)
+	url := config.Quotas.Webhook
+	if url == "" {
+		return
+	}
+	payload, _ := json.Marshal(map[string]any{"event": event, "quota": l})
+	go func() {
+		resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Printf("Quota webhook failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			log.Printf("Quota webhook failed with status %d", resp.StatusCode)
+		}
+	}()
+}
+
+// handleQuota serves /v1/quota: the caller's budgets and what is left of them.
+func handleQuota(w http.ResponseWriter, r *http.Request) {
+	if _, ok := copilotToken(w, r); !ok {
+		return
+	}
+	key := callerKeyID(r)
+	limits := []quotaLimit{}
+	if quotasEnabled() {
+		quotas.mu.Lock()
+		limits = append(limits, quotas.limits(key, time.Now())...)
+		quotas.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"key": key, "quotas": limits})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeriodBounds(t *testing.T) {
+	defer func() { config = &Config{} }()
+	date := func(month time.Month, day, hour int) time.Time {
+		return time.Date(2026, month, day, hour, 0, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		quotas     quotaConfig
+		period     string
+		now        time.Time
+		start, end time.Time
+	}{
+		{quotaConfig{}, "daily", date(3, 10, 15), date(3, 10, 0), date(3, 11, 0)},
+		{quotaConfig{ResetHour: 6}, "daily", date(3, 10, 5), date(3, 9, 6), date(3, 10, 6)},
+		{quotaConfig{ResetHour: 6}, "daily", date(3, 10, 6), date(3, 10, 6), date(3, 11, 6)},
+		{quotaConfig{ResetHour: 6}, "daily", date(3, 1, 2), date(2, 28, 6), date(3, 1, 6)},
+		{quotaConfig{}, "monthly", date(3, 10, 15), date(3, 1, 0), date(4, 1, 0)},
+		{quotaConfig{ResetDay: 15}, "monthly", date(3, 14, 23), date(2, 15, 0), date(3, 15, 0)},
+		{quotaConfig{ResetDay: 15}, "monthly", date(3, 15, 0), date(3, 15, 0), date(4, 15, 0)},
+		{quotaConfig{ResetDay: 31}, "monthly", date(3, 10, 0), date(3, 1, 0), date(4, 1, 0)},
+		{quotaConfig{}, "monthly", date(1, 1, 0).Add(-time.Hour), time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC), date(1, 1, 0)},
+		// Midnight in Tokyo is 15:00 UTC the day before
+		{quotaConfig{Timezone: "Asia/Tokyo"}, "daily", date(3, 10, 14), date(3, 9, 15), date(3, 10, 15)},
+		{quotaConfig{Timezone: "Asia/Tokyo"}, "daily", date(3, 10, 15), date(3, 10, 15), date(3, 11, 15)},
+	}
+	for _, c := range cases {
+		config = &Config{Quotas: c.quotas}
+		start, end := periodBounds(c.period, c.now)
+		if !start.Equal(c.start) || !end.Equal(c.end) {
+			t.Errorf("%+v %s at %v: %v to %v, want %v to %v", c.quotas, c.period, c.now, start, end, c.start, c.end)
+		}
+	}
+}
+
+func TestQuotaRollover(t *testing.T) {
+	config = &Config{Quotas: quotaConfig{Keys: map[string][]budget{
+		"*": {{Period: "daily", Tokens: 1000}, {Period: "monthly", PremiumRequests: 50}},
+	}}}
+	defer func() { config = &Config{} }()
+	q := &quotaTracker{}
+	key := callerKeyID(callerRequest("a"))
+	s := quotaSubjects(key)[0]
+	now := time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC)
+	q.current(&s, "daily", now).Tokens = 900
+	q.current(&s, "monthly", now).PremiumRequests = 40
+
+	used := func(now time.Time) map[string]float64 {
+		out := make(map[string]float64)
+		for _, l := range q.limits(key, now) {
+			out[l.Period+" "+l.Metric] = l.Used
+		}
+		return out
+	}
+	cases := []struct {
+		now             time.Time
+		tokens, premium float64
+	}{
+		{now.Add(59 * time.Minute), 900, 40},
+		// A new day and a new month
+		{now.Add(time.Hour), 0, 0},
+	}
+	for _, c := range cases {
+		got := used(c.now)
+		if got["daily tokens"] != c.tokens || got["monthly premium_requests"] != c.premium {
+			t.Errorf("at %v: used %v, want %v tokens and %v premium requests", c.now, got, c.tokens, c.premium)
+		}
+	}
+}
+
+func TestQuotaThresholds(t *testing.T) {
+	defer func() { config = &Config{} }()
+	cases := []struct {
+		budget   budget
+		soft     float64
+		tokens   int
+		premium  float64
+		status   int
+		warning  bool
+		notified string
+	}{
+		{budget{Period: "daily", Tokens: 1000}, 0, 799, 0, http.StatusOK, false, ""},
+		{budget{Period: "daily", Tokens: 1000}, 0, 800, 0, http.StatusOK, true, "tokens:soft_limit"},
+		{budget{Period: "daily", Tokens: 1000}, 0.5, 500, 0, http.StatusOK, true, "tokens:soft_limit"},
+		{budget{Period: "daily", Tokens: 1000}, 0, 999, 0, http.StatusOK, true, "tokens:soft_limit"},
+		{budget{Period: "daily", Tokens: 1000}, 0, 1000, 0, http.StatusTooManyRequests, false, "tokens:hard_limit"},
+		{budget{Period: "monthly", PremiumRequests: 10}, 0, 0, 8, http.StatusOK, true, "premium_requests:soft_limit"},
+		{budget{Period: "monthly", PremiumRequests: 10}, 0, 5000, 10, http.StatusTooManyRequests, false, "premium_requests:hard_limit"},
+	}
+	for i, c := range cases {
+		config = &Config{Quotas: quotaConfig{Keys: map[string][]budget{"*": {c.budget}}, SoftLimit: c.soft}}
+		q := &quotaTracker{}
+		r := callerRequest("a")
+		q.consume(r, &unstream.OAIUsage{PromptTokens: c.tokens}, c.premium)
+		w := httptest.NewRecorder()
+		ok := q.admit(w, r)
+		if ok != (c.status == http.StatusOK) || w.Code != c.status {
+			t.Errorf("case %d: admitted %v with status %d, want %d", i, ok, w.Code, c.status)
+		}
+		if warning := w.Header().Get("X-Copilot-Proxy-Quota-Warning") != ""; warning != c.warning {
+			t.Errorf("case %d: warning %q", i, w.Header().Get("X-Copilot-Proxy-Quota-Warning"))
+		}
+		if c.status == http.StatusTooManyRequests {
+			if w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "insufficient_quota") {
+				t.Errorf("case %d: rejected with %v %s", i, w.Header(), w.Body)
+			}
+		}
+		var notified []string
+		for _, u := range q.usage {
+			for mark := range u.Notified {
+				notified = append(notified, mark)
+			}
+		}
+		if got := strings.Join(notified, ","); got != c.notified {
+			t.Errorf("case %d: notified %q, want %q", i, got, c.notified)
+		}
+	}
+}
+
+func TestQuotaWebhookTimeout(t *testing.T) {
+	gaveUp := make(chan bool, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client left once the body is read
+		io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			gaveUp <- true
+		case <-time.After(5 * time.Second):
+			gaveUp <- false
+		}
+	}))
+	defer hook.Close()
+	timeout := webhookClient.Timeout
+	webhookClient.Timeout = 50 * time.Millisecond
+	defer func() { webhookClient.Timeout = timeout }()
+	config = &Config{Quotas: quotaConfig{Webhook: hook.URL}}
+	defer func() { config = &Config{} }()
+
+	q := &quotaTracker{}
+	q.notify(&quotaLimit{Scope: "key", Name: "k", Period: "daily", Metric: "tokens", Limit: 10, Used: 10}, time.Now())
+	if !<-gaveUp {
+		t.Error("the webhook request did not time out")
+	}
+}
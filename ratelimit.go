@@ -0,0 +1,254 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limiting keeps one caller from exhausting the Copilot rate limit of the
+// whole seat. Every caller key gets token buckets that refill continuously over
+// a minute: one for requests, and one each for prompt and completion tokens.
+// Token counts are only known once a response has been seen, so they are
+// charged after the fact and a caller is turned away while its balance is
+// negative. Concurrent streams are counted separately. Callers whose buckets
+// have refilled are forgotten, since a full bucket is no different from a new
+// one.
+
+// rateLimits are the limits of one caller. 0 means no limit.
+type rateLimits struct {
+	RequestsPerMinute         int `json:"requests_per_minute"`
+	ConcurrentStreams         int `json:"concurrent_streams"`
+	PromptTokensPerMinute     int `json:"prompt_tokens_per_minute"`
+	CompletionTokensPerMinute int `json:"completion_tokens_per_minute"`
+}
+
+type rateLimitConfig struct {
+	// The default limits of every caller.
+	rateLimits
+	// Keys overrides the limits of callers by key id.
+	Keys map[string]rateLimits `json:"keys"`
+}
+
+func (l *rateLimits) unlimited() bool {
+	return *l == rateLimits{}
+}
+
+func rateLimitsFor(key string) rateLimits {
+	if l, ok := config.RateLimits.Keys[key]; ok {
+		return l
+	}
+	return config.RateLimits.rateLimits
+}
+
+// tokenBucket holds up to a minute's worth of tokens and refills at the
+// per-minute rate. Its level goes negative when usage is charged beyond it.
+type tokenBucket struct {
+	level   float64
+	updated time.Time
+	started bool
+}
+
+// refill brings the bucket up to date for a limit per minute.
+func (b *tokenBucket) refill(limit int, now time.Time) {
+	if !b.started {
+		b.level, b.updated, b.started = float64(limit), now, true
+		return
+	}
+	b.level = math.Min(float64(limit), b.level+now.Sub(b.updated).Minutes()*float64(limit))
+	b.updated = now
+}
+
+// full reports whether the bucket has refilled by now.
+func (b *tokenBucket) full(limit int, now time.Time) bool {
+	return !b.started || limit == 0 || b.level+now.Sub(b.updated).Minutes()*float64(limit) >= float64(limit)
+}
+
+// wait returns how long until the bucket holds n tokens.
+func (b *tokenBucket) wait(limit int, n float64) time.Duration {
+	if b.level >= n {
+		return 0
+	}
+	return time.Duration((n - b.level) / float64(limit) * float64(time.Minute))
+}
+
+// keyLimiter is the state of one caller.
+type keyLimiter struct {
+	requests, prompt, completion tokenBucket
+	streams                      int
+}
+
+// idle reports whether a caller's state can be forgotten: it has no open
+// stream and all its buckets have refilled.
+func (kl *keyLimiter) idle(limits *rateLimits, now time.Time) bool {
+	return kl.streams == 0 &&
+		kl.requests.full(limits.RequestsPerMinute, now) &&
+		kl.prompt.full(limits.PromptTokensPerMinute, now) &&
+		kl.completion.full(limits.CompletionTokensPerMinute, now)
+}
+
+// limiterSweepInterval is how often idle callers are looked for.
+const limiterSweepInterval = time.Minute
+
+type rateLimiter struct {
+	mu    sync.Mutex
+	keys  map[string]*keyLimiter
+	swept time.Time
+}
+
+var limiter = &rateLimiter{keys: make(map[string]*keyLimiter)}
+
+// admit takes a request from the caller's budget, or answers with a 429 and
+// returns false. The returned function must be called once the request is
+// done to release its stream slot.
+func (rl *rateLimiter) admit(w http.ResponseWriter, r *http.Request, stream bool) (func(), bool) {
+	return rl.admitRequests(w, r, stream, 1)
+}
+
+// admitRequests is admit for a request that is sent upstream as n requests,
+// or as n streams when stream is set. Like tokens, the requests may take the
+// budget below zero.
+func (rl *rateLimiter) admitRequests(w http.ResponseWriter, r *http.Request, stream bool, n int) (func(), bool) {
+	key := callerKeyID(r)
+	limits := rateLimitsFor(key)
+	if limits.unlimited() {
+		return func() {}, true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	rl.sweep(now)
+	kl := rl.get(key)
+	kl.requests.refill(limits.RequestsPerMinute, now)
+	kl.prompt.refill(limits.PromptTokensPerMinute, now)
+	kl.completion.refill(limits.CompletionTokensPerMinute, now)
+
+	var (
+		kind, limitName string
+		limit           int
+		retry           time.Duration
+	)
+	switch {
+	case limits.RequestsPerMinute > 0 && kl.requests.level < 1:
+		kind, limitName, limit = "requests", "requests per minute", limits.RequestsPerMinute
+		retry = kl.requests.wait(limit, 1)
+	case limits.PromptTokensPerMinute > 0 && kl.prompt.level < 1:
+		kind, limitName, limit = "tokens", "prompt tokens per minute", limits.PromptTokensPerMinute
+		retry = kl.prompt.wait(limit, 1)
+	case limits.CompletionTokensPerMinute > 0 && kl.completion.level < 1:
+		kind, limitName, limit = "tokens", "completion tokens per minute", limits.CompletionTokensPerMinute
+		retry = kl.completion.wait(limit, 1)
+	case stream && limits.ConcurrentStreams > 0 && kl.streams+n > limits.ConcurrentStreams:
+		// Streams have no refill rate; suggest trying again shortly
+		kind, limitName, limit = "requests", "concurrent streams", limits.ConcurrentStreams
+		retry = time.Second
+	}
+	setRateLimitHeaders(w, kl, &limits)
+	if kind != "" {
+		log.Printf("429: Key %s exceeded its limit of %d %s", key, limit, limitName)
+		writeRateLimitError(w, kind, limitName, limit, retry)
+		return nil, false
+	}
+
+	if limits.RequestsPerMinute > 0 {
+		kl.requests.level -= float64(n)
+		w.Header().Set("x-ratelimit-remaining-requests", strconv.Itoa(max(int(kl.requests.level), 0)))
+	}
+	if !stream || limits.ConcurrentStreams == 0 {
+		return func() {}, true
+	}
+	kl.streams += n
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rl.mu.Lock()
+			kl.streams -= n
+			rl.mu.Unlock()
+		})
+	}, true
+}
+
+// get returns the state of a caller, creating it if needed. rl.mu must be
+// held.
+func (rl *rateLimiter) get(key string) *keyLimiter {
+	kl := rl.keys[key]
+	if kl == nil {
+		kl = &keyLimiter{}
+		rl.keys[key] = kl
+	}
+	return kl
+}
+
+// sweep forgets the idle callers, so that keys seen once do not stay in
+// memory. rl.mu must be held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.swept) < limiterSweepInterval {
+		return
+	}
+	rl.swept = now
+	for key, kl := range rl.keys {
+		limits := rateLimitsFor(key)
+		if kl.idle(&limits, now) {
+			delete(rl.keys, key)
+		}
+	}
+}
+
+// charge deducts the tokens of a response from the caller's budget.
+func (rl *rateLimiter) charge(r *http.Request, usage *unstream.OAIUsage) {
+	if usage == nil {
+		return
+	}
+	key := callerKeyID(r)
+	limits := rateLimitsFor(key)
+	if limits.PromptTokensPerMinute == 0 && limits.CompletionTokensPerMinute == 0 {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	// The caller may have been forgotten while its request was served
+	kl := rl.get(key)
+	now := time.Now()
+	kl.prompt.refill(limits.PromptTokensPerMinute, now)
+	kl.completion.refill(limits.CompletionTokensPerMinute, now)
+	kl.prompt.level -= float64(usage.PromptTokens)
+	kl.completion.level -= float64(usage.CompletionTokens)
+}
+
+// setRateLimitHeaders reports the caller's limits, what is left of them and
+// when they are fully replenished, like OpenAI's x-ratelimit-* headers.
+func setRateLimitHeaders(w http.ResponseWriter, kl *keyLimiter, limits *rateLimits) {
+	set := func(name string, b *tokenBucket, limit int) {
+		if limit == 0 {
+			return
+		}
+		w.Header().Set("x-ratelimit-limit-"+name, strconv.Itoa(limit))
+		w.Header().Set("x-ratelimit-remaining-"+name, strconv.Itoa(max(int(b.level), 0)))
+		w.Header().Set("x-ratelimit-reset-"+name, b.wait(limit, float64(limit)).Round(time.Millisecond).String())
+	}
+	set("requests", &kl.requests, limits.RequestsPerMinute)
+	set("prompt-tokens", &kl.prompt, limits.PromptTokensPerMinute)
+	set("completion-tokens", &kl.completion, limits.CompletionTokensPerMinute)
+}
+
+// writeRateLimitError writes a 429 in the shape OpenAI uses, with the delay
+// after which the request can be retried.
+func writeRateLimitError(w http.ResponseWriter, kind, limitName string, limit int, retry time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	w.Header().Set("retry-after-ms", strconv.FormatInt(retry.Milliseconds(), 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(unstream.OAIErrorResponse{
+		Error: unstream.OAIError{
+			Message: fmt.Sprintf("Rate limit reached on %s: limit %d. Please try again in %s.", limitName, limit, retry.Round(time.Millisecond)),
+			Type:    kind,
+			Code:    "rate_limit_exceeded",
+		},
+	})
+}
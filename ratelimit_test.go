@@ -0,0 +1,192 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func callerRequest(token string) *http.Request {
+	r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	start := time.Now()
+	var b tokenBucket
+	b.refill(60, start)
+	if b.level != 60 {
+		t.Fatalf("new bucket holds %v, want 60", b.level)
+	}
+	b.level = -30
+	cases := []struct {
+		after time.Duration
+		level float64
+		wait  time.Duration
+		full  bool
+	}{
+		{0, -30, 31 * time.Second, false},
+		{30 * time.Second, 0, time.Second, false},
+		{time.Minute, 30, 0, false},
+		{2 * time.Minute, 60, 0, true},
+		{time.Hour, 60, 0, true},
+	}
+	for _, c := range cases {
+		b := b
+		now := start.Add(c.after)
+		if full := b.full(60, now); full != c.full {
+			t.Errorf("after %v: full = %v, want %v", c.after, full, c.full)
+		}
+		b.refill(60, now)
+		if b.level != c.level {
+			t.Errorf("after %v: level %v, want %v", c.after, b.level, c.level)
+		}
+		if wait := b.wait(60, 1); wait != c.wait {
+			t.Errorf("after %v: wait %v, want %v", c.after, wait, c.wait)
+		}
+	}
+}
+
+func TestRateLimitRequests(t *testing.T) {
+	config = &Config{RateLimits: rateLimitConfig{rateLimits: rateLimits{RequestsPerMinute: 2}}}
+	defer func() { config = &Config{} }()
+	rl := &rateLimiter{keys: make(map[string]*keyLimiter)}
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		_, ok := rl.admit(w, callerRequest("a"), false)
+		if ok != (want == http.StatusOK) || w.Code != want {
+			t.Fatalf("request %d: admitted %v with status %d", i+1, ok, w.Code)
+		}
+		if want == http.StatusTooManyRequests {
+			// One request refills in 30 seconds
+			if got := w.Header().Get("Retry-After"); got != "30" {
+				t.Errorf("Retry-After = %q, want 30", got)
+			}
+			if got := w.Header().Get("x-ratelimit-remaining-requests"); got != "0" {
+				t.Errorf("x-ratelimit-remaining-requests = %q, want 0", got)
+			}
+		}
+	}
+	// Other callers have budgets of their own
+	if _, ok := rl.admit(httptest.NewRecorder(), callerRequest("b"), false); !ok {
+		t.Error("other caller denied")
+	}
+}
+
+func TestRateLimitTokens(t *testing.T) {
+	config = &Config{RateLimits: rateLimitConfig{rateLimits: rateLimits{CompletionTokensPerMinute: 600}}}
+	defer func() { config = &Config{} }()
+	rl := &rateLimiter{keys: make(map[string]*keyLimiter)}
+	r := callerRequest("a")
+
+	if _, ok := rl.admit(httptest.NewRecorder(), r, false); !ok {
+		t.Fatal("first request denied")
+	}
+	rl.charge(r, &unstream.OAIUsage{PromptTokens: 100, CompletionTokens: 900})
+	w := httptest.NewRecorder()
+	if _, ok := rl.admit(w, r, false); ok {
+		t.Fatal("request admitted with a negative balance")
+	}
+	// 301 tokens at 600 a minute take just over 30 seconds
+	if got := w.Header().Get("Retry-After"); got != "31" {
+		t.Errorf("Retry-After = %q, want 31", got)
+	}
+}
+
+func TestRateLimitConcurrentStreams(t *testing.T) {
+	config = &Config{RateLimits: rateLimitConfig{rateLimits: rateLimits{ConcurrentStreams: 1}}}
+	defer func() { config = &Config{} }()
+	rl := &rateLimiter{keys: make(map[string]*keyLimiter)}
+	r := callerRequest("a")
+
+	release, ok := rl.admit(httptest.NewRecorder(), r, true)
+	if !ok {
+		t.Fatal("first stream denied")
+	}
+	if _, ok := rl.admit(httptest.NewRecorder(), r, false); !ok {
+		t.Error("buffered request denied while a stream is open")
+	}
+	w := httptest.NewRecorder()
+	if _, ok := rl.admit(w, r, true); ok {
+		t.Fatal("second stream admitted")
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	release()
+	release()
+	if _, ok := rl.admit(httptest.NewRecorder(), r, true); !ok {
+		t.Error("stream denied after release")
+	}
+	if n := rl.keys[callerKeyID(r)].streams; n != 1 {
+		t.Errorf("%d streams open, want 1", n)
+	}
+}
+
+func TestRateLimitBatch(t *testing.T) {
+	config = &Config{RateLimits: rateLimitConfig{rateLimits: rateLimits{RequestsPerMinute: 10, ConcurrentStreams: 4}}}
+	defer func() { config = &Config{} }()
+	rl := &rateLimiter{keys: make(map[string]*keyLimiter)}
+	r := callerRequest("a")
+
+	release, ok := rl.admitRequests(httptest.NewRecorder(), r, true, 3)
+	if !ok {
+		t.Fatal("batch of 3 denied")
+	}
+	if level := rl.keys[callerKeyID(r)].requests.level; level != 7 {
+		t.Errorf("%v requests left, want 7", level)
+	}
+	if _, ok := rl.admitRequests(httptest.NewRecorder(), r, true, 2); ok {
+		t.Error("2 more streams admitted with 3 of 4 open")
+	}
+	release()
+	// A batch larger than what is left takes the budget below zero
+	w := httptest.NewRecorder()
+	if _, ok := rl.admitRequests(w, r, false, 9); !ok {
+		t.Fatal("batch of 9 denied")
+	}
+	if got := w.Header().Get("x-ratelimit-remaining-requests"); got != "0" {
+		t.Errorf("x-ratelimit-remaining-requests = %q, want 0", got)
+	}
+	if _, ok := rl.admit(httptest.NewRecorder(), r, false); ok {
+		t.Error("request admitted with a negative balance")
+	}
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	config = &Config{RateLimits: rateLimitConfig{rateLimits: rateLimits{RequestsPerMinute: 60, ConcurrentStreams: 1, PromptTokensPerMinute: 1000}}}
+	defer func() { config = &Config{} }()
+	rl := &rateLimiter{keys: make(map[string]*keyLimiter)}
+	idle, streaming, indebted := callerRequest("idle"), callerRequest("streaming"), callerRequest("indebted")
+
+	rl.admit(httptest.NewRecorder(), idle, false)
+	release, _ := rl.admit(httptest.NewRecorder(), streaming, true)
+	rl.admit(httptest.NewRecorder(), indebted, false)
+	rl.charge(indebted, &unstream.OAIUsage{PromptTokens: 3000})
+
+	rl.sweep(time.Now().Add(2 * time.Minute))
+	if _, ok := rl.keys[callerKeyID(idle)]; ok {
+		t.Error("idle caller kept")
+	}
+	if _, ok := rl.keys[callerKeyID(streaming)]; !ok {
+		t.Error("caller with an open stream forgotten")
+	}
+	if _, ok := rl.keys[callerKeyID(indebted)]; !ok {
+		t.Error("caller with a negative balance forgotten")
+	}
+
+	// Sweeps are spaced out
+	release()
+	rl.sweep(time.Now().Add(2 * time.Minute))
+	if _, ok := rl.keys[callerKeyID(streaming)]; !ok {
+		t.Error("swept again within a minute")
+	}
+	rl.sweep(time.Now().Add(4 * time.Minute))
+	if len(rl.keys) != 0 {
+		t.Errorf("%d callers left after they refilled", len(rl.keys))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+)
+
+// relayStream forwards an upstream SSE stream to the client chunk by chunk.
+// Once a tool call delta appears, the rest of the stream is held back so that
+// the assembled tool calls can be validated and repaired before being replayed.
+// With tool calling emulation, text is held back from the first <tool_call>
+// marker instead. What the client is sent is collected for the completion
+// hooks and the response cache.
+func relayStream(w http.ResponseWriter, cr *chatRequest, resp *http.Response) {
+	copyResponseHeaders(w, resp, map[string]struct{}{"Content-Length": {}})
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	var (
+		held *unstream.OAIStreamCollector
+		emu  *emulatedStream
+		ph   *placeholderStream
+	)
+	if cr.emulateTools {
+		emu = newEmulatedStream()
+	}
+	if cr.restoresPlaceholders() {
+		ph = newPlaceholderStream(cr.scrubbed)
+	}
+	written := unstream.NewOAIStreamCollector()
+	written.MergeChoices = cr.mergeChoices()
+	// upstream collects the finish reasons, to tell a stream that broke off
+	upstream := unstream.NewOAIStreamCollector()
+	var ended, complete bool
+	defer func() { publishStream(cr, written.BuildResponse(), complete) }()
+	reader := unstream.NewOAIStreamReader(resp.Body)
+	for {
+		chunk, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			ended = streamComplete(reader.Done(), upstream.BuildResponse())
+			break
+		}
+		if err != nil {
+			log.Printf("Relayed stream failed: %v", err)
+			writeStreamError(w, err)
+			flush()
+			return
+		}
+		upstream.AddChunk(chunk)
+		if cr.injectsUsage() && isUsageOnlyChunk(chunk) {
+			written.AddChunk(chunk)
+			continue
+		}
+		if emu != nil {
+			if chunk = emu.filter(chunk); chunk == nil {
+				continue
+			}
+		} else if held == nil && hasToolCallDelta(chunk) {
+			held = unstream.NewOAIStreamCollector()
+			held.MergeChoices = cr.mergeChoices()
+		}
+		if held != nil {
+			held.AddChunk(chunk)
+			continue
+		}
+		if ph != nil {
+			ph.filter(chunk)
+		}
+		chunk.Model = cr.route.responseModel(chunk.Model)
+		if err := unstream.WriteSSEChunk(w, chunk); err != nil {
+			return
+		}
+		written.AddChunk(chunk)
+		flush()
+	}
+	if ph != nil {
+		if chunk := ph.flush(); chunk != nil {
+			chunk.Model = cr.route.responseModel(chunk.Model)
+			if err := unstream.WriteSSEChunk(w, chunk); err != nil {
+				return
+			}
+			written.AddChunk(chunk)
+		}
+	}
+
+	var rest *unstream.OAIChatResponse
+	if emu != nil {
+		rest = emu.finish(cr)
+	} else if held != nil {
+		rest = held.BuildResponse()
+	}
+	if rest != nil {
+		final, _, err := applyToolValidation(cr, rest)
+		if err != nil {
+			writeStreamError(w, err)
+			flush()
+			return
+		}
+		restorePlaceholders(cr, final)
+		cr.route.presentModel(final)
+		chunks := unstream.SynthesizeStream(final, unstream.SynthesizeOptions{IncludeUsage: true})
+		for i := range chunks {
+			if err := unstream.WriteSSEChunk(w, &chunks[i]); err != nil {
+				return
+			}
+			written.AddChunk(&chunks[i])
+		}
+	}
+	// Only a stream that was relayed to its end is complete, and cached
+	complete = ended
+	if complete {
+		storeCachedChat(cr, written.BuildResponse())
+	}
+	unstream.WriteSSEDone(w)
+	flush()
+}
+
+func hasToolCallDelta(chunk *unstream.OAIStreamChunk) bool {
+	for _, ch := range chunk.Choices {
+		if len(ch.Delta.ToolCalls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeStreamError reports an error to a client whose stream has already
+// started, as an error payload in the OpenAI format, followed by [DONE].
+func writeStreamError(w io.Writer, err error) {
+	var upErr *upstreamError
+	if !errors.As(err, &upErr) {
+		upErr = newUpstreamError(http.StatusBadGateway, err.Error())
+	}
+	var streamErr *unstream.StreamError
+	if errors.As(err, &streamErr) {
+		upErr.Err = streamErr.Err
+	}
+	unstream.WriteSSEJSON(w, unstream.OAIErrorResponse{Error: upErr.Err})
+	unstream.WriteSSEDone(w)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+)
+
+// Model routing maps the model names clients ask for onto upstream model ids.
+// Routes are checked in order and the first one that matches wins; a request
+// that matches none is forwarded with its model unchanged.
+
+// routeRule is one entry of the routes config.
+type routeRule struct {
+	// Match is the requested model name, exact or as a glob (*, ?, [...]).
+	Match string `json:"match"`
+	// Model is the upstream model to use instead.
+	Model string `json:"model"`
+
+	// Keys restricts the rule to callers with these key ids.
+	Keys []string `json:"keys"`
+	// Tools and Images restrict the rule to requests with (true) or without
+	// (false) tools or image inputs.
+	Tools  *bool `json:"tools"`
+	Images *bool `json:"images"`
+	// MinPromptTokens and MaxPromptTokens restrict the rule by the estimated
+	// size of the prompt. 0 means no bound.
+	MinPromptTokens int `json:"min_prompt_tokens"`
+	MaxPromptTokens int `json:"max_prompt_tokens"`
+
+	// KeepAlias reports the requested name in the response's model field
+	// instead of the upstream model.
+	KeepAlias bool `json:"keep_alias"`
+}
+
+// modelRoute is the outcome of routing a request.
+type modelRoute struct {
+	Requested string
+	Resolved  string
+	KeepAlias bool
+}
+
+// routeFacts are the properties of a request that rules can depend on.
+type routeFacts struct {
+	key          string
+	tools        bool
+	images       bool
+	promptTokens int
+}
+
+func (rule *routeRule) matches(model string, facts *routeFacts) bool {
+	if rule.Match != model {
+		if ok, _ := path.Match(rule.Match, model); !ok {
+			return false
+		}
+	}
+	if len(rule.Keys) > 0 && !contains(rule.Keys, facts.key) {
+		return false
+	}
+	if rule.Tools != nil && *rule.Tools != facts.tools {
+		return false
+	}
+	if rule.Images != nil && *rule.Images != facts.images {
+		return false
+	}
+	if rule.MinPromptTokens > 0 && facts.promptTokens < rule.MinPromptTokens {
+		return false
+	}
+	if rule.MaxPromptTokens > 0 && facts.promptTokens > rule.MaxPromptTokens {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// routeChat resolves the model of a chat completion body and returns the body
+// with the model replaced.
+func routeChat(r *http.Request, body []byte) ([]byte, *modelRoute) {
+	var m map[string]any
+	if json.Unmarshal(body, &m) != nil {
+		return body, nil
+	}
+	model, _ := m["model"].(string)
+	if model == "" {
+		return body, nil
+	}
+	route := &modelRoute{Requested: model, Resolved: model}
+	if len(config.Routes) == 0 {
+		return body, route
+	}
+	messages, _ := m["messages"].([]any)
+	tools, _ := m["tools"].([]any)
+	facts := &routeFacts{
+		key:          callerKeyID(r),
+		tools:        len(tools) > 0,
+		images:       hasImageInput(messages),
+		promptTokens: countChatPrompt(newTokenCounter(model, ""), m).total(),
+	}
+	for i := range config.Routes {
+		rule := &config.Routes[i]
+		if rule.Model == "" || !rule.matches(model, facts) {
+			continue
+		}
+		route.Resolved, route.KeepAlias = rule.Model, rule.KeepAlias
+		break
+	}
+	if route.Resolved == model {
+		return body, route
+	}
+	log.Printf("Routing model %s to %s", model, route.Resolved)
+	m["model"] = route.Resolved
+	newBody, err := json.Marshal(m)
+	if err != nil {
+		return body, nil
+	}
+	return newBody, route
+}
+
+// hasImageInput reports whether any message has an image content part.
+func hasImageInput(messages []any) bool {
+	for _, msg := range messages {
+		m, _ := msg.(map[string]any)
+		parts, _ := m["content"].([]any)
+		for _, part := range parts {
+			if p, _ := part.(map[string]any); p["type"] == "image_url" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upstreamModel returns the model the request is sent to, or "" without a
+// route.
+func (route *modelRoute) upstreamModel() string {
+	if route == nil {
+		return ""
+	}
+	return route.Resolved
+}
+
+// responseModel returns the model name to report to the client for a
+// response from model.
+func (route *modelRoute) responseModel(model string) string {
+	if route != nil && route.KeepAlias {
+		return route.Requested
+	}
+	return model
+}
+
+// rewritesModel reports whether responses have to be rewritten to show the alias.
+func (route *modelRoute) rewritesModel() bool {
+	return route != nil && route.KeepAlias && route.Requested != route.Resolved
+}
+
+// setModelHeader reports the resolved model to the client.
+func (route *modelRoute) setModelHeader(w http.ResponseWriter) {
+	if route != nil {
+		w.Header().Set("X-Copilot-Proxy-Model", route.Resolved)
+	}
+}
+
+// presentModel rewrites the model of a complete response for the client.
+func (route *modelRoute) presentModel(final *unstream.OAIChatResponse) {
+	if final != nil {
+		final.Model = route.responseModel(final.Model)
+	}
+}
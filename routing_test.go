@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRouteChat(t *testing.T) {
+	yes, no := true, false
+	config = &Config{Routes: []routeRule{
+		{Match: "fast", Model: "gpt-4o-mini", Keys: []string{callerKeyID(callerRequest("vip"))}, KeepAlias: true},
+		{Match: "fast", Model: "gpt-4.1-nano"},
+		{Match: "smart", Model: "gpt-4o", Images: &yes},
+		{Match: "smart", Model: "o3-mini", Tools: &no, MaxPromptTokens: 100},
+		{Match: "smart", Model: "claude-sonnet-4", MinPromptTokens: 101},
+		{Match: "smart", Model: "gpt-4.1"},
+		{Match: "claude-*", Model: "claude-sonnet-4"},
+		{Match: "unrouted"},
+	}}
+	defer func() { config = &Config{} }()
+
+	long := strings.Repeat("word ", 200)
+	cases := []struct {
+		name  string
+		token string
+		body  string
+		want  string
+		alias bool
+	}{
+		{"key restricted rule", "vip", `{"model":"fast","messages":[]}`, "gpt-4o-mini", true},
+		{"other keys", "a", `{"model":"fast","messages":[]}`, "gpt-4.1-nano", false},
+		{"images", "a", `{"model":"smart","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"x"}}]}]}`, "gpt-4o", false},
+		{"small prompt without tools", "a", `{"model":"smart","messages":[{"role":"user","content":"hi"}]}`, "o3-mini", false},
+		{"small prompt with tools", "a", `{"model":"smart","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function"}]}`, "gpt-4.1", false},
+		{"large prompt", "a", `{"model":"smart","messages":[{"role":"user","content":"` + long + `"}]}`, "claude-sonnet-4", false},
+		{"glob", "a", `{"model":"claude-3.5","messages":[]}`, "claude-sonnet-4", false},
+		{"rule without a model", "a", `{"model":"unrouted","messages":[]}`, "unrouted", false},
+		{"no rule", "a", `{"model":"gpt-4o","messages":[]}`, "gpt-4o", false},
+	}
+	for _, c := range cases {
+		body, route := routeChat(callerRequest(c.token), []byte(c.body))
+		var m struct {
+			Model string `json:"model"`
+		}
+		json.Unmarshal(body, &m)
+		if route == nil || route.Resolved != c.want || m.Model != c.want || route.KeepAlias != c.alias {
+			t.Errorf("%s: routed to %+v, body model %s, want %s", c.name, route, m.Model, c.want)
+		}
+	}
+
+	if _, route := routeChat(callerRequest("a"), []byte(`{"messages":[]}`)); route != nil {
+		t.Errorf("request without a model routed to %+v", route)
+	}
+}
+
+func TestModelRouteResponses(t *testing.T) {
+	cases := []struct {
+		route    *modelRoute
+		response string
+		rewrites bool
+	}{
+		{nil, "gpt-4o-2024-08-06", false},
+		{&modelRoute{Requested: "fast", Resolved: "gpt-4o"}, "gpt-4o-2024-08-06", false},
+		{&modelRoute{Requested: "fast", Resolved: "gpt-4o", KeepAlias: true}, "fast", true},
+		{&modelRoute{Requested: "gpt-4o", Resolved: "gpt-4o", KeepAlias: true}, "gpt-4o", false},
+	}
+	for _, c := range cases {
+		if got := c.route.responseModel("gpt-4o-2024-08-06"); got != c.response || c.route.rewritesModel() != c.rewrites {
+			t.Errorf("%+v: response model %s, rewrites %v", c.route, got, c.route.rewritesModel())
+		}
+	}
+}
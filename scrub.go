@@ -0,0 +1,395 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Chat request bodies are scanned for secrets and personal data before they
+// are sent upstream. Each detector's hits are redacted with placeholders,
+// block the request, or are only logged. Placeholders the model repeats are
+// put back in the response, so that tool calls act on the real values.
+
+type scrubConfig struct {
+	// Enabled turns scanning on.
+	Enabled bool `json:"enabled"`
+	// Action is what is done with hits: "redact" (the default), "block" or
+	// "log".
+	Action string `json:"action"`
+	// Detectors sets the action of individual built-in detectors, or "off".
+	Detectors map[string]string `json:"detectors"`
+	// Patterns are extra detectors. When the regexp has a group, only the
+	// text of the first group is treated as the hit.
+	Patterns []scrubPattern `json:"patterns"`
+	// KeepPlaceholders leaves placeholders in responses as they are.
+	KeepPlaceholders bool `json:"keep_placeholders"`
+}
+
+type scrubPattern struct {
+	Name   string `json:"name"`
+	Regex  string `json:"regex"`
+	Action string `json:"action"`
+}
+
+type scrubDetector struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+var builtinDetectors = []scrubDetector{
+	{name: "private_key", re: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{name: "aws_access_key", re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{name: "aws_secret_key", re: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`)},
+	{name: "github_token", re: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{name: "slack_token", re: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`)},
+	{name: "jwt", re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]+`)},
+	// Assignments of secret looking variables, as found in .env files
+	{name: "env_secret", re: regexp.MustCompile(`(?im)^[ \t]*(?:export[ \t]+)?[A-Z0-9_]*(?:PASSWORD|PASSWD|SECRET|TOKEN|API_?KEY|PRIVATE_KEY|CREDENTIALS?)[A-Z0-9_]*[ \t]*=[ \t]*["']?([^\s"'#]{4,})`)},
+	{name: "email", re: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`)},
+	{name: "us_ssn", re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+	{name: "credit_card", re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: luhnValid},
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum of card
+// numbers.
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+var scrubDetectors = struct {
+	sync.Mutex
+	config *Config
+	list   []scrubDetector
+}{}
+
+// currentDetectors returns the built-in and configured detectors. Patterns
+// that do not compile are logged and left out.
+func currentDetectors() []scrubDetector {
+	scrubDetectors.Lock()
+	defer scrubDetectors.Unlock()
+	if scrubDetectors.config == config {
+		return scrubDetectors.list
+	}
+	list := append([]scrubDetector(nil), builtinDetectors...)
+	for _, p := range config.Scrub.Patterns {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			log.Printf("Ignoring scrub pattern %s: %v", p.Name, err)
+			continue
+		}
+		list = append(list, scrubDetector{name: p.Name, re: re})
+	}
+	scrubDetectors.config, scrubDetectors.list = config, list
+	return list
+}
+
+// scrubAction returns what is done with the hits of a detector.
+func scrubAction(name string) string {
+	if action := config.Scrub.Detectors[name]; action != "" {
+		return action
+	}
+	for _, p := range config.Scrub.Patterns {
+		if p.Name == name && p.Action != "" {
+			return p.Action
+		}
+	}
+	if config.Scrub.Action != "" {
+		return config.Scrub.Action
+	}
+	return "redact"
+}
+
+// scrubbing is what was redacted from a request: the original text of each
+// placeholder, and the detectors that had hits.
+type scrubbing struct {
+	placeholders map[string]string
+	byValue      map[string]string
+	counts       map[string]int
+	blocked      []string
+	logged       []string
+}
+
+// scrubRequest scans a request body. It returns the body to send upstream,
+// or writes an error and returns false when a hit blocks the request.
+func scrubRequest(w http.ResponseWriter, r *http.Request, body []byte) ([]byte, *scrubbing, bool) {
+	if !config.Scrub.Enabled {
+		return body, nil, true
+	}
+	var m map[string]any
+	if json.Unmarshal(body, &m) != nil {
+		return body, nil, true
+	}
+	s := &scrubbing{placeholders: make(map[string]string), byValue: make(map[string]string), counts: make(map[string]int)}
+	for k, v := range m {
+		if k != "model" {
+			m[k] = s.scrubValue(v)
+		}
+	}
+	if len(s.logged) > 0 {
+		log.Printf("Request from key %s contains %s", callerKeyID(r), strings.Join(s.logged, ", "))
+	}
+	if len(s.blocked) > 0 {
+		log.Printf("Blocked request from key %s containing %s", callerKeyID(r), strings.Join(s.blocked, ", "))
+		redacted, _ := json.Marshal(m)
+		auditBlockedRequest(r, redacted, s.blocked)
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error",
+			fmt.Sprintf("The request was blocked because it contains what looks like %s. Remove it and try again.", strings.Join(s.blocked, ", ")))
+		return nil, nil, false
+	}
+	if len(s.placeholders) == 0 {
+		return body, nil, true
+	}
+	names := make([]string, 0, len(s.counts))
+	for name := range s.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("X-Copilot-Proxy-Scrubbed", strings.Join(names, ","))
+	log.Printf("Redacted %s from request of key %s", strings.Join(names, ", "), callerKeyID(r))
+	scrubbed, _ := json.Marshal(m)
+	auditRequestBody(r, scrubbed)
+	return scrubbed, s, true
+}
+
+// scrubValue scans the strings of a decoded JSON value.
+func (s *scrubbing) scrubValue(v any) any {
+	switch v := v.(type) {
+	case string:
+		return s.scrubString(v)
+	case map[string]any:
+		for k, child := range v {
+			v[k] = s.scrubValue(child)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = s.scrubValue(child)
+		}
+	}
+	return v
+}
+
+// scrubString replaces the hits of every detector in text. Hits are all found
+// in the original text and replaced in one pass, so that no detector sees the
+// placeholders of another. Where hits overlap, the detector listed first wins,
+// and text that already is a placeholder is left alone.
+func (s *scrubbing) scrubString(text string) string {
+	type span struct {
+		start, end int
+		name       string
+	}
+	var taken, hits []span
+	for _, loc := range placeholderPattern.FindAllStringIndex(text, -1) {
+		taken = append(taken, span{start: loc[0], end: loc[1]})
+	}
+	overlaps := func(start, end int) bool {
+		for _, t := range taken {
+			if start < t.end && t.start < end {
+				return true
+			}
+		}
+		return false
+	}
+	for _, d := range currentDetectors() {
+		action := scrubAction(d.name)
+		if action == "off" {
+			continue
+		}
+		for _, m := range d.re.FindAllStringSubmatchIndex(text, -1) {
+			start, end := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			hit := text[start:end]
+			if hit == "" || d.valid != nil && !d.valid(hit) || overlaps(start, end) {
+				continue
+			}
+			switch action {
+			case "block":
+				// Blocked values are redacted too, for the audit log
+				s.note(&s.blocked, d.name)
+			case "log":
+				s.note(&s.logged, d.name)
+				continue
+			}
+			taken = append(taken, span{start, end, d.name})
+			hits = append(hits, span{start, end, d.name})
+		}
+	}
+	if len(hits) == 0 {
+		return text
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].start < hits[j].start })
+	var out strings.Builder
+	last := 0
+	for _, h := range hits {
+		out.WriteString(text[last:h.start])
+		out.WriteString(s.placeholder(h.name, text[h.start:h.end]))
+		last = h.end
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+func (s *scrubbing) note(list *[]string, name string) {
+	if !contains(*list, name) {
+		*list = append(*list, name)
+	}
+}
+
+// placeholder returns the placeholder of a hit, the same one for every
+// occurrence of the value.
+func (s *scrubbing) placeholder(name, value string) string {
+	if p, ok := s.byValue[value]; ok {
+		return p
+	}
+	s.counts[name]++
+	p := fmt.Sprintf("[REDACTED_%s_%d]", strings.ToUpper(name), s.counts[name])
+	s.placeholders[p] = value
+	s.byValue[value] = p
+	return p
+}
+
+// placeholderPattern matches the placeholders of scrubbing.
+var placeholderPattern = regexp.MustCompile(`\[REDACTED_[A-Z0-9_]+_\d+\]`)
+
+// restoresPlaceholders reports whether placeholders in the response are to be
+// put back.
+func (cr *chatRequest) restoresPlaceholders() bool {
+	return cr.scrubbed != nil && !config.Scrub.KeepPlaceholders
+}
+
+// restore puts the original values back in text. In JSON, such as tool call
+// arguments, they are escaped as string contents.
+func (s *scrubbing) restore(text string, inJSON bool) string {
+	return placeholderPattern.ReplaceAllStringFunc(text, func(p string) string {
+		value, ok := s.placeholders[p]
+		if !ok {
+			return p
+		}
+		if inJSON {
+			b, _ := json.Marshal(value)
+			return string(b[1 : len(b)-1])
+		}
+		return value
+	})
+}
+
+// restorePlaceholders puts the redacted values back in a complete response.
+func restorePlaceholders(cr *chatRequest, final *unstream.OAIChatResponse) {
+	if !cr.restoresPlaceholders() || final == nil {
+		return
+	}
+	for i := range final.Choices {
+		msg := &final.Choices[i].Message
+		if msg.Content != nil {
+			restored := cr.scrubbed.restore(*msg.Content, false)
+			msg.Content = &restored
+		}
+		for j := range msg.ToolCalls {
+			msg.ToolCalls[j].Function.Arguments = cr.scrubbed.restore(msg.ToolCalls[j].Function.Arguments, true)
+		}
+	}
+}
+
+// placeholderStream puts the redacted values back in streamed content.
+// Text that may be the start of a placeholder is held back until the next
+// delta shows whether it is one.
+type placeholderStream struct {
+	s       *scrubbing
+	pending map[int]string
+	last    unstream.OAIStreamChunk
+}
+
+func newPlaceholderStream(s *scrubbing) *placeholderStream {
+	return &placeholderStream{s: s, pending: make(map[int]string)}
+}
+
+func (p *placeholderStream) filter(chunk *unstream.OAIStreamChunk) {
+	p.last = unstream.OAIStreamChunk{ID: chunk.ID, Object: chunk.Object, Created: chunk.Created, Model: chunk.Model}
+	for i := range chunk.Choices {
+		ch := &chunk.Choices[i]
+		if ch.Delta.Content == nil && ch.FinishReason == nil {
+			continue
+		}
+		text := p.pending[ch.Index]
+		if ch.Delta.Content != nil {
+			text += *ch.Delta.Content
+		}
+		text = p.s.restore(text, false)
+		held := ""
+		if ch.FinishReason == nil {
+			held = placeholderPrefix(text)
+		}
+		p.pending[ch.Index] = held
+		text = text[:len(text)-len(held)]
+		if text != "" || ch.Delta.Content != nil {
+			ch.Delta.Content = &text
+		}
+	}
+}
+
+// flush returns a chunk with the text still held back, or nil.
+func (p *placeholderStream) flush() *unstream.OAIStreamChunk {
+	var chunk *unstream.OAIStreamChunk
+	for index, text := range p.pending {
+		if text == "" {
+			continue
+		}
+		if chunk == nil {
+			head := p.last
+			chunk = &head
+		}
+		chunk.Choices = append(chunk.Choices, unstream.OAIStreamChoice{Index: index, Delta: unstream.OAIStreamDelta{Content: &text}})
+		delete(p.pending, index)
+	}
+	return chunk
+}
+
+// placeholderPrefix returns the end of text that may be the start of a
+// placeholder.
+func placeholderPrefix(text string) string {
+	const start = "[REDACTED_"
+	i := strings.LastIndexByte(text, '[')
+	if i < 0 || len(text)-i > 64 {
+		return ""
+	}
+	tail := text[i:]
+	if len(tail) <= len(start) {
+		if strings.HasPrefix(start, tail) {
+			return tail
+		}
+		return ""
+	}
+	if !strings.HasPrefix(tail, start) {
+		return ""
+	}
+	for _, c := range tail[len(start):] {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return ""
+		}
+	}
+	return tail
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"copilot-proxy/unstream"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+)
+
+// injectsUsage reports whether stream_options.include_usage is added to the
+// upstream request on the client's behalf, so that the proxy learns the usage
+// of streams whose client did not ask for it.
+func (cr *chatRequest) injectsUsage() bool {
+	return config.InjectStreamUsage && cr.Stream && (cr.StreamOptions == nil || !cr.StreamOptions.IncludeUsage)
+}
+
+// isUsageOnlyChunk reports whether a chunk is the extra one that carries the
+// usage when include_usage is set.
+func isUsageOnlyChunk(chunk *unstream.OAIStreamChunk) bool {
+	return chunk.Usage != nil && len(chunk.Choices) == 0
+}
+
+// teeStream copies an upstream SSE stream to the client event by event, as it
+// arrives, while collecting it. It returns the collected response, or what
+// there was of it if the stream broke off, and whether the stream reached its
+// end. The usage chunk the client did not ask for is collected but not sent.
+func teeStream(w http.ResponseWriter, cr *chatRequest, resp *http.Response) (*unstream.OAIChatResponse, bool) {
+	copyResponseHeaders(w, resp, map[string]struct{}{"Content-Length": {}})
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	collector := unstream.NewOAIStreamCollector()
+	collector.MergeChoices = cr.mergeChoices()
+
+	reader := bufio.NewReader(resp.Body)
+	var (
+		event  bytes.Buffer
+		done   bool
+		broken bool
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		event.Write(line)
+		// Events end with a blank line
+		if event.Len() > 0 && (err != nil || len(bytes.TrimSpace(line)) == 0) {
+			send, last := teeEvent(cr, collector, event.Bytes())
+			done = done || last
+			if send {
+				if _, werr := w.Write(event.Bytes()); werr != nil {
+					broken = true
+					break
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			event.Reset()
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("Streamed response broke off: %v", err)
+				broken = true
+			}
+			break
+		}
+	}
+	final := collector.BuildResponse()
+	return final, !broken && streamComplete(done, final)
+}
+
+// teeEvent adds the chunks of an SSE event to the collector, and reports
+// whether the event is to be sent to the client and whether it is [DONE].
+func teeEvent(cr *chatRequest, collector *unstream.OAIStreamCollector, event []byte) (send, done bool) {
+	reader := unstream.NewOAIStreamReader(bytes.NewReader(event))
+	for {
+		// Error events and payloads that are not chunks are passed on as they
+		// are
+		chunk, err := reader.Next()
+		if err != nil {
+			return true, reader.Done()
+		}
+		collector.AddChunk(chunk)
+		if cr.injectsUsage() && isUsageOnlyChunk(chunk) {
+			return false, false
+		}
+	}
+}
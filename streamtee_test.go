@@ -0,0 +1,40 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"testing"
+)
+
+func TestTeeEvent(t *testing.T) {
+	config = &Config{InjectStreamUsage: true}
+	defer func() { config = &Config{} }()
+	cr := &chatRequest{Stream: true}
+
+	cases := []struct {
+		event   string
+		send    bool
+		done    bool
+		content string
+	}{
+		{"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"one\"}}]}\n\n", true, false, "one"},
+		// A payload split over several data lines is one chunk
+		{"data: {\"choices\":[{\"index\":0,\ndata: \"delta\":{\"content\":\"two\"}}]}\n\n", true, false, "two"},
+		{": keep-alive\n\n", true, false, ""},
+		{"data: [DONE]\n\n", true, true, ""},
+		{"event: error\ndata: {\"message\":\"overloaded\"}\n\n", true, false, ""},
+		{"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":2,\"total_tokens\":5}}\n\n", false, false, ""},
+	}
+	for _, c := range cases {
+		collector := unstream.NewOAIStreamCollector()
+		if send, done := teeEvent(cr, collector, []byte(c.event)); send != c.send || done != c.done {
+			t.Errorf("teeEvent(%q) = %v, %v, want %v, %v", c.event, send, done, c.send, c.done)
+		}
+		content := ""
+		if final := collector.BuildResponse(); len(final.Choices) > 0 && final.Choices[0].Message.Content != nil {
+			content = *final.Choices[0].Message.Content
+		}
+		if content != c.content {
+			t.Errorf("teeEvent(%q) collected %q, want %q", c.event, content, c.content)
+		}
+	}
+}
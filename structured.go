@@ -0,0 +1,165 @@
+package main
+
+import (
+	"copilot-proxy/jsonschema"
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Structured outputs: responses to requests with response_format json_schema
+// (or json_object) are validated before the client sees them, and the model is
+// asked again with the validation error when they do not match.
+
+const defaultStructuredOutputRetries = 2
+
+type structuredOutputConfig struct {
+	// Disabled turns validation of response_format off.
+	Disabled bool `json:"disabled"`
+	// MaxRetries bounds the number of re-asks after a validation failure.
+	// Defaults to 2.
+	MaxRetries int `json:"max_retries"`
+}
+
+type responseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema *struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+		Strict bool            `json:"strict"`
+	} `json:"json_schema,omitempty"`
+}
+
+// structuredOutput reports whether the response has to be validated as JSON.
+func (cr *chatRequest) structuredOutput() bool {
+	if config.StructuredOutputs.Disabled || cr.ResponseFormat == nil {
+		return false
+	}
+	return cr.ResponseFormat.Type == "json_schema" || cr.ResponseFormat.Type == "json_object"
+}
+
+// injectSchemaBody replaces response_format with prompt instructions, for
+// models that ignore or reject it.
+func injectSchemaBody(cr *chatRequest, body map[string]any) map[string]any {
+	delete(body, "response_format")
+	instructions := "Respond only with a single JSON object. Do not add any other text and do not use code fences."
+	if rf := cr.ResponseFormat; rf.Type == "json_schema" && rf.JSONSchema != nil {
+		instructions = fmt.Sprintf("Respond only with a single JSON document that conforms to the JSON schema %q below. "+
+			"Do not add any other text and do not use code fences.\n\n%s", rf.JSONSchema.Name, string(rf.JSONSchema.Schema))
+	}
+	messages, _ := body["messages"].([]any)
+	body["messages"] = append([]any{map[string]any{"role": "system", "content": instructions}}, messages...)
+	return body
+}
+
+// checkStructuredOutput validates the content of the first choice and returns
+// the JSON document to send. Models often wrap the document in code fences or
+// prose, so the document is extracted before validation.
+func checkStructuredOutput(cr *chatRequest, final *unstream.OAIChatResponse) (string, error) {
+	if len(final.Choices) == 0 || final.Choices[0].Message.Content == nil {
+		return "", fmt.Errorf("the response has no content")
+	}
+	doc := extractJSON(*final.Choices[0].Message.Content)
+	if doc == "" {
+		return "", fmt.Errorf("the response is not a JSON document")
+	}
+	rf := cr.ResponseFormat
+	if rf.Type == "json_object" || rf.JSONSchema == nil {
+		if !strings.HasPrefix(doc, "{") {
+			return "", fmt.Errorf("the response is not a JSON object")
+		}
+		return doc, nil
+	}
+	schema, err := jsonschema.Parse(rf.JSONSchema.Schema)
+	if err != nil {
+		// The schema is the client's problem; upstream would have rejected it too
+		log.Printf("Cannot validate response_format %s: %v", rf.JSONSchema.Name, err)
+		return doc, nil
+	}
+	if err := schema.ValidateJSON([]byte(doc)); err != nil {
+		return "", err
+	}
+	return doc, nil
+}
+
+// extractJSON returns the JSON document in content, stripping code fences and
+// surrounding prose, or "" if there is none.
+func extractJSON(content string) string {
+	content = strings.TrimSpace(content)
+	if json.Valid([]byte(content)) {
+		return content
+	}
+	if strings.HasPrefix(content, "```") {
+		if repaired, ok := unstream.RepairJSON(content); ok && repaired != "{}" {
+			return repaired
+		}
+	}
+	start := strings.IndexAny(content, "{[")
+	if start < 0 {
+		return ""
+	}
+	closer := "}"
+	if content[start] == '[' {
+		closer = "]"
+	}
+	end := strings.LastIndex(content, closer)
+	if end <= start {
+		return ""
+	}
+	if candidate := content[start : end+1]; json.Valid([]byte(candidate)) {
+		return candidate
+	}
+	return ""
+}
+
+// applyStructuredOutput validates final against the requested response_format,
+// re-asking with the validation error up to the configured bound. If the output
+// never validates, the response is turned into a refusal.
+func applyStructuredOutput(cr *chatRequest, final *unstream.OAIChatResponse) (*unstream.OAIChatResponse, error) {
+	if !cr.structuredOutput() || hasToolCalls(final) {
+		return final, nil
+	}
+	maxRetries := config.StructuredOutputs.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultStructuredOutputRetries
+	}
+	for attempt := 0; ; attempt++ {
+		if final.Choices[0].Message.Refusal != nil {
+			return final, nil
+		}
+		doc, err := checkStructuredOutput(cr, final)
+		if err == nil {
+			final.Choices[0].Message.Content = &doc
+			return final, nil
+		}
+		log.Printf("Structured output from %s failed validation: %v", cr.Model, err)
+		if attempt >= maxRetries {
+			refusal := fmt.Sprintf("The model did not produce output matching the requested response_format after %d attempts: %v", attempt+1, err)
+			final.Choices[0].Message.Content = nil
+			final.Choices[0].Message.Refusal = &refusal
+			final.Choices[0].FinishReason = "stop"
+			return final, nil
+		}
+		body, bodyErr := cr.bodyMap()
+		if bodyErr != nil {
+			return nil, bodyErr
+		}
+		messages, _ := body["messages"].([]any)
+		if c := final.Choices[0].Message.Content; c != nil {
+			messages = append(messages, map[string]any{"role": "assistant", "content": *c})
+		}
+		messages = append(messages, map[string]any{
+			"role":    "user",
+			"content": "Your previous reply did not match the required format: " + err.Error() + ". Reply again with only the corrected JSON document.",
+		})
+		body["messages"] = messages
+		chargeDiscarded(cr, final)
+		retried, _, retryErr := completeChat(cr, body)
+		if retryErr != nil {
+			return nil, retryErr
+		}
+		final = retried
+	}
+}
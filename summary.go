@@ -0,0 +1,178 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Once a chat completion is over, whichever path served it, its assembled
+// response is published to the completion hooks: logging, metrics,
+// accounting and threads.
+
+// completionSummary is a finished chat completion. Response holds what the
+// client was sent, as far as it got; it is nil when nothing was. Incomplete
+// is set when the stream failed or broke off before its end.
+type completionSummary struct {
+	r          *http.Request
+	Model      string
+	Stream     bool
+	Response   *unstream.OAIChatResponse
+	Incomplete bool
+}
+
+// usage returns the usage reported for the completion, if any.
+func (s *completionSummary) usage() *unstream.OAIUsage {
+	if s.Response == nil {
+		return nil
+	}
+	return s.Response.Usage
+}
+
+var completionHooks = []func(*completionSummary){
+	logCompletion,
+	metrics.record,
+	accountCompletion,
+	storeThreadRun,
+}
+
+// publishCompletion runs the completion hooks for a request's response.
+func publishCompletion(cr *chatRequest, final *unstream.OAIChatResponse) {
+	publishStream(cr, final, true)
+}
+
+// publishStream runs the completion hooks for a streamed response. complete
+// reports whether the stream reached its end.
+func publishStream(cr *chatRequest, final *unstream.OAIChatResponse, complete bool) {
+	s := &completionSummary{r: cr.r, Model: cr.Model, Stream: cr.Stream, Response: final, Incomplete: !complete}
+	for _, hook := range completionHooks {
+		hook(s)
+	}
+}
+
+// streamComplete reports whether an upstream stream reached its end: it sent
+// [DONE], or a finish reason for its answer.
+func streamComplete(done bool, upstream *unstream.OAIChatResponse) bool {
+	if done {
+		return true
+	}
+	for _, ch := range upstream.Choices {
+		if ch.FinishReason != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func logCompletion(s *completionSummary) {
+	u := s.usage()
+	if u == nil {
+		log.Printf("Completion from %s finished (%s), usage not reported", s.Model, finishReasons(s.Response))
+		return
+	}
+	log.Printf("Completion from %s finished (%s), %d prompt and %d completion tokens", s.Model, finishReasons(s.Response), u.PromptTokens, u.CompletionTokens)
+}
+
+func accountCompletion(s *completionSummary) {
+	chargeUsage(s.r, s.Model, 1, s.usage())
+}
+
+// chargeDiscarded charges a response that is thrown away to ask the model
+// again. Only the response the client gets is published, so the attempts
+// before it are charged when they are discarded.
+func chargeDiscarded(cr *chatRequest, discarded *unstream.OAIChatResponse) {
+	chargeUsage(cr.r, cr.Model, 1, discarded.Usage)
+}
+
+// finishReasons lists the finish reasons of a response's choices.
+func finishReasons(final *unstream.OAIChatResponse) string {
+	if final == nil || len(final.Choices) == 0 {
+		return "no choices"
+	}
+	reason := ""
+	for i, ch := range final.Choices {
+		if i > 0 {
+			reason += ", "
+		}
+		if ch.FinishReason == "" {
+			reason += "unfinished"
+		} else {
+			reason += ch.FinishReason
+		}
+	}
+	return reason
+}
+
+// modelMetrics are the counters of one model.
+type modelMetrics struct {
+	Requests         int            `json:"requests"`
+	Streamed         int            `json:"streamed"`
+	WithoutUsage     int            `json:"without_usage"`
+	PromptTokens     int            `json:"prompt_tokens"`
+	CompletionTokens int            `json:"completion_tokens"`
+	CachedTokens     int            `json:"cached_tokens"`
+	FinishReasons    map[string]int `json:"finish_reasons"`
+}
+
+// completionMetrics counts completions since the proxy started, by model.
+type completionMetrics struct {
+	mu     sync.Mutex
+	models map[string]*modelMetrics
+}
+
+var metrics = &completionMetrics{models: make(map[string]*modelMetrics)}
+
+func (m *completionMetrics) record(s *completionSummary) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mm := m.models[s.Model]
+	if mm == nil {
+		mm = &modelMetrics{FinishReasons: make(map[string]int)}
+		m.models[s.Model] = mm
+	}
+	mm.Requests++
+	if s.Stream {
+		mm.Streamed++
+	}
+	if u := s.usage(); u != nil {
+		mm.PromptTokens += u.PromptTokens
+		mm.CompletionTokens += u.CompletionTokens
+		if u.PromptTokensDetails != nil {
+			mm.CachedTokens += u.PromptTokensDetails.CachedTokens
+		}
+	} else {
+		mm.WithoutUsage++
+	}
+	if s.Response != nil {
+		for _, ch := range s.Response.Choices {
+			reason := ch.FinishReason
+			if reason == "" {
+				reason = "unfinished"
+			}
+			mm.FinishReasons[reason]++
+		}
+	}
+}
+
+// handleAdminMetrics serves /admin/metrics: completion counters by model.
+func handleAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	type row struct {
+		Model string `json:"model"`
+		modelMetrics
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	data := make([]row, 0, len(metrics.models))
+	for name, mm := range metrics.models {
+		data = append(data, row{name, *mm})
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].Model < data[j].Model })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data})
+}
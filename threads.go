@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Threads keep the history of a conversation on the server, so that clients
+// only send what is new. A run completes the thread's conversation through the
+// chat completions handler like any other request, and the completion hook
+// adds the new messages and the assistant's answer to the thread once it is
+// over. Runs of a thread go one at a time.
+
+type threadsConfig struct {
+	// Dir is where threads are kept, a file per thread. The threads API is
+	// off when it is empty.
+	Dir string `json:"dir"`
+}
+
+// thread is a conversation owned by the key that created it.
+type thread struct {
+	ID        string            `json:"id"`
+	Owner     string            `json:"owner"`
+	CreatedAt int64             `json:"created_at"`
+	Model     string            `json:"model,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Messages  []threadMessage   `json:"messages"`
+}
+
+// threadMessage is a chat message of a thread.
+type threadMessage struct {
+	ID         string                 `json:"id"`
+	Object     string                 `json:"object"`
+	CreatedAt  int64                  `json:"created_at"`
+	Role       string                 `json:"role"`
+	Content    json.RawMessage        `json:"content"`
+	Name       string                 `json:"name,omitempty"`
+	ToolCalls  []unstream.OAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string                 `json:"tool_call_id,omitempty"`
+}
+
+// threadView is a thread as clients see it. Lists leave out the messages.
+type threadView struct {
+	ID           string            `json:"id"`
+	Object       string            `json:"object"`
+	CreatedAt    int64             `json:"created_at"`
+	Model        string            `json:"model,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	MessageCount int               `json:"message_count"`
+	Messages     []threadMessage   `json:"messages,omitempty"`
+}
+
+func (t *thread) view(withMessages bool) threadView {
+	v := threadView{
+		ID:           t.ID,
+		Object:       "thread",
+		CreatedAt:    t.CreatedAt,
+		Model:        t.Model,
+		Metadata:     t.Metadata,
+		MessageCount: len(t.Messages),
+	}
+	if withMessages {
+		v.Messages = append([]threadMessage{}, t.Messages...)
+	}
+	return v
+}
+
+func newThreadID(prefix string) string {
+	return prefix + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// chatMessage returns the message in the shape of a chat completion request.
+func (m *threadMessage) chatMessage() map[string]any {
+	out := map[string]any{"role": m.Role, "content": m.Content}
+	if m.Name != "" {
+		out["name"] = m.Name
+	}
+	if len(m.ToolCalls) > 0 {
+		calls := make([]map[string]any, len(m.ToolCalls))
+		for i, tc := range m.ToolCalls {
+			calls[i] = map[string]any{"id": tc.Id, "type": "function", "function": tc.Function}
+		}
+		out["tool_calls"] = calls
+	}
+	if m.ToolCallID != "" {
+		out["tool_call_id"] = m.ToolCallID
+	}
+	return out
+}
+
+// check reports what is wrong with a message a client sent, or "".
+func (m *threadMessage) check() string {
+	switch m.Role {
+	case "system", "developer", "user", "assistant", "tool":
+	default:
+		return fmt.Sprintf("Invalid role %q", m.Role)
+	}
+	if m.Role == "tool" && m.ToolCallID == "" {
+		return "Tool messages need a tool_call_id"
+	}
+	if (len(m.Content) == 0 || string(m.Content) == "null") && !(m.Role == "assistant" && len(m.ToolCalls) > 0) {
+		return "Messages need content"
+	}
+	return ""
+}
+
+type threadStore struct {
+	mu      sync.Mutex
+	config  *Config // the config the threads were loaded for
+	threads map[string]*thread
+	running map[string]bool // threads with a run in progress
+}
+
+var threads = &threadStore{running: make(map[string]bool)}
+
+var errThreadBusy = errors.New("another run of the thread is in progress")
+
+// load reads the threads of the current config's directory, when the config
+// has changed. Callers hold s.mu.
+func (s *threadStore) load() {
+	if s.config == config {
+		return
+	}
+	s.config = config
+	s.threads = make(map[string]*thread)
+	dir := config.Threads.Dir
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Printf("Failed to create the threads directory: %v", err)
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Failed to read threads: %v", err)
+		return
+	}
+	for _, de := range entries {
+		if !strings.HasSuffix(de.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, de.Name()))
+		if err != nil {
+			log.Printf("Failed to read thread %s: %v", de.Name(), err)
+			continue
+		}
+		var t thread
+		if err := json.Unmarshal(data, &t); err != nil || t.ID == "" {
+			log.Printf("Failed to read thread %s: %v", de.Name(), err)
+			continue
+		}
+		s.threads[t.ID] = &t
+	}
+	log.Printf("Loaded %d threads", len(s.threads))
+}
+
+// save writes a thread to its file. Callers hold s.mu.
+func (s *threadStore) save(t *thread) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(config.Threads.Dir, t.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// get returns a thread of owner. Callers hold s.mu.
+func (s *threadStore) get(owner, id string) *thread {
+	s.load()
+	if t := s.threads[id]; t != nil && t.Owner == owner {
+		return t
+	}
+	return nil
+}
+
+func (s *threadStore) create(t *thread) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	if err := s.save(t); err != nil {
+		return err
+	}
+	s.threads[t.ID] = t
+	return nil
+}
+
+// view returns a copy of a thread of owner, and whether there is one.
+func (s *threadStore) view(owner, id string, withMessages bool) (threadView, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.get(owner, id)
+	if t == nil {
+		return threadView{}, false
+	}
+	return t.view(withMessages), true
+}
+
+// list returns the threads of owner, newest first.
+func (s *threadStore) list(owner string) []threadView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load()
+	views := []threadView{}
+	for _, t := range s.threads {
+		if t.Owner == owner {
+			views = append(views, t.view(false))
+		}
+	}
+	sort.Slice(views, func(i, j int) bool {
+		if views[i].CreatedAt != views[j].CreatedAt {
+			return views[i].CreatedAt > views[j].CreatedAt
+		}
+		return views[i].ID < views[j].ID
+	})
+	return views
+}
+
+// appendMessages adds messages to a thread of owner. It reports false when
+// there is no such thread.
+func (s *threadStore) appendMessages(owner, id string, messages ...threadMessage) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.get(owner, id)
+	if t == nil {
+		return false, nil
+	}
+	t.Messages = append(t.Messages, messages...)
+	return true, s.save(t)
+}
+
+func (s *threadStore) remove(owner, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.get(owner, id) == nil {
+		return false, nil
+	}
+	delete(s.threads, id)
+	if err := os.Remove(filepath.Join(config.Threads.Dir, id+".json")); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+// startRun returns a thread of owner with its messages, and whether there is
+// one, and marks a run of it as in progress until endRun. It returns
+// errThreadBusy when another run is.
+func (s *threadStore) startRun(owner, id string) (threadView, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.get(owner, id)
+	if t == nil {
+		return threadView{}, false, nil
+	}
+	if s.running[id] {
+		return threadView{}, true, errThreadBusy
+	}
+	s.running[id] = true
+	return t.view(true), true, nil
+}
+
+func (s *threadStore) endRun(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, id)
+}
+
+// threadRun is a run in progress. Its new messages are only added to the
+// thread together with the answer, so that a failed run can be retried.
+type threadRun struct {
+	owner    string
+	threadID string
+	pending  []threadMessage
+}
+
+type threadRunContextKey struct{}
+
+// storeThreadRun is the completion hook that adds the messages of a run and
+// the assistant's answer, as collected from the response, to the thread.
+func storeThreadRun(s *completionSummary) {
+	run, _ := s.r.Context().Value(threadRunContextKey{}).(*threadRun)
+	if run == nil || s.Response == nil || len(s.Response.Choices) == 0 {
+		return
+	}
+	if s.Incomplete {
+		// Neither the question nor the partial answer is kept, so the run
+		// can be retried
+		log.Printf("Not storing the answer of thread %s, its stream broke off", run.threadID)
+		return
+	}
+	answer := s.Response.Choices[0].Message
+	if answer.Content == nil && len(answer.ToolCalls) == 0 {
+		return
+	}
+	content, _ := json.Marshal(answer.Content)
+	msg := threadMessage{
+		ID:        newThreadID("msg_"),
+		Object:    "thread.message",
+		CreatedAt: time.Now().Unix(),
+		Role:      "assistant",
+		Content:   content,
+		ToolCalls: answer.ToolCalls,
+	}
+	ok, err := threads.appendMessages(run.owner, run.threadID, append(run.pending, msg)...)
+	switch {
+	case err != nil:
+		log.Printf("Failed to store the answer of thread %s: %v", run.threadID, err)
+	case !ok:
+		log.Printf("Thread %s was deleted during its run", run.threadID)
+	}
+}
+
+func writeThreadNotFound(w http.ResponseWriter, id string) {
+	writeAPIError(w, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("No thread found with id '%s'.", id))
+}
+
+// handleThreads serves the threads API:
+//
+//	POST   /v1/threads                create a thread
+//	GET    /v1/threads                list the caller's threads
+//	GET    /v1/threads/{id}           a thread with its messages
+//	DELETE /v1/threads/{id}           delete a thread
+//	GET    /v1/threads/{id}/messages  the messages of a thread
+//	POST   /v1/threads/{id}/messages  add a message
+//	POST   /v1/threads/{id}/runs      complete the conversation
+func handleThreads(w http.ResponseWriter, r *http.Request) {
+	if _, ok := copilotToken(w, r); !ok {
+		return
+	}
+	if config.Threads.Dir == "" {
+		writeAPIError(w, http.StatusNotFound, "invalid_request_error", "Threads are not enabled on this proxy")
+		return
+	}
+	owner := callerKeyID(r)
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1"), "/threads")
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	id, sub := parts[0], ""
+	if len(parts) > 1 {
+		sub = parts[1]
+	}
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		createThread(w, r, owner)
+	case id == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": threads.list(owner)})
+	case sub == "" && r.Method == http.MethodGet:
+		v, ok := threads.view(owner, id, true)
+		if !ok {
+			writeThreadNotFound(w, id)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	case sub == "" && r.Method == http.MethodDelete:
+		ok, err := threads.remove(owner, id)
+		if err != nil {
+			log.Printf("Failed to delete thread %s: %v", id, err)
+		}
+		if !ok {
+			writeThreadNotFound(w, id)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": id, "object": "thread.deleted", "deleted": true})
+	case sub == "messages" && r.Method == http.MethodGet:
+		v, ok := threads.view(owner, id, true)
+		if !ok {
+			writeThreadNotFound(w, id)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": append([]threadMessage{}, v.Messages...)})
+	case sub == "messages" && r.Method == http.MethodPost:
+		addThreadMessage(w, r, owner, id)
+	case sub == "runs" && r.Method == http.MethodPost:
+		runThread(w, r, owner, id)
+	case id != "" && (sub == "" || sub == "messages" || sub == "runs"):
+		writeAPIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method "+r.Method+" is not allowed here")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// readThreadMessages checks messages sent by a client and gives them ids. It
+// writes an error and returns false when one is invalid.
+func readThreadMessages(w http.ResponseWriter, param string, messages []threadMessage) bool {
+	now := time.Now().Unix()
+	for i := range messages {
+		m := &messages[i]
+		if m.Role == "" {
+			m.Role = "user"
+		}
+		if problem := m.check(); problem != "" {
+			writeParamError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("%s[%d]", param, i), "invalid_value", problem)
+			return false
+		}
+		m.ID, m.Object, m.CreatedAt = newThreadID("msg_"), "thread.message", now
+	}
+	return true
+}
+
+func createThread(w http.ResponseWriter, r *http.Request, owner string) {
+	var req struct {
+		Model    string            `json:"model"`
+		Metadata map[string]string `json:"metadata"`
+		Messages []threadMessage   `json:"messages"`
+	}
+	if body, _ := io.ReadAll(r.Body); len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON: "+err.Error())
+			return
+		}
+	}
+	if !readThreadMessages(w, "messages", req.Messages) {
+		return
+	}
+	t := &thread{
+		ID:        newThreadID("thread_"),
+		Owner:     owner,
+		CreatedAt: time.Now().Unix(),
+		Model:     req.Model,
+		Metadata:  req.Metadata,
+		Messages:  req.Messages,
+	}
+	if t.Messages == nil {
+		t.Messages = []threadMessage{}
+	}
+	if err := threads.create(t); err != nil {
+		log.Printf("Failed to store thread: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "server_error", "Failed to store the thread")
+		return
+	}
+	log.Printf("Created thread %s for key %s", t.ID, owner)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.view(true))
+}
+
+func addThreadMessage(w http.ResponseWriter, r *http.Request, owner, id string) {
+	var m threadMessage
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &m); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON: "+err.Error())
+		return
+	}
+	messages := []threadMessage{m}
+	if !readThreadMessages(w, "messages", messages) {
+		return
+	}
+	ok, err := threads.appendMessages(owner, id, messages...)
+	if !ok {
+		writeThreadNotFound(w, id)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to store thread %s: %v", id, err)
+		writeAPIError(w, http.StatusInternalServerError, "server_error", "Failed to store the message")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages[0])
+}
+
+// runThread completes a thread's conversation. The body holds chat
+// completion parameters, and the new messages of the turn as messages, or as
+// content for a single user message. The history is put before them and the
+// request is served by the chat completions handler; the response is the
+// chat completion, streamed or not.
+func runThread(w http.ResponseWriter, r *http.Request, owner, id string) {
+	body, _ := io.ReadAll(r.Body)
+	var params map[string]any
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &params); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON: "+err.Error())
+			return
+		}
+	}
+	if params == nil {
+		params = make(map[string]any)
+	}
+	var turn struct {
+		Content  json.RawMessage `json:"content"`
+		Messages []threadMessage `json:"messages"`
+	}
+	json.Unmarshal(body, &turn)
+	if len(turn.Content) > 0 {
+		turn.Messages = append(turn.Messages, threadMessage{Role: "user", Content: turn.Content})
+	}
+	if !readThreadMessages(w, "messages", turn.Messages) {
+		return
+	}
+	delete(params, "content")
+
+	v, ok, err := threads.startRun(owner, id)
+	if !ok {
+		writeThreadNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, "invalid_request_error", fmt.Sprintf("Thread %s already has a run in progress. Try again once it is over.", id))
+		return
+	}
+	defer threads.endRun(id)
+	if _, ok := params["model"]; !ok && v.Model != "" {
+		params["model"] = v.Model
+	}
+	messages := make([]any, 0, len(v.Messages)+len(turn.Messages))
+	for _, m := range append(v.Messages, turn.Messages...) {
+		messages = append(messages, m.chatMessage())
+	}
+	params["messages"] = messages
+	chatBody, err := json.Marshal(params)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	run := &threadRun{owner: owner, threadID: id, pending: turn.Messages}
+	chatR := r.Clone(context.WithValue(r.Context(), threadRunContextKey{}, run))
+	chatR.URL.Path = "/v1/chat/completions"
+	chatR.URL.RawPath = ""
+	chatR.Body = io.NopCloser(bytes.NewReader(chatBody))
+	chatR.ContentLength = int64(len(chatBody))
+	// Cache hits are not published, so the answer would not be stored
+	chatR.Header.Set("Cache-Control", "no-store")
+	w.Header().Set("X-Copilot-Proxy-Thread", id)
+	log.Printf("Running thread %s with %d messages", id, len(messages))
+	instrument(handleGitHubProxy)(w, chatR)
+}
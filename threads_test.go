@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// threadRequest calls the threads API as the caller with token.
+func threadRequest(t *testing.T, token, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	tokenCache.Set(token, CopilotToken{Token: "ct", Expiry: time.Now().Add(time.Hour).Unix()})
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handleThreads(w, r)
+	return w
+}
+
+func TestThreadOwners(t *testing.T) {
+	config = &Config{Threads: threadsConfig{Dir: t.TempDir()}}
+	defer func() { config = &Config{} }()
+
+	w := threadRequest(t, "alice", "POST", "/v1/threads", `{"messages":[{"content":"hello"}]}`)
+	var created threadView
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.ID == "" {
+		t.Fatalf("create answered %d %s", w.Code, w.Body)
+	}
+	path := "/v1/threads/" + created.ID
+
+	cases := []struct {
+		method, path, body string
+	}{
+		{"GET", path, ""},
+		{"GET", path + "/messages", ""},
+		{"POST", path + "/messages", `{"content":"hi"}`},
+		{"POST", path + "/runs", `{"content":"hi"}`},
+		{"DELETE", path, ""},
+	}
+	for _, c := range cases {
+		if w := threadRequest(t, "bob", c.method, c.path, c.body); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s by another key answered %d", c.method, c.path, w.Code)
+		}
+	}
+	if w := threadRequest(t, "bob", "GET", "/v1/threads", ""); strings.Contains(w.Body.String(), created.ID) {
+		t.Errorf("another key lists the thread: %s", w.Body)
+	}
+
+	if w := threadRequest(t, "alice", "GET", path, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "hello") {
+		t.Errorf("owner got %d %s", w.Code, w.Body)
+	}
+	if w := threadRequest(t, "alice", "GET", "/v1/threads", ""); !strings.Contains(w.Body.String(), created.ID) {
+		t.Errorf("owner's list misses the thread: %s", w.Body)
+	}
+	if w := threadRequest(t, "alice", "DELETE", path, ""); w.Code != http.StatusOK {
+		t.Errorf("owner's delete answered %d", w.Code)
+	}
+}
+
+func TestThreadsNeedDir(t *testing.T) {
+	config = &Config{}
+	if w := threadRequest(t, "alice", "POST", "/v1/threads", ""); w.Code != http.StatusNotFound {
+		t.Errorf("create without a directory answered %d", w.Code)
+	}
+}
+
+func TestStoreThreadRun(t *testing.T) {
+	config = &Config{Threads: threadsConfig{Dir: t.TempDir()}}
+	defer func() { config = &Config{} }()
+	owner := callerKeyID(callerRequest("alice"))
+	th := &thread{ID: newThreadID("thread_"), Owner: owner, Messages: []threadMessage{}}
+	if err := threads.create(th); err != nil {
+		t.Fatal(err)
+	}
+
+	question := threadMessage{ID: "msg_1", Role: "user", Content: json.RawMessage(`"weather in Paris?"`)}
+	run := &threadRun{owner: owner, threadID: th.ID, pending: []threadMessage{question}}
+	r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	r = r.WithContext(context.WithValue(r.Context(), threadRunContextKey{}, run))
+	calls := []unstream.OAIToolCall{{Id: "call_1", Type: "function", Function: unstream.OAIToolCallFunction{Name: "weather", Arguments: `{"city":"Paris"}`}}}
+	storeThreadRun(&completionSummary{r: r, Response: &unstream.OAIChatResponse{
+		Choices: []unstream.OAIChatChoice{{FinishReason: "tool_calls", Message: unstream.OAIChatMessage{Role: "assistant", ToolCalls: calls}}},
+	}})
+	// Requests outside of runs are not stored
+	storeThreadRun(&completionSummary{r: httptest.NewRequest("POST", "/v1/chat/completions", nil), Response: &unstream.OAIChatResponse{
+		Choices: []unstream.OAIChatChoice{{Message: unstream.OAIChatMessage{Role: "assistant", Content: new(string)}}},
+	}})
+
+	v, _ := threads.view(owner, th.ID, true)
+	if len(v.Messages) != 2 {
+		t.Fatalf("thread has %d messages, want 2", len(v.Messages))
+	}
+	answer := v.Messages[1]
+	if v.Messages[0].ID != "msg_1" || answer.Role != "assistant" || len(answer.ToolCalls) != 1 || answer.ToolCalls[0].Function != calls[0].Function {
+		t.Errorf("stored %+v", v.Messages)
+	}
+	sent := answer.chatMessage()
+	if tc, _ := sent["tool_calls"].([]map[string]any); len(tc) != 1 || tc[0]["id"] != "call_1" {
+		t.Errorf("answer sent back as %v", sent)
+	}
+}
+
+func TestThreadRunBrokenStream(t *testing.T) {
+	config = &Config{Threads: threadsConfig{Dir: t.TempDir()}}
+	defer func() { config = &Config{} }()
+	owner := callerKeyID(callerRequest("alice"))
+	th := &thread{ID: newThreadID("thread_"), Owner: owner, Messages: []threadMessage{}}
+	if err := threads.create(th); err != nil {
+		t.Fatal(err)
+	}
+	question := threadMessage{ID: "msg_1", Role: "user", Content: json.RawMessage(`"weather in Paris?"`)}
+	run := &threadRun{owner: owner, threadID: th.ID, pending: []threadMessage{question}}
+	r := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	r = r.WithContext(context.WithValue(r.Context(), threadRunContextKey{}, run))
+	cr := newChatRequest(r, "ct", []byte(`{"model":"gpt-4o","stream":true}`))
+
+	truncated := "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"It is sun\"}}]}\n\n"
+	finished := truncated + "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n"
+	tee := func(body string) {
+		final, complete := teeStream(httptest.NewRecorder(), cr, upstreamStream(body))
+		publishStream(cr, final, complete)
+	}
+	relay := func(body string) {
+		relayStream(httptest.NewRecorder(), cr, upstreamStream(body))
+	}
+	cases := []struct {
+		name     string
+		serve    func(string)
+		body     string
+		messages int
+	}{
+		{"teed, broken off", tee, truncated, 0},
+		{"relayed, broken off", relay, truncated, 0},
+		{"relayed, error", relay, truncated + "event: error\ndata: {\"message\":\"overloaded\"}\n\n", 0},
+		{"teed, finished", tee, finished, 2},
+	}
+	for _, c := range cases {
+		c.serve(c.body)
+		if v, _ := threads.view(owner, th.ID, true); len(v.Messages) != c.messages {
+			t.Errorf("%s: thread has %d messages, want %d", c.name, len(v.Messages), c.messages)
+		}
+	}
+}
+
+// upstreamStream is a streamed upstream response with body.
+func upstreamStream(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestThreadRunsOneAtATime(t *testing.T) {
+	config = &Config{Threads: threadsConfig{Dir: t.TempDir()}}
+	defer func() { config = &Config{} }()
+	w := threadRequest(t, "alice", "POST", "/v1/threads", "")
+	var created threadView
+	json.Unmarshal(w.Body.Bytes(), &created)
+	owner := callerKeyID(callerRequest("alice"))
+
+	if _, ok, err := threads.startRun(owner, created.ID); !ok || err != nil {
+		t.Fatalf("startRun = %v, %v", ok, err)
+	}
+	if _, ok, err := threads.startRun(owner, created.ID); !ok || err != errThreadBusy {
+		t.Errorf("second startRun = %v, %v", ok, err)
+	}
+	if w := threadRequest(t, "alice", "POST", "/v1/threads/"+created.ID+"/runs", `{"content":"hi"}`); w.Code != http.StatusConflict {
+		t.Errorf("run during a run answered %d", w.Code)
+	}
+	threads.endRun(created.ID)
+	if _, ok, err := threads.startRun(owner, created.ID); !ok || err != nil {
+		t.Errorf("startRun after endRun = %v, %v", ok, err)
+	}
+	threads.endRun(created.ID)
+}
@@ -0,0 +1,262 @@
+// Package tokenizer counts tokens the way OpenAI models do. Encodings are
+// byte pair encodings loaded from tiktoken rank files (cl100k_base.tiktoken,
+// o200k_base.tiktoken), split into pieces first with the patterns of those
+// encodings. Text for models whose encoding is not available can be counted
+// with Approximate instead.
+package tokenizer
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The split patterns of tiktoken, without the \s+(?!\S) alternative that RE2
+// cannot express. It is applied by hand in split.
+var (
+	cl100kPattern = compilePattern(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+	o200kPattern  = compilePattern(strings.Join([]string{
+		`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?`,
+		`[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?`,
+		`\p{N}{1,3}`,
+		` ?[^\s\p{L}\p{N}]+[\r\n/]*`,
+		`\s*[\r\n]+`,
+		`\s+`,
+	}, "|"))
+)
+
+// compilePattern compiles a split pattern with \s meaning Unicode white
+// space, as in tiktoken, rather than ASCII white space as in RE2.
+func compilePattern(p string) *regexp.Regexp {
+	const space = `\t\n\v\f\r\x{85}\p{Z}`
+	p = strings.ReplaceAll(p, `[^\s`, `[^`+space)
+	p = strings.ReplaceAll(p, `\s`, `[`+space+`]`)
+	return regexp.MustCompile(p)
+}
+
+// Names of the encodings the package knows the split pattern of.
+const (
+	CL100K = "cl100k_base"
+	O200K  = "o200k_base"
+)
+
+// Encoding is a loaded byte pair encoding.
+type Encoding struct {
+	Name    string
+	pattern *regexp.Regexp
+	ranks   map[string]int
+}
+
+// Load reads an encoding from a tiktoken rank file: one base64 token and its
+// rank per line.
+func Load(name string, r io.Reader) (*Encoding, error) {
+	var pattern *regexp.Regexp
+	switch name {
+	case CL100K:
+		pattern = cl100kPattern
+	case O200K:
+		pattern = o200kPattern
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		token, rank, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid rank line %q", line)
+		}
+		b, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token %q: %w", token, err)
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rank %q: %w", rank, err)
+		}
+		ranks[string(b)] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &Encoding{Name: name, pattern: pattern, ranks: ranks}, nil
+}
+
+// Encode returns the token ids of text. Special tokens are encoded as text.
+func (e *Encoding) Encode(text string) []int {
+	var ids []int
+	for _, piece := range split(e.pattern, text) {
+		if rank, ok := e.ranks[piece]; ok {
+			ids = append(ids, rank)
+			continue
+		}
+		ids = append(ids, e.bytePairEncode(piece)...)
+	}
+	return ids
+}
+
+// Count returns the number of tokens of text.
+func (e *Encoding) Count(text string) int {
+	n := 0
+	for _, piece := range split(e.pattern, text) {
+		if _, ok := e.ranks[piece]; ok {
+			n++
+			continue
+		}
+		n += len(e.bytePairEncode(piece))
+	}
+	return n
+}
+
+// bytePairEncode merges the bytes of a piece, lowest ranked pair first and
+// leftmost first among equal ranks, as tiktoken does. The tokens form a linked
+// list and the pairs wait in a heap, so that long pieces, such as runs of
+// base64, take O(n log n) rather than quadratic time.
+func (e *Encoding) bytePairEncode(piece string) []int {
+	n := len(piece)
+	// Tokens are identified by their start offset. next[i] is the start of
+	// the token after the one at i, or n; prev[i] the start of the one before,
+	// or -1. Merged tokens are dropped from the list.
+	next := make([]int, n)
+	prev := make([]int, n)
+	for i := range n {
+		next[i], prev[i] = i+1, i-1
+	}
+	live := make([]bool, n)
+	for i := range live {
+		live[i] = true
+	}
+	var pairs pairHeap
+	push := func(i int) {
+		if i < 0 || next[i] >= n {
+			return
+		}
+		j := next[i]
+		if r, ok := e.ranks[piece[i:next[j]]]; ok {
+			heap.Push(&pairs, pair{rank: r, start: i, mid: j, end: next[j]})
+		}
+	}
+	for i := range n {
+		push(i)
+	}
+	for pairs.Len() > 0 {
+		p := heap.Pop(&pairs).(pair)
+		// Pairs that a merge changed are stale
+		if !live[p.start] || !live[p.mid] || next[p.start] != p.mid || next[p.mid] != p.end {
+			continue
+		}
+		live[p.mid] = false
+		next[p.start] = p.end
+		if p.end < n {
+			prev[p.end] = p.start
+		}
+		push(prev[p.start])
+		push(p.start)
+	}
+
+	var ids []int
+	for i := 0; i < n; i = next[i] {
+		if r, ok := e.ranks[piece[i:next[i]]]; ok {
+			ids = append(ids, r)
+		} else {
+			// Complete rank files have every byte, so this only happens
+			// with partial ones
+			ids = append(ids, -1)
+		}
+	}
+	return ids
+}
+
+// pair is two neighbouring tokens that could be merged.
+type pair struct {
+	rank            int
+	start, mid, end int
+}
+
+// pairHeap orders pairs by rank, then position.
+type pairHeap []pair
+
+func (h pairHeap) Len() int { return len(h) }
+func (h pairHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].start < h[j].start
+}
+func (h pairHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *pairHeap) Push(x any)   { *h = append(*h, x.(pair)) }
+func (h *pairHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// split cuts text into the pieces the encoding merges separately. A run of
+// whitespace followed by other text leaves its last character to the next
+// piece, as \s+(?!\S) does in tiktoken's patterns.
+func split(pattern *regexp.Regexp, text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		loc := pattern.FindStringIndex(text)
+		if loc == nil {
+			pieces = append(pieces, text)
+			break
+		}
+		end := loc[1]
+		piece := text[loc[0]:end]
+		// Runs ending in a line break are matched by \s*[\r\n]+ instead
+		if end < len(text) && isSpaceRun(piece) && utf8.RuneCountInString(piece) > 1 && !strings.HasSuffix(piece, "\n") && !strings.HasSuffix(piece, "\r") {
+			if r, _ := utf8.DecodeRuneInString(text[end:]); !unicode.IsSpace(r) {
+				_, size := utf8.DecodeLastRuneInString(piece)
+				end -= size
+				piece = piece[:len(piece)-size]
+			}
+		}
+		if loc[0] > 0 {
+			pieces = append(pieces, text[:loc[0]])
+		}
+		pieces = append(pieces, piece)
+		text = text[end:]
+	}
+	return pieces
+}
+
+func isSpaceRun(s string) bool {
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Approximate estimates the tokens of text for models without a known
+// encoding: text is split as cl100k splits it, and each piece counts one
+// token per four ASCII bytes, rounded up, plus one per other character.
+func Approximate(text string) int {
+	n := 0
+	for _, piece := range split(cl100kPattern, text) {
+		ascii, other := 0, 0
+		for _, r := range piece {
+			if r < utf8.RuneSelf {
+				ascii++
+			} else {
+				other++
+			}
+		}
+		n += (ascii+3)/4 + other
+	}
+	return n
+}
@@ -0,0 +1,185 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		pattern string
+		text    string
+		want    []string
+	}{
+		{CL100K, "Hello world", []string{"Hello", " world"}},
+		{CL100K, "  hello", []string{" ", " hello"}},
+		{CL100K, "I'm here", []string{"I", "'m", " here"}},
+		{CL100K, "12345", []string{"123", "45"}},
+		{CL100K, "hello\n\nworld", []string{"hello", "\n\n", "world"}},
+		{CL100K, "a  ", []string{"a", "  "}},
+		{CL100K, "x\n  y", []string{"x", "\n", " ", " y"}},
+		{CL100K, "if (a) {", []string{"if", " (", "a", ")", " {"}},
+		{CL100K, "HelloWorld", []string{"HelloWorld"}},
+		{CL100K, "a  b", []string{"a", " ", " b"}},
+		{O200K, "HelloWorld", []string{"Hello", "World"}},
+		{O200K, "I'm here", []string{"I'm", " here"}},
+		{O200K, "path/to\n", []string{"path", "/to", "\n"}},
+	}
+	for _, c := range cases {
+		pattern := cl100kPattern
+		if c.pattern == O200K {
+			pattern = o200kPattern
+		}
+		if got := split(pattern, c.text); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s split(%q) = %q, want %q", c.pattern, c.text, got, c.want)
+		}
+	}
+}
+
+func TestSplitCoversText(t *testing.T) {
+	text := "func main() {\n\tfmt.Println(\"héllo, 世界\")   \r\n}\n\n  // done 2024-01-01  "
+	for _, pattern := range []string{CL100K, O200K} {
+		enc := &Encoding{Name: pattern, pattern: cl100kPattern}
+		if pattern == O200K {
+			enc.pattern = o200kPattern
+		}
+		if got := strings.Join(split(enc.pattern, text), ""); got != text {
+			t.Errorf("%s pieces join to %q", pattern, got)
+		}
+	}
+}
+
+func rankFile(tokens ...string) string {
+	var b strings.Builder
+	for i, tok := range tokens {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(tok)), i)
+	}
+	return b.String()
+}
+
+func TestEncode(t *testing.T) {
+	enc, err := Load(CL100K, strings.NewReader(rankFile("a", "b", "c", " ", "ab", "bc", "abc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		text string
+		want []int
+	}{
+		{"abc", []int{6}},
+		// ab merges first, at both ends, then abc
+		{"abcab", []int{6, 4}},
+		{"cab bc", []int{2, 4, 3, 5}},
+	}
+	for _, c := range cases {
+		if got := enc.Encode(c.text); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Encode(%q) = %v, want %v", c.text, got, c.want)
+		}
+		if got := enc.Count(c.text); got != len(c.want) {
+			t.Errorf("Count(%q) = %d, want %d", c.text, got, len(c.want))
+		}
+	}
+}
+
+// naiveBytePairEncode is the straightforward quadratic merge, as tiktoken
+// writes it, to check bytePairEncode against.
+func naiveBytePairEncode(e *Encoding, piece string) []int {
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+	for len(parts) > 2 {
+		best, at := -1, -1
+		for i := 0; i < len(parts)-2; i++ {
+			if r, ok := e.ranks[piece[parts[i]:parts[i+2]]]; ok && (best < 0 || r < best) {
+				best, at = r, i
+			}
+		}
+		if at < 0 {
+			break
+		}
+		parts = append(parts[:at+1], parts[at+2:]...)
+	}
+	var ids []int
+	for i := 0; i < len(parts)-1; i++ {
+		if r, ok := e.ranks[piece[parts[i]:parts[i+1]]]; ok {
+			ids = append(ids, r)
+		} else {
+			ids = append(ids, -1)
+		}
+	}
+	return ids
+}
+
+func TestBytePairEncodeMatchesNaive(t *testing.T) {
+	enc, err := Load(CL100K, strings.NewReader(rankFile("a", "b", "c", "aa", "ab", "ba", "bc", "aaa", "abc", "bab", "aab", "cab", "abab")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for range 2000 {
+		b := make([]byte, 1+rng.Intn(40))
+		for i := range b {
+			b[i] = "abcd"[rng.Intn(4)]
+		}
+		piece := string(b)
+		if got, want := enc.bytePairEncode(piece), naiveBytePairEncode(enc, piece); !reflect.DeepEqual(got, want) {
+			t.Fatalf("bytePairEncode(%q) = %v, want %v", piece, got, want)
+		}
+	}
+}
+
+func BenchmarkBytePairEncodeLongPiece(b *testing.B) {
+	tokens := []string{}
+	for c := 'a'; c <= 'z'; c++ {
+		tokens = append(tokens, string(c))
+	}
+	for c1 := 'a'; c1 <= 'z'; c1++ {
+		for c2 := 'a'; c2 <= 'z'; c2 += 3 {
+			tokens = append(tokens, string(c1)+string(c2))
+		}
+	}
+	enc, err := Load(CL100K, strings.NewReader(rankFile(tokens...)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	piece := make([]byte, 100_000)
+	for i := range piece {
+		piece[i] = byte('a' + rng.Intn(26))
+	}
+	b.ResetTimer()
+	for range b.N {
+		enc.Count(string(piece))
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	if _, err := Load("p50k_base", strings.NewReader("")); err == nil {
+		t.Error("unknown encoding loaded")
+	}
+	if _, err := Load(CL100K, strings.NewReader("YQ== x\n")); err == nil {
+		t.Error("invalid rank accepted")
+	}
+}
+
+func TestApproximate(t *testing.T) {
+	cases := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"Hello world", 4},
+		{"supercalifragilistic", 5},
+		{"世界", 2},
+	}
+	for _, c := range cases {
+		if got := Approximate(c.text); got != c.want {
+			t.Errorf("Approximate(%q) = %d, want %d", c.text, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"copilot-proxy/tokenizer"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prompts are counted locally, with the tokenizer of the model where its
+// encoding is known and approximately otherwise. Counts are served at
+// /v1/tokenize and /v1/messages/count_tokens, and chat requests that would
+// not fit the model's context window are refused before they are sent.
+
+type tokenizerConfig struct {
+	// Dir holds the tiktoken rank files, cl100k_base.tiktoken and
+	// o200k_base.tiktoken. Without them every count is approximate.
+	Dir string `json:"dir"`
+	// Preflight is what is done with chat requests too long for the model:
+	// "reject" (the default), "flag" or "off".
+	Preflight string `json:"preflight"`
+}
+
+// encodingPrefixes guess the encoding of models by name, when neither the
+// config nor the catalog names it. The first matching prefix wins.
+var encodingPrefixes = []struct{ prefix, encoding string }{
+	{"gpt-4o", tokenizer.O200K},
+	{"gpt-4.1", tokenizer.O200K},
+	{"gpt-4.5", tokenizer.O200K},
+	{"gpt-5", tokenizer.O200K},
+	{"o1", tokenizer.O200K},
+	{"o3", tokenizer.O200K},
+	{"o4", tokenizer.O200K},
+	{"gpt-4", tokenizer.CL100K},
+	{"gpt-3.5", tokenizer.CL100K},
+	{"text-embedding-", tokenizer.CL100K},
+}
+
+// encodingName returns the encoding of a model: the one set in its
+// capabilities, the one the catalog lists, or a guess from its name. Copilot
+// measures its prompt limits with the tokenizer it lists, for models of other
+// vendors too. It returns "" when the encoding is unknown.
+func encodingName(model, listed string) string {
+	if name := lookupCapabilities(model).Tokenizer; name != "" {
+		return name
+	}
+	if listed == tokenizer.CL100K || listed == tokenizer.O200K {
+		return listed
+	}
+	for _, p := range encodingPrefixes {
+		if strings.HasPrefix(model, p.prefix) {
+			return p.encoding
+		}
+	}
+	return ""
+}
+
+var encodings = struct {
+	sync.Mutex
+	config *Config
+	loaded map[string]*tokenizer.Encoding // nil for files that failed to load
+}{}
+
+// loadEncoding returns an encoding from the rank files of the config, or nil
+// when it is not available. Files are read once per config.
+func loadEncoding(name string) *tokenizer.Encoding {
+	if name == "" || config.Tokenizer.Dir == "" {
+		return nil
+	}
+	encodings.Lock()
+	defer encodings.Unlock()
+	if encodings.config != config {
+		encodings.config, encodings.loaded = config, make(map[string]*tokenizer.Encoding)
+	}
+	if enc, ok := encodings.loaded[name]; ok {
+		return enc
+	}
+	path := filepath.Join(config.Tokenizer.Dir, name+".tiktoken")
+	f, err := os.Open(path)
+	if err == nil {
+		defer f.Close()
+		var enc *tokenizer.Encoding
+		if enc, err = tokenizer.Load(name, f); err == nil {
+			log.Printf("Loaded encoding %s from %s", name, path)
+			encodings.loaded[name] = enc
+			return enc
+		}
+	}
+	log.Printf("Counting tokens approximately, encoding %s not available: %v", name, err)
+	encodings.loaded[name] = nil
+	return nil
+}
+
+// tokenCounter counts tokens with an encoding, or approximately without one.
+type tokenCounter struct {
+	enc *tokenizer.Encoding
+}
+
+func newTokenCounter(model, listed string) tokenCounter {
+	return tokenCounter{enc: loadEncoding(encodingName(model, listed))}
+}
+
+func (c tokenCounter) count(text string) int {
+	if c.enc == nil {
+		return tokenizer.Approximate(text)
+	}
+	return c.enc.Count(text)
+}
+
+func (c tokenCounter) approximate() bool {
+	return c.enc == nil
+}
+
+// encoding names the encoding counts are made with.
+func (c tokenCounter) encoding() string {
+	if c.enc == nil {
+		return "approximate"
+	}
+	return c.enc.Name
+}
+
+// countJSON counts a value as its JSON text.
+func (c tokenCounter) countJSON(v any) int {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return c.count(string(b))
+}
+
+// OpenAI's chat format adds tokens around every message and primes the reply.
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+)
+
+// imageTokens is the cost of an image input. Without its size only the
+// detail level is known: low detail images cost a fixed 85 tokens, others
+// are counted as four 512px tiles.
+func imageTokens(detail string) int {
+	if detail == "low" {
+		return 85
+	}
+	return 85 + 4*170
+}
+
+// promptCount is the size of a prompt.
+type promptCount struct {
+	Messages    int
+	Tools       int
+	Encoding    string
+	Approximate bool
+}
+
+func (p promptCount) total() int {
+	return p.Messages + p.Tools
+}
+
+// format gives a count, marked with ~ when it is approximate.
+func (p promptCount) format() string {
+	if p.Approximate {
+		return "~" + strconv.Itoa(p.total())
+	}
+	return strconv.Itoa(p.total())
+}
+
+// countChatPrompt counts the prompt of a chat completion body.
+func countChatPrompt(c tokenCounter, m map[string]any) promptCount {
+	p := promptCount{Encoding: c.encoding(), Approximate: c.approximate()}
+	messages, _ := m["messages"].([]any)
+	for _, msg := range messages {
+		p.Messages += tokensPerMessage + c.countChatMessage(msg)
+	}
+	if len(messages) > 0 {
+		p.Messages += tokensPerReply
+	}
+	if tools, ok := m["tools"].([]any); ok && len(tools) > 0 {
+		p.Tools = c.countJSON(tools)
+	} else if functions, ok := m["functions"].([]any); ok && len(functions) > 0 {
+		p.Tools = c.countJSON(functions)
+	}
+	return p
+}
+
+func (c tokenCounter) countChatMessage(msg any) int {
+	m, _ := msg.(map[string]any)
+	n := 0
+	if role, ok := m["role"].(string); ok {
+		n += c.count(role)
+	}
+	if name, ok := m["name"].(string); ok {
+		n += tokensPerName + c.count(name)
+	}
+	switch content := m["content"].(type) {
+	case string:
+		n += c.count(content)
+	case []any:
+		for _, part := range content {
+			p, _ := part.(map[string]any)
+			switch p["type"] {
+			case "text":
+				text, _ := p["text"].(string)
+				n += c.count(text)
+			case "refusal":
+				text, _ := p["refusal"].(string)
+				n += c.count(text)
+			case "image_url":
+				image, _ := p["image_url"].(map[string]any)
+				detail, _ := image["detail"].(string)
+				n += imageTokens(detail)
+			}
+		}
+	}
+	calls, _ := m["tool_calls"].([]any)
+	for _, call := range calls {
+		fn, _ := call.(map[string]any)["function"].(map[string]any)
+		name, _ := fn["name"].(string)
+		args, _ := fn["arguments"].(string)
+		n += c.count(name) + c.count(args)
+	}
+	return n
+}
+
+// countAnthropicPrompt counts the prompt of an Anthropic messages body.
+func countAnthropicPrompt(c tokenCounter, m map[string]any) promptCount {
+	p := promptCount{Encoding: c.encoding(), Approximate: c.approximate()}
+	if system, ok := m["system"]; ok {
+		p.Messages += c.countAnthropicContent(system)
+	}
+	messages, _ := m["messages"].([]any)
+	for _, msg := range messages {
+		mm, _ := msg.(map[string]any)
+		role, _ := mm["role"].(string)
+		p.Messages += tokensPerMessage + c.count(role) + c.countAnthropicContent(mm["content"])
+	}
+	if tools, ok := m["tools"].([]any); ok && len(tools) > 0 {
+		p.Tools = c.countJSON(tools)
+	}
+	return p
+}
+
+// countAnthropicContent counts a string or a list of content blocks.
+func (c tokenCounter) countAnthropicContent(content any) int {
+	switch content := content.(type) {
+	case string:
+		return c.count(content)
+	case []any:
+		n := 0
+		for _, block := range content {
+			b, _ := block.(map[string]any)
+			switch b["type"] {
+			case "text":
+				text, _ := b["text"].(string)
+				n += c.count(text)
+			case "image":
+				n += imageTokens("")
+			case "tool_use":
+				name, _ := b["name"].(string)
+				n += c.count(name) + c.countJSON(b["input"])
+			case "tool_result":
+				n += c.countAnthropicContent(b["content"])
+			}
+		}
+		return n
+	}
+	return 0
+}
+
+// modelLimits returns the catalog entry of a model, or nil when it is not
+// listed or the catalog cannot be fetched.
+func modelLimits(r *http.Request, token, model string) *catalogExtension {
+	m, err := catalog.lookup(r, token, model)
+	if err != nil {
+		log.Printf("Cannot look up the limits of %s: %v", model, err)
+		return nil
+	}
+	if m == nil {
+		return nil
+	}
+	return m.catalogExtension
+}
+
+// tokenizeRequest is the body of /v1/tokenize: text as input, or a chat
+// prompt as messages and tools.
+type tokenizeRequest struct {
+	Model    string          `json:"model"`
+	Input    json.RawMessage `json:"input"`
+	Messages []any           `json:"messages"`
+	Tools    []any           `json:"tools"`
+}
+
+// handleTokenize serves /v1/tokenize. Single string inputs are also given as
+// token ids when they are counted exactly.
+func handleTokenize(w http.ResponseWriter, r *http.Request) {
+	ct, ok := copilotToken(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Use POST")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var req tokenizeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON: "+err.Error())
+		return
+	}
+	if req.Model == "" {
+		writeParamError(w, http.StatusBadRequest, "invalid_request_error", "model", "missing_required_parameter",
+			"Missing required parameter: 'model'.")
+		return
+	}
+	var inputs []string
+	var single string
+	if len(req.Input) > 0 {
+		if json.Unmarshal(req.Input, &single) == nil {
+			inputs = []string{single}
+		} else if json.Unmarshal(req.Input, &inputs) != nil {
+			writeParamError(w, http.StatusBadRequest, "invalid_request_error", "input", "invalid_value",
+				"input must be a string or an array of strings")
+			return
+		}
+	} else if len(req.Messages) == 0 {
+		writeParamError(w, http.StatusBadRequest, "invalid_request_error", "input", "missing_required_parameter",
+			"Either input or messages is required")
+		return
+	}
+
+	limits := modelLimits(r, ct.Token, req.Model)
+	listed := ""
+	if limits != nil {
+		listed = limits.Tokenizer
+	}
+	c := newTokenCounter(req.Model, listed)
+	var p promptCount
+	if inputs != nil {
+		p = promptCount{Encoding: c.encoding(), Approximate: c.approximate()}
+		for _, s := range inputs {
+			p.Messages += c.count(s)
+		}
+	} else {
+		p = countChatPrompt(c, map[string]any{"messages": req.Messages, "tools": req.Tools})
+	}
+
+	resp := map[string]any{
+		"object":        "tokenize",
+		"model":         req.Model,
+		"encoding":      p.Encoding,
+		"approximate":   p.Approximate,
+		"token_count":   p.total(),
+		"message_count": p.Messages,
+		"tool_count":    p.Tools,
+	}
+	if len(inputs) == 1 && len(req.Input) > 0 && req.Input[0] == '"' && c.enc != nil {
+		resp["tokens"] = c.enc.Encode(single)
+	}
+	if limits != nil {
+		if limits.ContextWindow > 0 {
+			resp["context_window"] = limits.ContextWindow
+		}
+		if limits.MaxPromptTokens > 0 {
+			resp["max_prompt_tokens"] = limits.MaxPromptTokens
+		}
+		if limit := promptLimit(limits); limit > 0 {
+			resp["fits"] = p.total() <= limit
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleCountTokens serves /v1/messages/count_tokens in Anthropic's shape.
+func handleCountTokens(w http.ResponseWriter, r *http.Request) {
+	ct, ok := copilotToken(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Use POST")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var m map[string]any
+	if err := json.Unmarshal(body, &m); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Invalid JSON: "+err.Error())
+		return
+	}
+	model, _ := m["model"].(string)
+	if model == "" {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "model: Field required")
+		return
+	}
+	if _, ok := m["messages"].([]any); !ok {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "messages: Field required")
+		return
+	}
+	listed := ""
+	if limits := modelLimits(r, ct.Token, model); limits != nil {
+		listed = limits.Tokenizer
+	}
+	p := countAnthropicPrompt(newTokenCounter(model, listed), m)
+	w.Header().Set("X-Copilot-Proxy-Prompt-Tokens", p.format())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"input_tokens": p.total()})
+}
+
+// writeAnthropicError writes an error in the shape of Anthropic's API.
+func writeAnthropicError(w http.ResponseWriter, status int, errType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	})
+}
+
+// promptLimit returns the most prompt tokens a model takes, 0 when unknown.
+func promptLimit(limits *catalogExtension) int {
+	if limits.MaxPromptTokens > 0 && (limits.ContextWindow == 0 || limits.MaxPromptTokens < limits.ContextWindow) {
+		return limits.MaxPromptTokens
+	}
+	return limits.ContextWindow
+}
+
+// requestedCompletion returns the completion tokens a chat body asks for, 0
+// when it does not say.
+func requestedCompletion(m map[string]any) int {
+	for _, name := range []string{"max_completion_tokens", "max_tokens"} {
+		if n, ok := m[name].(float64); ok && n > 0 {
+			return int(n)
+		}
+	}
+	return 0
+}
+
+// contextOverflow describes how a prompt exceeds a model's limits, or returns
+// "" when it fits.
+func contextOverflow(p promptCount, completion int, limits *catalogExtension) string {
+	parts := fmt.Sprintf("%d in the messages, %d in the functions", p.Messages, p.Tools)
+	if limit := promptLimit(limits); limit > 0 && p.total() > limit {
+		return fmt.Sprintf("This model's maximum prompt length is %d tokens. However, your messages resulted in %d tokens (%s). Please reduce the length of the messages or functions.",
+			limit, p.total(), parts)
+	}
+	if limits.ContextWindow > 0 && completion > 0 && p.total()+completion > limits.ContextWindow {
+		return fmt.Sprintf("This model's maximum context length is %d tokens. However, you requested %d tokens (%s, and %d in the completion). Please reduce the length of the messages, functions or completion.",
+			limits.ContextWindow, p.total()+completion, parts, completion)
+	}
+	return ""
+}
+
+// approximateSlack is how many times over a limit an approximate prompt count
+// has to be before the request is refused: Approximate can overestimate
+// English text about twice.
+const approximateSlack = 3
+
+// clearlyOverflows reports whether an approximate count exceeds the model's
+// limits even allowing for the error of the estimate.
+func clearlyOverflows(p promptCount, completion int, limits *catalogExtension) bool {
+	prompt := p.total() / approximateSlack
+	if limit := promptLimit(limits); limit > 0 && prompt > limit {
+		return true
+	}
+	return limits.ContextWindow > 0 && completion > 0 && prompt+completion > limits.ContextWindow
+}
+
+// preflightContext counts the prompt of a chat request and checks it against
+// the context window of the model it is sent to. Prompts that do not fit are
+// shortened when context management is on, see contextwindow.go. Requests
+// that still do not fit are refused with the counts, unless the config only
+// flags them or the count is approximate and within approximateSlack of the
+// limits; flagged requests carry X-Copilot-Proxy-Context-Warning. It writes an
+// error and returns false when the request is refused.
+func preflightContext(w http.ResponseWriter, cr *chatRequest) bool {
+	mode := config.Tokenizer.Preflight
+	if mode == "off" && !config.ContextWindow.Enabled {
+		return true
+	}
+	limits := modelLimits(cr.r, cr.token, cr.Model)
+	if limits == nil {
+		return true
+	}
+	m, err := cr.bodyMap()
+	if err != nil {
+		return true
+	}
+	counter := newTokenCounter(cr.Model, limits.Tokenizer)
+	p := countChatPrompt(counter, m)
+	completion := requestedCompletion(m)
+	overflow := contextOverflow(p, completion, limits)
+	if overflow != "" && config.ContextWindow.Enabled {
+		if applied := fitContext(cr, counter, m, p, promptBudget(limits, completion)); len(applied) > 0 {
+			if body, err := json.Marshal(m); err == nil {
+				cr.body = body
+				p = countChatPrompt(counter, m)
+				overflow = contextOverflow(p, completion, limits)
+				w.Header().Set("X-Copilot-Proxy-Context-Strategy", strings.Join(applied, ","))
+				log.Printf("Shortened the prompt for %s to %s tokens with %s", cr.Model, p.format(), strings.Join(applied, ", "))
+			}
+		}
+	}
+	w.Header().Set("X-Copilot-Proxy-Prompt-Tokens", p.format())
+	if overflow == "" || mode == "off" {
+		return true
+	}
+	if mode == "flag" || p.Approximate && !clearlyOverflows(p, completion, limits) {
+		log.Printf("Request for %s may not fit its context window: %s", cr.Model, overflow)
+		w.Header().Set("X-Copilot-Proxy-Context-Warning", overflow)
+		return true
+	}
+	log.Printf("Refused request for %s: %s", cr.Model, overflow)
+	writeParamError(w, http.StatusBadRequest, "invalid_request_error", "messages", "context_length_exceeded", overflow)
+	return false
+}
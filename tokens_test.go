@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestClearlyOverflows(t *testing.T) {
+	limits := &catalogExtension{ContextWindow: 1000, MaxPromptTokens: 800}
+	cases := []struct {
+		prompt, completion int
+		want               bool
+	}{
+		{900, 0, false},
+		{2400, 0, false},
+		{2403, 0, true},
+		{1800, 300, false},
+		{1800, 500, true},
+	}
+	for _, c := range cases {
+		p := promptCount{Messages: c.prompt, Approximate: true}
+		if got := clearlyOverflows(p, c.completion, limits); got != c.want {
+			t.Errorf("~%d tokens with %d to complete: clearly overflows = %v, want %v", c.prompt, c.completion, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Tool calling emulation for models without native function calling. The tools
+// are rendered into the system prompt and the model is asked to answer with
+// <tool_call> blocks, which are parsed back into structured tool_calls.
+
+const (
+	toolCallOpen  = "<tool_call>"
+	toolCallClose = "</tool_call>"
+)
+
+var toolCallBlock = regexp.MustCompile(`(?s)<tool_call>(.*?)(?:</tool_call>|\z)`)
+
+// toolChoice is the parsed tool_choice of a request: "auto", "none",
+// "required", or the name of the single function that must be called.
+type toolChoice struct {
+	Mode     string
+	Function string
+}
+
+func parseToolChoice(raw json.RawMessage) toolChoice {
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil && mode != "" {
+		return toolChoice{Mode: mode}
+	}
+	var named struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &named); err == nil && named.Function.Name != "" {
+		return toolChoice{Mode: "function", Function: named.Function.Name}
+	}
+	return toolChoice{Mode: "auto"}
+}
+
+// mustCall reports whether the tool choice requires at least one tool call.
+func (tc toolChoice) mustCall() bool {
+	return tc.Mode == "required" || tc.Mode == "function"
+}
+
+// emulateToolsBody rewrites a request body for a model without native function
+// calling: tools go into the system prompt and tool calls and results in the
+// history are rendered as text.
+func emulateToolsBody(cr *chatRequest, body map[string]any) map[string]any {
+	choice := parseToolChoice(cr.ToolChoice)
+	delete(body, "tools")
+	delete(body, "tool_choice")
+	delete(body, "parallel_tool_calls")
+
+	messages, _ := body["messages"].([]any)
+	rendered := make([]any, 0, len(messages)+1)
+	if choice.Mode != "none" {
+		rendered = append(rendered, map[string]any{"role": "system", "content": renderToolPrompt(cr.Tools, choice)})
+	}
+	toolNames := make(map[string]string) // tool_call_id -> name
+	var results []string
+	flushResults := func() {
+		if len(results) > 0 {
+			rendered = append(rendered, map[string]any{"role": "user", "content": strings.Join(results, "\n")})
+			results = nil
+		}
+	}
+	for _, raw := range messages {
+		msg, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		role, _ := msg["role"].(string)
+		switch {
+		case role == "tool":
+			id, _ := msg["tool_call_id"].(string)
+			results = append(results, fmt.Sprintf("<tool_result id=%q name=%q>\n%s\n</tool_result>", id, toolNames[id], messageText(msg["content"])))
+			continue
+		case role == "assistant" && msg["tool_calls"] != nil:
+			text := messageText(msg["content"])
+			calls, _ := msg["tool_calls"].([]any)
+			for _, c := range calls {
+				call, _ := c.(map[string]any)
+				fn, _ := call["function"].(map[string]any)
+				id, _ := call["id"].(string)
+				name, _ := fn["name"].(string)
+				args, _ := fn["arguments"].(string)
+				toolNames[id] = name
+				if args == "" {
+					args = "{}"
+				}
+				text += fmt.Sprintf("\n%s{\"name\": %q, \"arguments\": %s}%s", toolCallOpen, name, args, toolCallClose)
+			}
+			msg = map[string]any{"role": "assistant", "content": strings.TrimSpace(text)}
+		}
+		flushResults()
+		rendered = append(rendered, msg)
+	}
+	flushResults()
+	body["messages"] = rendered
+	return body
+}
+
+func renderToolPrompt(tools []chatTool, choice toolChoice) string {
+	var b strings.Builder
+	b.WriteString("You can call tools to help answer. To call a tool, reply with one block per call, exactly in this form:\n")
+	b.WriteString(toolCallOpen + `{"name": "<tool name>", "arguments": {<arguments as a JSON object>}}` + toolCallClose + "\n")
+	b.WriteString("Each block must contain a single valid JSON object whose arguments match the tool's parameter schema. ")
+	b.WriteString("Do not wrap blocks in code fences. After your tool calls, stop and wait: the results will be sent back in <tool_result> blocks.\n")
+	switch choice.Mode {
+	case "required":
+		b.WriteString("You must call at least one tool in your reply.\n")
+	case "function":
+		fmt.Fprintf(&b, "You must call the tool %q in your reply.\n", choice.Function)
+	}
+	b.WriteString("\nAvailable tools:\n")
+	for _, t := range tools {
+		fmt.Fprintf(&b, "\n## %s\n", t.Function.Name)
+		if t.Function.Description != "" {
+			b.WriteString(t.Function.Description + "\n")
+		}
+		if len(t.Function.Parameters) > 0 {
+			b.WriteString("Parameters (JSON schema): " + string(t.Function.Parameters) + "\n")
+		}
+	}
+	return b.String()
+}
+
+// messageText flattens string or content-part message content into text.
+func messageText(content any) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case []any:
+		var parts []string
+		for _, p := range c {
+			if part, ok := p.(map[string]any); ok {
+				if text, ok := part["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
+
+// parseEmulatedToolCalls extracts <tool_call> blocks from text. Only blocks
+// holding a JSON object with a known tool name and object arguments become
+// tool calls; anything else is kept as text. It returns the remaining text.
+func parseEmulatedToolCalls(text string, tools []chatTool) (string, []unstream.OAIToolCall) {
+	known := make(map[string]bool, len(tools))
+	for _, t := range tools {
+		known[t.Function.Name] = true
+	}
+	var calls []unstream.OAIToolCall
+	remaining := toolCallBlock.ReplaceAllStringFunc(text, func(block string) string {
+		inner := toolCallBlock.FindStringSubmatch(block)[1]
+		call, err := parseToolCallBlock(inner, known)
+		if err != nil {
+			log.Printf("Ignoring emulated tool call block: %v", err)
+			return block
+		}
+		call.Index = len(calls)
+		calls = append(calls, call)
+		return ""
+	})
+	return strings.TrimSpace(remaining), calls
+}
+
+func parseToolCallBlock(inner string, known map[string]bool) (unstream.OAIToolCall, error) {
+	var block struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	inner = strings.TrimSpace(inner)
+	if err := json.Unmarshal([]byte(inner), &block); err != nil {
+		return unstream.OAIToolCall{}, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if !known[block.Name] {
+		return unstream.OAIToolCall{}, fmt.Errorf("unknown tool %q", block.Name)
+	}
+	args := strings.TrimSpace(string(block.Arguments))
+	var asString string
+	if json.Unmarshal(block.Arguments, &asString) == nil {
+		// Some models double-encode the arguments
+		args = asString
+	}
+	if args == "" || args == "null" {
+		args = "{}"
+	}
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(args), &obj); err != nil {
+		return unstream.OAIToolCall{}, fmt.Errorf("arguments of %s are not a JSON object", block.Name)
+	}
+	return unstream.OAIToolCall{
+		Id:       "call_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24],
+		Type:     "function",
+		Function: unstream.OAIToolCallFunction{Name: block.Name, Arguments: args},
+	}, nil
+}
+
+// applyEmulatedToolCalls turns <tool_call> blocks in every choice of final
+// into structured tool calls, honoring tool_choice "none" and named functions.
+func applyEmulatedToolCalls(cr *chatRequest, final *unstream.OAIChatResponse) {
+	choice := parseToolChoice(cr.ToolChoice)
+	for i := range final.Choices {
+		ch := &final.Choices[i]
+		if ch.Message.Content == nil || choice.Mode == "none" {
+			continue
+		}
+		text, calls := parseEmulatedToolCalls(*ch.Message.Content, cr.Tools)
+		if choice.Mode == "function" {
+			calls = filterToolCalls(calls, choice.Function)
+		}
+		if len(calls) == 0 {
+			continue
+		}
+		ch.Message.Content = nil
+		if text != "" {
+			ch.Message.Content = &text
+		}
+		ch.Message.ToolCalls = calls
+		ch.FinishReason = "tool_calls"
+	}
+}
+
+func filterToolCalls(calls []unstream.OAIToolCall, name string) []unstream.OAIToolCall {
+	var kept []unstream.OAIToolCall
+	for _, c := range calls {
+		if c.Function.Name == name {
+			c.Index = len(kept)
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// enforceEmulatedToolChoice re-asks the model once when tool_choice requires a
+// call and the emulated response contains none. It returns an error if the
+// model still does not call a tool.
+func enforceEmulatedToolChoice(cr *chatRequest, final *unstream.OAIChatResponse) (*unstream.OAIChatResponse, error) {
+	choice := parseToolChoice(cr.ToolChoice)
+	if !choice.mustCall() || hasToolCalls(final) {
+		return final, nil
+	}
+	body, err := cr.bodyMap()
+	if err != nil {
+		return nil, err
+	}
+	messages, _ := body["messages"].([]any)
+	if len(final.Choices) > 0 && final.Choices[0].Message.Content != nil {
+		messages = append(messages, map[string]any{"role": "assistant", "content": *final.Choices[0].Message.Content})
+	}
+	reminder := "You must call a tool now. Reply only with " + toolCallOpen + " blocks."
+	if choice.Mode == "function" {
+		reminder = fmt.Sprintf("You must call the tool %q now. Reply only with a %s block.", choice.Function, toolCallOpen)
+	}
+	messages = append(messages, map[string]any{"role": "user", "content": reminder})
+	body["messages"] = messages
+	log.Printf("Re-asking %s to honor tool_choice %s", cr.Model, choice.Mode)
+	chargeDiscarded(cr, final)
+	retried, _, err := completeChat(cr, body)
+	if err != nil {
+		return nil, err
+	}
+	if !hasToolCalls(retried) {
+		chargeDiscarded(cr, retried)
+		return nil, newUpstreamError(http.StatusBadGateway, fmt.Sprintf("model %s did not call a tool as required by tool_choice", cr.Model))
+	}
+	return retried, nil
+}
+
+func hasToolCalls(resp *unstream.OAIChatResponse) bool {
+	for _, ch := range resp.Choices {
+		if len(ch.Message.ToolCalls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// emulatedStream filters a relayed stream for tool calling emulation. Content
+// is forwarded as it arrives until a <tool_call> marker shows up; from then on
+// the rest of the choice is held back and parsed once the stream ends.
+type emulatedStream struct {
+	collector *unstream.OAIStreamCollector
+	choices   map[int]*emulatedChoice
+	usage     *unstream.OAIUsage
+}
+
+type emulatedChoice struct {
+	pending      string // forwarded text not yet sent, may hold a partial marker
+	held         strings.Builder
+	holding      bool
+	finishReason string
+}
+
+func newEmulatedStream() *emulatedStream {
+	return &emulatedStream{
+		collector: unstream.NewOAIStreamCollector(),
+		choices:   make(map[int]*emulatedChoice),
+	}
+}
+
+// filter returns the chunk to forward now, or nil if it is held back entirely.
+func (e *emulatedStream) filter(chunk *unstream.OAIStreamChunk) *unstream.OAIStreamChunk {
+	e.collector.AddChunk(chunk)
+	if len(chunk.Choices) == 0 && chunk.Usage == nil {
+		return chunk
+	}
+	if chunk.Usage != nil {
+		e.usage = chunk.Usage
+	}
+	out := *chunk
+	out.Usage = nil
+	out.Choices = nil
+	for _, ch := range chunk.Choices {
+		state, ok := e.choices[ch.Index]
+		if !ok {
+			state = &emulatedChoice{}
+			e.choices[ch.Index] = state
+		}
+		if ch.FinishReason != nil {
+			state.finishReason = *ch.FinishReason
+		}
+		fwd := unstream.OAIStreamChoice{Index: ch.Index, Delta: unstream.OAIStreamDelta{Role: ch.Delta.Role}}
+		if ch.Delta.Content != nil {
+			if text := state.push(*ch.Delta.Content); text != "" {
+				fwd.Delta.Content = &text
+			}
+		}
+		if fwd.Delta.Role != "" || fwd.Delta.Content != nil {
+			out.Choices = append(out.Choices, fwd)
+		}
+	}
+	if len(out.Choices) == 0 {
+		return nil
+	}
+	return &out
+}
+
+// push adds streamed text and returns the part that is safe to forward.
+func (s *emulatedChoice) push(text string) string {
+	if s.holding {
+		s.held.WriteString(text)
+		return ""
+	}
+	s.pending += text
+	if i := strings.Index(s.pending, toolCallOpen); i >= 0 {
+		s.holding = true
+		s.held.WriteString(s.pending[i:])
+		out := s.pending[:i]
+		s.pending = ""
+		return out
+	}
+	// Keep back a suffix that could be the start of a marker
+	keep := 0
+	for n := len(toolCallOpen) - 1; n > 0; n-- {
+		if strings.HasSuffix(s.pending, toolCallOpen[:n]) {
+			keep = n
+			break
+		}
+	}
+	out := s.pending[:len(s.pending)-keep]
+	s.pending = s.pending[len(s.pending)-keep:]
+	return out
+}
+
+// finish builds a response from everything that was held back, with the
+// emulated tool calls parsed out, ready to be replayed after the forwarded part.
+func (e *emulatedStream) finish(cr *chatRequest) *unstream.OAIChatResponse {
+	base := e.collector.BuildResponse()
+	final := &unstream.OAIChatResponse{
+		ID:                base.ID,
+		Object:            base.Object,
+		Created:           base.Created,
+		Model:             base.Model,
+		SystemFingerprint: base.SystemFingerprint,
+		Usage:             e.usage,
+	}
+	for idx, state := range e.choices {
+		text := state.pending + state.held.String()
+		ch := unstream.OAIChatChoice{Index: idx, FinishReason: state.finishReason, Message: unstream.OAIChatMessage{Role: "assistant"}}
+		if text != "" {
+			ch.Message.Content = &text
+		}
+		final.Choices = append(final.Choices, ch)
+	}
+	applyEmulatedToolCalls(cr, final)
+	return final
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseToolChoice(t *testing.T) {
+	cases := []struct {
+		raw      string
+		want     toolChoice
+		mustCall bool
+	}{
+		{``, toolChoice{Mode: "auto"}, false},
+		{`"none"`, toolChoice{Mode: "none"}, false},
+		{`"required"`, toolChoice{Mode: "required"}, true},
+		{`{"type":"function","function":{"name":"weather"}}`, toolChoice{Mode: "function", Function: "weather"}, true},
+		{`{"type":"function"}`, toolChoice{Mode: "auto"}, false},
+	}
+	for _, c := range cases {
+		got := parseToolChoice(json.RawMessage(c.raw))
+		if got != c.want || got.mustCall() != c.mustCall {
+			t.Errorf("parseToolChoice(%s) = %+v, must call %v", c.raw, got, got.mustCall())
+		}
+	}
+}
+
+func TestParseEmulatedToolCalls(t *testing.T) {
+	tools := []chatTool{{Type: "function"}}
+	tools[0].Function.Name = "weather"
+
+	cases := []struct {
+		text  string
+		rest  string
+		calls []string // name and arguments of each call
+	}{
+		{"It is sunny.", "It is sunny.", nil},
+		{`<tool_call>{"name":"weather","arguments":{"city":"Paris"}}</tool_call>`, "", []string{`weather {"city":"Paris"}`}},
+		{"Let me check.\n<tool_call>{\"name\":\"weather\",\"arguments\":{\"city\":\"Paris\"}}</tool_call>\n<tool_call>{\"name\":\"weather\",\"arguments\":{\"city\":\"Rome\"}}</tool_call>",
+			"Let me check.", []string{`weather {"city":"Paris"}`, `weather {"city":"Rome"}`}},
+		// Double-encoded and missing arguments
+		{`<tool_call>{"name":"weather","arguments":"{\"city\":\"Oslo\"}"}</tool_call>`, "", []string{`weather {"city":"Oslo"}`}},
+		{`<tool_call>{"name":"weather"}</tool_call>`, "", []string{`weather {}`}},
+		// An unclosed block at the end of the answer still counts
+		{`<tool_call>{"name":"weather","arguments":{}}`, "", []string{`weather {}`}},
+		// Blocks that are not valid calls stay text
+		{`<tool_call>{"name":"search","arguments":{}}</tool_call>`, `<tool_call>{"name":"search","arguments":{}}</tool_call>`, nil},
+		{`<tool_call>not json</tool_call>`, `<tool_call>not json</tool_call>`, nil},
+		{`<tool_call>{"name":"weather","arguments":[1]}</tool_call>`, `<tool_call>{"name":"weather","arguments":[1]}</tool_call>`, nil},
+	}
+	for _, c := range cases {
+		rest, calls := parseEmulatedToolCalls(c.text, tools)
+		var got []string
+		for i, call := range calls {
+			if call.Index != i || call.Type != "function" || !strings.HasPrefix(call.Id, "call_") {
+				t.Errorf("%q: call %d is %+v", c.text, i, call)
+			}
+			got = append(got, call.Function.Name+" "+call.Function.Arguments)
+		}
+		if rest != c.rest || !reflect.DeepEqual(got, c.calls) {
+			t.Errorf("%q: got %q and %q, want %q and %q", c.text, rest, got, c.rest, c.calls)
+		}
+	}
+}
+
+func TestApplyEmulatedToolCalls(t *testing.T) {
+	tools := []chatTool{{Type: "function"}, {Type: "function"}}
+	tools[0].Function.Name = "weather"
+	tools[1].Function.Name = "time"
+	answer := `Checking. <tool_call>{"name":"time","arguments":{}}</tool_call><tool_call>{"name":"weather","arguments":{}}</tool_call>`
+
+	cases := []struct {
+		choice string
+		text   string
+		calls  []string
+		finish string
+	}{
+		{`"auto"`, "Checking.", []string{"time", "weather"}, "tool_calls"},
+		{`{"type":"function","function":{"name":"weather"}}`, "Checking.", []string{"weather"}, "tool_calls"},
+		{`"none"`, answer, nil, "stop"},
+		{`{"type":"function","function":{"name":"search"}}`, answer, nil, "stop"},
+	}
+	for _, c := range cases {
+		cr := &chatRequest{Tools: tools, ToolChoice: json.RawMessage(c.choice)}
+		content := answer
+		final := &unstream.OAIChatResponse{Choices: []unstream.OAIChatChoice{{FinishReason: "stop", Message: unstream.OAIChatMessage{Content: &content}}}}
+		applyEmulatedToolCalls(cr, final)
+		ch := final.Choices[0]
+		var names []string
+		for _, call := range ch.Message.ToolCalls {
+			names = append(names, call.Function.Name)
+		}
+		text := ""
+		if ch.Message.Content != nil {
+			text = *ch.Message.Content
+		}
+		if text != c.text || !reflect.DeepEqual(names, c.calls) || ch.FinishReason != c.finish {
+			t.Errorf("tool_choice %s: got %q, %v, %s", c.choice, text, names, ch.FinishReason)
+		}
+	}
+}
+
+func TestEmulatedChoicePush(t *testing.T) {
+	cases := []struct {
+		chunks  []string
+		sent    string
+		held    string
+		pending string
+	}{
+		{[]string{"Hello", " world"}, "Hello world", "", ""},
+		// A marker split over chunks is never forwarded
+		{[]string{"Sure <tool", "_call>{\"name\"", ":\"x\"}"}, "Sure ", `<tool_call>{"name":"x"}`, ""},
+		// Text that only looks like the start of a marker waits
+		{[]string{"a <", "b"}, "a <b", "", ""},
+		{[]string{"a <tool_"}, "a ", "", "<tool_"},
+	}
+	for _, c := range cases {
+		var state emulatedChoice
+		sent := ""
+		for _, chunk := range c.chunks {
+			sent += state.push(chunk)
+		}
+		if sent != c.sent || state.held.String() != c.held || state.pending != c.pending {
+			t.Errorf("%q: sent %q, held %q, pending %q", c.chunks, sent, state.held.String(), state.pending)
+		}
+	}
+}
+
+func TestEmulateToolsBody(t *testing.T) {
+	tools := []chatTool{{Type: "function"}}
+	tools[0].Function.Name = "weather"
+	var body map[string]any
+	json.Unmarshal([]byte(`{
+		"tools": [], "tool_choice": "required", "parallel_tool_calls": true,
+		"messages": [
+			{"role": "user", "content": "Weather in Paris and Rome?"},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "weather", "arguments": "{\"city\":\"Paris\"}"}},
+				{"id": "call_2", "type": "function", "function": {"name": "weather", "arguments": ""}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "sunny"},
+			{"role": "tool", "tool_call_id": "call_2", "content": [{"type": "text", "text": "rain"}]}
+		]
+	}`), &body)
+	cr := &chatRequest{Tools: tools, ToolChoice: json.RawMessage(`"required"`)}
+	body = emulateToolsBody(cr, body)
+
+	for _, k := range []string{"tools", "tool_choice", "parallel_tool_calls"} {
+		if _, ok := body[k]; ok {
+			t.Errorf("%s left in the body", k)
+		}
+	}
+	messages := body["messages"].([]any)
+	want := []struct{ role, contains string }{
+		{"system", "You must call at least one tool"},
+		{"user", "Weather in Paris and Rome?"},
+		{"assistant", `<tool_call>{"name": "weather", "arguments": {"city":"Paris"}}</tool_call>` + "\n" + `<tool_call>{"name": "weather", "arguments": {}}</tool_call>`},
+		// Consecutive results are sent back as one message
+		{"user", "<tool_result id=\"call_1\" name=\"weather\">\nsunny\n</tool_result>\n<tool_result id=\"call_2\" name=\"weather\">\nrain\n</tool_result>"},
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("%d messages, want %d: %v", len(messages), len(want), messages)
+	}
+	for i, w := range want {
+		msg := messages[i].(map[string]any)
+		content, _ := msg["content"].(string)
+		if msg["role"] != w.role || !strings.Contains(content, w.contains) {
+			t.Errorf("message %d is %v, want a %s message with %q", i, msg, w.role, w.contains)
+		}
+	}
+}
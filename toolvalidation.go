@@ -0,0 +1,170 @@
+package main
+
+import (
+	"copilot-proxy/jsonschema"
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Tool validation policies, applied to tool calls that are still invalid after repair.
+const (
+	toolPolicyPassthrough = "passthrough" // log and return the calls unchanged
+	toolPolicyError       = "error"       // fail the request
+	toolPolicyReask       = "reask"       // ask the model again with the errors fed back
+)
+
+type toolValidationConfig struct {
+	// Policy is one of passthrough (the default), error or reask.
+	Policy string `json:"policy"`
+	// MaxReasks bounds the number of re-asks with the reask policy. Defaults to 1.
+	MaxReasks int `json:"max_reasks"`
+}
+
+// toolCallProblem is a tool call whose arguments could not be made valid.
+type toolCallProblem struct {
+	Call unstream.OAIToolCall
+	Err  string
+}
+
+// toolValidationEnabled reports whether the request's tool calls are checked.
+func toolValidationEnabled(cr *chatRequest) bool {
+	return config.ToolValidation != nil && len(cr.Tools) > 0
+}
+
+// toolSchemas parses the parameter schemas declared in the request's tools.
+// Tools with unparseable schemas are accepted without validation.
+func (cr *chatRequest) toolSchemas() map[string]*jsonschema.Schema {
+	schemas := make(map[string]*jsonschema.Schema, len(cr.Tools))
+	for _, t := range cr.Tools {
+		schema, err := jsonschema.Parse(t.Function.Parameters)
+		if err != nil {
+			log.Printf("Ignoring schema of tool %s: %v", t.Function.Name, err)
+			schema = nil
+		}
+		schemas[t.Function.Name] = schema
+	}
+	return schemas
+}
+
+// checkToolCalls repairs the arguments of every tool call in resp in place
+// and returns the calls that are still invalid.
+func checkToolCalls(resp *unstream.OAIChatResponse, schemas map[string]*jsonschema.Schema) []toolCallProblem {
+	var problems []toolCallProblem
+	for i := range resp.Choices {
+		calls := resp.Choices[i].Message.ToolCalls
+		for j := range calls {
+			tc := &calls[j]
+			schema, known := schemas[tc.Function.Name]
+			if !known {
+				problems = append(problems, toolCallProblem{Call: *tc, Err: fmt.Sprintf("unknown tool %q", tc.Function.Name)})
+				continue
+			}
+			if !json.Valid([]byte(tc.Function.Arguments)) {
+				repaired, ok := unstream.RepairJSON(tc.Function.Arguments)
+				if !ok {
+					problems = append(problems, toolCallProblem{Call: *tc, Err: "arguments are not valid JSON"})
+					continue
+				}
+				log.Printf("Repaired arguments of tool call %s (%s)", tc.Id, tc.Function.Name)
+				tc.Function.Arguments = repaired
+			}
+			if err := schema.ValidateJSON([]byte(tc.Function.Arguments)); err != nil {
+				problems = append(problems, toolCallProblem{Call: *tc, Err: err.Error()})
+			}
+		}
+	}
+	return problems
+}
+
+// applyToolValidation validates and repairs the tool calls in final and applies
+// the configured policy to what remains invalid. It returns the response to
+// send and the number of tool calls that are still invalid.
+func applyToolValidation(cr *chatRequest, final *unstream.OAIChatResponse) (*unstream.OAIChatResponse, int, error) {
+	if !toolValidationEnabled(cr) {
+		return final, 0, nil
+	}
+	cfg := config.ToolValidation
+	schemas := cr.toolSchemas()
+	maxReasks := cfg.MaxReasks
+	if maxReasks <= 0 {
+		maxReasks = 1
+	}
+	for attempt := 0; ; attempt++ {
+		problems := checkToolCalls(final, schemas)
+		if len(problems) == 0 {
+			return final, 0, nil
+		}
+		for _, p := range problems {
+			log.Printf("Invalid tool call %s (%s): %s", p.Call.Id, p.Call.Function.Name, p.Err)
+		}
+		switch cfg.Policy {
+		case toolPolicyError:
+			return nil, len(problems), &upstreamError{
+				Status: http.StatusBadGateway,
+				Err: unstream.OAIError{
+					Message: "model produced invalid tool call arguments: " + describeProblems(problems),
+					Type:    "invalid_tool_call",
+				},
+			}
+		case toolPolicyReask:
+			if attempt >= maxReasks {
+				log.Printf("Giving up on tool call repair after %d re-asks", attempt)
+				return final, len(problems), nil
+			}
+			body, err := reaskBody(cr, final, problems)
+			if err != nil {
+				return final, len(problems), nil
+			}
+			log.Printf("Re-asking %s for valid tool calls (attempt %d)", cr.Model, attempt+1)
+			chargeDiscarded(cr, final)
+			retried, _, err := completeChat(cr, body)
+			if err != nil {
+				return nil, len(problems), err
+			}
+			final = retried
+		default:
+			return final, len(problems), nil
+		}
+	}
+}
+
+// reaskBody appends the failed assistant turn and one tool result per call to
+// the original messages, so the model can see what was wrong and call again.
+func reaskBody(cr *chatRequest, final *unstream.OAIChatResponse, problems []toolCallProblem) (map[string]any, error) {
+	body, err := cr.bodyMap()
+	if err != nil {
+		return nil, err
+	}
+	messages, _ := body["messages"].([]any)
+	msg := final.Choices[0].Message
+	messages = append(messages, msg)
+	failed := make(map[string]string, len(problems))
+	for _, p := range problems {
+		failed[p.Call.Id] = p.Err
+	}
+	for _, tc := range msg.ToolCalls {
+		result := "Not executed because another tool call in this turn was invalid. Call it again."
+		if e, ok := failed[tc.Id]; ok {
+			result = "Invalid arguments: " + e + ". Call the tool again with arguments that match its JSON schema."
+		}
+		messages = append(messages, map[string]any{
+			"role":         "tool",
+			"tool_call_id": tc.Id,
+			"content":      result,
+		})
+	}
+	body["messages"] = messages
+	return body, nil
+}
+
+func describeProblems(problems []toolCallProblem) string {
+	parts := make([]string, len(problems))
+	for i, p := range problems {
+		parts[i] = fmt.Sprintf("%s: %s", p.Call.Function.Name, p.Err)
+	}
+	return strings.Join(parts, "; ")
+}
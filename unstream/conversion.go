@@ -1,6 +1,8 @@
 package unstream
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -14,6 +16,11 @@ type OAIStreamCollector struct {
 	PromptFilterResults []OAIPromptFilterResult
 	Usage               *OAIUsage
 
+	// MergeChoices folds every streamed choice into choice 0. Some models served
+	// by Copilot spread text and parallel tool calls over several choices even
+	// though only one was requested.
+	MergeChoices bool
+
 	// For each choice index, collect content and tool calls
 	choices map[int]*collectedChoice
 }
@@ -21,12 +28,22 @@ type OAIStreamCollector struct {
 type collectedChoice struct {
 	role                 string
 	content              *strings.Builder
-	toolCalls            map[int]*OAIToolCall // index -> tool call
-	toolCallsOrder       []int                // preserve order
+	refusal              *strings.Builder
+	toolCalls            []*OAIToolCall      // in order of first appearance
+	toolCallPos          map[toolCallKey]int // streamed index -> position in toolCalls
+	lastToolCall         int                 // position of the most recent call, -1 if none
+	logprobs             *OAILogprobs
 	finishReason         *string
 	contentFilterResults map[string]OAIContentFilterResult
 }
 
+// toolCallKey identifies a streamed tool call. The choice index is part of the
+// key so that merged choices which each start at tool index 0 stay apart.
+type toolCallKey struct {
+	choice int
+	index  int
+}
+
 func NewOAIStreamCollector() *OAIStreamCollector {
 	return &OAIStreamCollector{
 		choices: make(map[int]*collectedChoice),
@@ -60,84 +77,150 @@ func (c *OAIStreamCollector) AddChunk(chunk *OAIStreamChunk) {
 			CompletionTokens: chunk.Usage.CompletionTokens,
 			TotalTokens:      chunk.Usage.TotalTokens,
 		}
+		if d := chunk.Usage.PromptTokensDetails; d != nil {
+			c.Usage.PromptTokensDetails = &OAIPromptTokensDetails{CachedTokens: d.CachedTokens}
+		}
 	}
 
 	for _, ch := range chunk.Choices {
 		idx := ch.Index
+		if c.MergeChoices {
+			idx = 0
+		}
 		choice, ok := c.choices[idx]
 		if !ok {
 			choice = &collectedChoice{
 				content:              &strings.Builder{},
-				toolCalls:            make(map[int]*OAIToolCall),
+				refusal:              &strings.Builder{},
+				toolCallPos:          make(map[toolCallKey]int),
+				lastToolCall:         -1,
 				contentFilterResults: make(map[string]OAIContentFilterResult),
 			}
 			c.choices[idx] = choice
 		}
 		// Role
-		if ch.Delta.Role != "" {
+		if ch.Delta.Role != "" && choice.role == "" {
 			choice.role = ch.Delta.Role
 		}
 		// Content
 		if ch.Delta.Content != nil {
 			choice.content.WriteString(*ch.Delta.Content)
 		}
+		if ch.Delta.Refusal != nil {
+			choice.refusal.WriteString(*ch.Delta.Refusal)
+		}
 		// Tool calls
 		for _, tc := range ch.Delta.ToolCalls {
-			// Tool calls are streamed by index, accumulate arguments
-			existing, ok := choice.toolCalls[tc.Index]
-			if !ok {
-				// Copy the struct to avoid pointer aliasing
-				copyTC := tc
-				choice.toolCalls[tc.Index] = &copyTC
-				choice.toolCallsOrder = append(choice.toolCallsOrder, tc.Index)
-			} else {
-				// Append arguments if present
-				if tc.Function.Arguments != "" {
-					existing.Function.Arguments += tc.Function.Arguments
-				}
+			choice.addToolCallDelta(ch.Index, tc)
+		}
+		if ch.Logprobs != nil {
+			if choice.logprobs == nil {
+				choice.logprobs = &OAILogprobs{}
 			}
+			choice.logprobs.Content = append(choice.logprobs.Content, ch.Logprobs.Content...)
 		}
 		// Finish reason
-		if ch.FinishReason != nil {
+		if ch.FinishReason != nil && *ch.FinishReason != "" {
 			choice.finishReason = ch.FinishReason
 		}
-		// Content filter results
-		// Defensive nil check for ch.Delta.Content
-		contentLen := 0
-		if ch.Delta.Content != nil {
-			contentLen = len(*ch.Delta.Content)
-		}
-		if len(ch.Delta.ToolCalls) == 0 && contentLen == 0 && len(ch.Delta.Role) == 0 && len(ch.Delta.ToolCalls) == 0 {
-			// No-op for now, but if content filter results are streamed, handle here
+	}
+}
+
+// addToolCallDelta merges a streamed tool call fragment. Fragments are matched
+// by index, but a fragment carrying a new id on an index that already has a
+// different id starts a new call, and fragments without an index continue the
+// most recent call unless they carry a new id.
+func (ch *collectedChoice) addToolCallDelta(choiceIndex int, tc OAIToolCallDelta) {
+	pos := -1
+	if tc.Index != nil {
+		key := toolCallKey{choice: choiceIndex, index: *tc.Index}
+		if p, ok := ch.toolCallPos[key]; ok && !isNewCallID(ch.toolCalls[p], tc.Id) {
+			pos = p
+		} else {
+			pos = ch.newToolCall()
+			ch.toolCallPos[key] = pos
 		}
+	} else if ch.lastToolCall >= 0 && !isNewCallID(ch.toolCalls[ch.lastToolCall], tc.Id) {
+		pos = ch.lastToolCall
+	} else {
+		pos = ch.newToolCall()
+	}
+	ch.lastToolCall = pos
+
+	call := ch.toolCalls[pos]
+	// id, type and name may arrive in any fragment; the first non-empty value wins
+	if call.Id == "" {
+		call.Id = tc.Id
+	}
+	if call.Type == "" {
+		call.Type = tc.Type
 	}
+	if call.Function.Name == "" {
+		call.Function.Name = tc.Function.Name
+	}
+	call.Function.Arguments += tc.Function.Arguments
+}
+
+func (ch *collectedChoice) newToolCall() int {
+	ch.toolCalls = append(ch.toolCalls, &OAIToolCall{})
+	return len(ch.toolCalls) - 1
+}
+
+func isNewCallID(call *OAIToolCall, id string) bool {
+	return id != "" && call.Id != "" && call.Id != id
 }
 
-// BuildResponse returns the final OAIChatResponse.
+// BuildResponse returns the final OAIChatResponse. Choices are ordered by index
+// and tool calls by first appearance, renumbered from 0. Tool calls that never
+// received an id or type get deterministic defaults.
 func (c *OAIStreamCollector) BuildResponse() *OAIChatResponse {
+	indices := make([]int, 0, len(c.choices))
+	for idx := range c.choices {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+
 	choices := make([]OAIChatChoice, 0, len(c.choices))
-	for idx, ch := range c.choices {
-		// Collect tool calls in order
+	for _, idx := range indices {
+		ch := c.choices[idx]
 		var toolCalls []OAIToolCall
-		for _, i := range ch.toolCallsOrder {
-			tc := ch.toolCalls[i]
-			toolCalls = append(toolCalls, *tc)
+		for i, tc := range ch.toolCalls {
+			call := *tc
+			call.Index = i
+			if call.Id == "" {
+				call.Id = fmt.Sprintf("call_%s_%d_%d", strings.TrimPrefix(c.ID, "chatcmpl-"), idx, i)
+			}
+			if call.Type == "" {
+				call.Type = "function"
+			}
+			toolCalls = append(toolCalls, call)
 		}
 		contentStr := ch.content.String()
 		var contentPtr *string
 		if contentStr != "" {
 			contentPtr = &contentStr
 		}
+		var refusalPtr *string
+		if refusal := ch.refusal.String(); refusal != "" {
+			refusalPtr = &refusal
+		}
+		finishReason := derefString(ch.finishReason)
+		if len(toolCalls) > 0 && (finishReason == "" || finishReason == "stop") {
+			// Merged choices can end with "stop" on the text part of the answer
+			finishReason = "tool_calls"
+		}
 		choices = append(choices, OAIChatChoice{
-			FinishReason:         derefString(ch.finishReason),
+			FinishReason:         finishReason,
 			Index:                idx,
 			ContentFilterResults: ch.contentFilterResults,
 			Message: OAIChatMessage{
 				Role:      ch.role,
 				Content:   contentPtr,
+				Refusal:   refusalPtr,
 				ToolCalls: toolCalls,
 				Padding:   "", // Not streamed
 			},
+			Logprobs: ch.logprobs,
 		})
 	}
 	return &OAIChatResponse{
@@ -111,6 +111,30 @@ data: [DONE]
 	}
 }
 
+func TestOAIStreamCollector_Logprobs(t *testing.T) {
+	payloads := []string{
+		`{"choices":[{"index":0,"delta":{"content":"Hi","role":"assistant"},"logprobs":{"content":[{"token":"Hi","logprob":-0.1,"top_logprobs":[{"token":"Hi","logprob":-0.1}]}]}}],"id":"chatcmpl-1"}`,
+		`{"choices":[{"index":0,"delta":{"content":"!"},"logprobs":{"content":[{"token":"!","logprob":-0.5,"top_logprobs":[]}]}}],"id":"chatcmpl-1"}`,
+		`{"choices":[{"finish_reason":"stop","index":0,"delta":{}}],"id":"chatcmpl-1"}`,
+	}
+	collector := NewOAIStreamCollector()
+	for _, payload := range payloads {
+		var chunk OAIStreamChunk
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			t.Fatalf("failed to unmarshal chunk: %v", err)
+		}
+		collector.AddChunk(&chunk)
+	}
+	resp := collector.BuildResponse()
+	lp := resp.Choices[0].Logprobs
+	if lp == nil || len(lp.Content) != 2 {
+		t.Fatalf("expected 2 token logprobs, got %+v", lp)
+	}
+	if lp.Content[0].Token != "Hi" || lp.Content[1].Logprob != -0.5 {
+		t.Errorf("unexpected logprobs %+v", lp.Content)
+	}
+}
+
 func derefString(s *string) string {
 	if s == nil {
 		return ""
@@ -15,12 +15,14 @@ type OAIStreamChoice struct {
 	Delta        OAIStreamDelta `json:"delta"`
 	FinishReason *string        `json:"finish_reason,omitempty"`
 	Index        int            `json:"index"`
+	Logprobs     *OAILogprobs   `json:"logprobs,omitempty"`
 }
 
 type OAIStreamDelta struct {
-	Content   *string       `json:"content,omitempty"`
-	ToolCalls []OAIToolCall `json:"tool_calls,omitempty"`
-	Role      string        `json:"role,omitempty"`
+	Content   *string            `json:"content,omitempty"`
+	Refusal   *string            `json:"refusal,omitempty"`
+	ToolCalls []OAIToolCallDelta `json:"tool_calls,omitempty"`
+	Role      string             `json:"role,omitempty"`
 }
 
 type OAIPromptFilterResult struct {
@@ -45,6 +47,21 @@ type OAIToolCallFunction struct {
 	Name      string `json:"name"`
 }
 
+// OAIToolCallDelta is a streamed tool call fragment. Only the first fragment
+// of a call normally carries the id, type and name. Index is a pointer because
+// some upstreams leave it out.
+type OAIToolCallDelta struct {
+	Function OAIToolCallFunctionDelta `json:"function"`
+	Id       string                   `json:"id,omitempty"`
+	Index    *int                     `json:"index,omitempty"`
+	Type     string                   `json:"type,omitempty"`
+}
+
+type OAIToolCallFunctionDelta struct {
+	Arguments string `json:"arguments"`
+	Name      string `json:"name,omitempty"`
+}
+
 type OAIChatResponse struct {
 	ID                  string                  `json:"id"`
 	Object              string                  `json:"object"`
@@ -61,17 +78,56 @@ type OAIChatChoice struct {
 	Index                int                               `json:"index"`
 	ContentFilterResults map[string]OAIContentFilterResult `json:"content_filter_results,omitempty"`
 	Message              OAIChatMessage                    `json:"message"`
+	Logprobs             *OAILogprobs                      `json:"logprobs,omitempty"`
+}
+
+// OAILogprobs holds the log probabilities of the sampled tokens, returned when
+// a request sets logprobs.
+type OAILogprobs struct {
+	Content []OAITokenLogprob `json:"content"`
+}
+
+type OAITokenLogprob struct {
+	Token       string          `json:"token"`
+	Logprob     float64         `json:"logprob"`
+	Bytes       []int           `json:"bytes,omitempty"`
+	TopLogprobs []OAITopLogprob `json:"top_logprobs"`
+}
+
+type OAITopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes,omitempty"`
 }
 
 type OAIChatMessage struct {
 	Role      string        `json:"role"`
 	Content   *string       `json:"content,omitempty"`
+	Refusal   *string       `json:"refusal,omitempty"`
 	ToolCalls []OAIToolCall `json:"tool_calls,omitempty"`
 	Padding   string        `json:"padding,omitempty"`
 }
 
 type OAIUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens        int                     `json:"prompt_tokens"`
+	CompletionTokens    int                     `json:"completion_tokens"`
+	TotalTokens         int                     `json:"total_tokens"`
+	PromptTokensDetails *OAIPromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+// OAIPromptTokensDetails breaks down the prompt tokens of a response.
+type OAIPromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+// OAIErrorResponse is the error body returned by OpenAI compatible APIs.
+type OAIErrorResponse struct {
+	Error OAIError `json:"error"`
+}
+
+type OAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    any     `json:"code"`
 }
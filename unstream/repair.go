@@ -0,0 +1,153 @@
+package unstream
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// RepairJSON attempts a conservative repair of the almost-JSON models emit as
+// tool call arguments: markdown code fences, trailing commas, unterminated
+// strings, truncated literals and objects or arrays left open by a stream that
+// was cut off at finish_reason "length". It never rewrites values that were
+// already complete. The result is only usable if the returned bool is true.
+func RepairJSON(s string) (string, bool) {
+	if json.Valid([]byte(s)) {
+		return s, true
+	}
+	s = stripCodeFence(strings.TrimSpace(s))
+	if s == "" {
+		// Models call parameterless tools with empty arguments
+		return "{}", true
+	}
+	if json.Valid([]byte(s)) {
+		return s, true
+	}
+
+	var (
+		out      strings.Builder
+		stack    []byte
+		keyPos   []bool // for each open object: whether the next string is a key
+		inString bool
+		escaped  bool
+	)
+	trimTrailingComma := func() {
+		trimmed := strings.TrimRight(out.String(), " \t\r\n")
+		if strings.HasSuffix(trimmed, ",") {
+			trimmed = trimmed[:len(trimmed)-1]
+			out.Reset()
+			out.WriteString(trimmed)
+		}
+	}
+	for _, c := range s {
+		if inString {
+			out.WriteRune(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			stack = append(stack, '}')
+			keyPos = append(keyPos, true)
+		case '[':
+			stack = append(stack, ']')
+		case '}', ']':
+			trimTrailingComma()
+			if len(stack) == 0 || stack[len(stack)-1] != byte(c) {
+				return s, false
+			}
+			if c == '}' {
+				keyPos = keyPos[:len(keyPos)-1]
+			}
+			stack = stack[:len(stack)-1]
+		case ':':
+			if len(keyPos) > 0 {
+				keyPos[len(keyPos)-1] = false
+			}
+		case ',':
+			if len(stack) > 0 && stack[len(stack)-1] == '}' {
+				keyPos[len(keyPos)-1] = true
+			}
+		}
+		out.WriteRune(c)
+	}
+
+	if inString {
+		str := out.String()
+		if escaped {
+			str = str[:len(str)-1]
+		}
+		out.Reset()
+		out.WriteString(str)
+		out.WriteByte('"')
+	}
+	repaired := strings.TrimRight(out.String(), " \t\r\n")
+	repaired = completeTail(repaired, len(stack) > 0 && stack[len(stack)-1] == '}' && keyPos[len(keyPos)-1])
+	for i := len(stack) - 1; i >= 0; i-- {
+		repaired = strings.TrimSuffix(strings.TrimRight(repaired, " \t\r\n"), ",")
+		repaired += string(stack[i])
+	}
+	if !json.Valid([]byte(repaired)) {
+		return s, false
+	}
+	return repaired, true
+}
+
+// completeTail finishes whatever token the document was cut off in.
+// atKey reports whether the innermost open object expects a key.
+func completeTail(s string, atKey bool) string {
+	switch {
+	case strings.HasSuffix(s, ","):
+		return s[:len(s)-1]
+	case strings.HasSuffix(s, ":"):
+		return s + "null"
+	case atKey && strings.HasSuffix(s, `"`):
+		// A key without its value
+		return s + ":null"
+	}
+	for _, lit := range []string{"true", "false", "null"} {
+		for i := len(lit) - 1; i > 0; i-- {
+			if strings.HasSuffix(s, lit[:i]) && !isIdentByte(s, len(s)-i-1) {
+				return s + lit[i:]
+			}
+		}
+	}
+	switch last := s[len(s)-1]; last {
+	case '.', '-', '+':
+		return s + "0"
+	case 'e', 'E':
+		// Only a dangling exponent, not the end of a complete true or false
+		if len(s) > 1 && s[len(s)-2] >= '0' && s[len(s)-2] <= '9' {
+			return s + "0"
+		}
+	}
+	return s
+}
+
+func isIdentByte(s string, i int) bool {
+	if i < 0 {
+		return false
+	}
+	c := s[i]
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func stripCodeFence(s string) string {
+	if !strings.HasPrefix(s, "```") {
+		return s
+	}
+	if nl := strings.IndexByte(s, '\n'); nl >= 0 {
+		s = s[nl+1:]
+	} else {
+		s = strings.TrimPrefix(s, "```")
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "```"))
+}
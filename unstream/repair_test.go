@@ -0,0 +1,38 @@
+package unstream_test
+
+import (
+	. "copilot-proxy/unstream"
+	"testing"
+)
+
+func TestRepairJSON(t *testing.T) {
+	cases := []struct {
+		in, want string
+		ok       bool
+	}{
+		{`{"a":1}`, `{"a":1}`, true},
+		{``, `{}`, true},
+		{"```json\n{\"a\":1}\n```", `{"a":1}`, true},
+		{`{"a":1,}`, `{"a":1}`, true},
+		{`{"a":[1,2,],}`, `{"a":[1,2]}`, true},
+		{`{"path":"src/ma`, `{"path":"src/ma"}`, true},
+		{`{"path":"a\`, `{"path":"a"}`, true},
+		{`{"a":{"b":[1,2`, `{"a":{"b":[1,2]}}`, true},
+		{`{"a":1,"b"`, `{"a":1,"b":null}`, true},
+		{`{"a":`, `{"a":null}`, true},
+		{`{"a":tr`, `{"a":true}`, true},
+		{`{"a":1.`, `{"a":1.0}`, true},
+		{`{"a":2e`, `{"a":2e0}`, true},
+		{`{"a": true`, `{"a": true}`, true},
+		{`{"a": false`, `{"a": false}`, true},
+		{`{"a":"}"`, `{"a":"}"}`, true},
+		{`{"a":1}}`, `{"a":1}}`, false},
+		{`{"a" 1}`, `{"a" 1}`, false},
+	}
+	for _, c := range cases {
+		got, ok := RepairJSON(c.in)
+		if ok != c.ok || got != c.want {
+			t.Errorf("RepairJSON(%q) = %q, %v; want %q, %v", c.in, got, ok, c.want, c.ok)
+		}
+	}
+}
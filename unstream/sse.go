@@ -0,0 +1,265 @@
+package unstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// SSEEvent is a single dispatched server-sent event.
+type SSEEvent struct {
+	// Event is the value of the last event: field, empty for default "message" events.
+	Event string
+	// Data is the concatenation of all data: fields, joined with "\n".
+	Data string
+	// ID is the last event ID seen on the stream, which persists across events.
+	ID string
+	// Retry is the reconnection time in milliseconds, or -1 if not set.
+	Retry int
+}
+
+// SSEDecoder decodes a text/event-stream body as described by the WHATWG HTML
+// spec. Lines may be terminated by LF, CR or CRLF and have no length limit.
+type SSEDecoder struct {
+	r       *bufio.Reader
+	lastID  string
+	started bool
+	line    bytes.Buffer
+}
+
+func NewSSEDecoder(r io.Reader) *SSEDecoder {
+	return &SSEDecoder{r: bufio.NewReader(r)}
+}
+
+// Next returns the next event. It returns io.EOF once the stream is exhausted.
+// A trailing event that is not followed by a blank line is still dispatched,
+// since several upstreams omit the final terminator.
+func (d *SSEDecoder) Next() (*SSEEvent, error) {
+	var (
+		data      strings.Builder
+		hasData   bool
+		eventType string
+		retry     = -1
+	)
+	for {
+		line, err := d.readLine()
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			if errors.Is(err, io.EOF) && hasData {
+				return d.dispatch(&data, eventType, retry), nil
+			}
+			return nil, err
+		}
+		if line == "" {
+			if !hasData {
+				// Blank line without data resets the event type only
+				eventType = ""
+				continue
+			}
+			return d.dispatch(&data, eventType, retry), nil
+		}
+		if line[0] == ':' {
+			// Comment, commonly used as a keep-alive
+			continue
+		}
+		field, value, found := strings.Cut(line, ":")
+		if found {
+			value = strings.TrimPrefix(value, " ")
+		}
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				d.lastID = value
+			}
+		case "retry":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+				retry = n
+			}
+		}
+	}
+}
+
+func (d *SSEDecoder) dispatch(data *strings.Builder, eventType string, retry int) *SSEEvent {
+	return &SSEEvent{
+		Event: eventType,
+		Data:  strings.TrimSuffix(data.String(), "\n"),
+		ID:    d.lastID,
+		Retry: retry,
+	}
+}
+
+// readLine reads a single line without its terminator. At the end of the stream
+// it returns the final unterminated line, if any, together with io.EOF.
+func (d *SSEDecoder) readLine() (string, error) {
+	d.line.Reset()
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return d.line.String(), err
+		}
+		switch b {
+		case '\n':
+			return d.stripBOM(), nil
+		case '\r':
+			if next, err := d.r.Peek(1); err == nil && next[0] == '\n' {
+				d.r.ReadByte()
+			}
+			return d.stripBOM(), nil
+		}
+		d.line.WriteByte(b)
+	}
+}
+
+func (d *SSEDecoder) stripBOM() string {
+	line := d.line.String()
+	if !d.started {
+		d.started = true
+		line = strings.TrimPrefix(line, "\uFEFF")
+	}
+	return line
+}
+
+// OAIStreamReader reads chat.completion.chunk objects from an OpenAI style SSE stream.
+type OAIStreamReader struct {
+	dec     *SSEDecoder
+	pending []string
+	event   string
+	done    bool
+	sawDone bool
+}
+
+func NewOAIStreamReader(r io.Reader) *OAIStreamReader {
+	return &OAIStreamReader{dec: NewSSEDecoder(r)}
+}
+
+// Next returns the next chunk. It returns io.EOF after the [DONE] sentinel or
+// at the end of the stream, a *StreamError when the upstream reports an error
+// mid-stream, and an error for payloads that are not valid chunks.
+func (s *OAIStreamReader) Next() (*OAIStreamChunk, error) {
+	payload, err := s.NextPayload()
+	if err != nil {
+		return nil, err
+	}
+	var chunk OAIStreamChunk
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return nil, fmt.Errorf("invalid stream chunk: %w", err)
+	}
+	return &chunk, nil
+}
+
+// Done reports whether the stream has ended with the [DONE] sentinel, rather
+// than with an error or by breaking off.
+func (s *OAIStreamReader) Done() bool {
+	return s.sawDone
+}
+
+// NextPayload returns the next JSON payload without decoding it, for streams
+// of objects other than chat.completion.chunk. Errors are reported as by Next.
+func (s *OAIStreamReader) NextPayload() ([]byte, error) {
+	for {
+		if s.done {
+			return nil, io.EOF
+		}
+		if len(s.pending) == 0 {
+			ev, err := s.dec.Next()
+			if err != nil {
+				return nil, err
+			}
+			s.pending = splitPayloads(ev.Data)
+			s.event = ev.Event
+			continue
+		}
+		payload := s.pending[0]
+		s.pending = s.pending[1:]
+		if payload == "[DONE]" {
+			s.done, s.sawDone = true, true
+			continue
+		}
+		if s.event == "error" {
+			s.done = true
+			return nil, parseStreamError([]byte(payload))
+		}
+		var probe struct {
+			Error json.RawMessage `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(payload), &probe); err != nil {
+			return nil, fmt.Errorf("invalid stream chunk: %w", err)
+		}
+		if len(probe.Error) > 0 && string(probe.Error) != "null" {
+			s.done = true
+			return nil, parseStreamError(probe.Error)
+		}
+		return []byte(payload), nil
+	}
+}
+
+// splitPayloads returns the JSON payloads carried by an event. Multi-line data
+// is normally a single payload, but upstreams that leave out the blank line
+// between events produce several payloads joined by newlines.
+func splitPayloads(data string) []string {
+	data = strings.TrimSpace(data)
+	if data == "" {
+		return nil
+	}
+	if !strings.Contains(data, "\n") || json.Valid([]byte(data)) {
+		return []string{data}
+	}
+	var payloads []string
+	for _, line := range strings.Split(data, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			payloads = append(payloads, line)
+		}
+	}
+	return payloads
+}
+
+// StreamError is an error reported by the upstream in the middle of a stream,
+// either as an error event or as a data payload with an "error" member.
+type StreamError struct {
+	Err OAIError
+}
+
+func (e *StreamError) Error() string {
+	if e.Err.Message == "" {
+		return "upstream stream error"
+	}
+	return "upstream stream error: " + e.Err.Message
+}
+
+func parseStreamError(raw []byte) *StreamError {
+	return &StreamError{Err: ParseOAIError(raw)}
+}
+
+// ParseOAIError accepts {"error":{...}}, a bare error object or a plain
+// string, which are the shapes seen from the various upstream providers.
+func ParseOAIError(raw []byte) OAIError {
+	var wrapped OAIErrorResponse
+	if err := json.Unmarshal(raw, &wrapped); err == nil && wrapped.Error.Message != "" {
+		return wrapped.Error
+	}
+	var bare OAIError
+	if err := json.Unmarshal(raw, &bare); err == nil && bare.Message != "" {
+		return bare
+	}
+	var wrappedString struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &wrappedString); err == nil && wrappedString.Error != "" {
+		return OAIError{Message: wrappedString.Error, Type: "upstream_error"}
+	}
+	var msg string
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		msg = strings.TrimSpace(string(raw))
+	}
+	return OAIError{Message: msg, Type: "upstream_error"}
+}
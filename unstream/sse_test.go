@@ -0,0 +1,206 @@
+package unstream_test
+
+import (
+	. "copilot-proxy/unstream"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readEvents(t *testing.T, stream string) []*SSEEvent {
+	t.Helper()
+	dec := NewSSEDecoder(strings.NewReader(stream))
+	var events []*SSEEvent
+	for {
+		ev, err := dec.Next()
+		if errors.Is(err, io.EOF) {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		events = append(events, ev)
+	}
+}
+
+// collectStream decodes a chat completion stream and folds its chunks into a
+// response.
+func collectStream(t *testing.T, stream string) *OAIChatResponse {
+	t.Helper()
+	collector := NewOAIStreamCollector()
+	reader := NewOAIStreamReader(strings.NewReader(stream))
+	for {
+		chunk, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read chunk: %v", err)
+		}
+		collector.AddChunk(chunk)
+	}
+	return collector.BuildResponse()
+}
+
+func TestSSEDecoder_Fields(t *testing.T) {
+	stream := "\uFEFF: keep-alive\r\n" +
+		"event: error\r\n" +
+		"id: 7\r\n" +
+		"retry: 1500\r\n" +
+		"data: first\r\n" +
+		"data:second\r\n" +
+		"\r\n" +
+		"data: plain\r" +
+		"\r" +
+		"data: unterminated"
+	events := readEvents(t, stream)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	first := events[0]
+	if first.Event != "error" || first.Data != "first\nsecond" || first.ID != "7" || first.Retry != 1500 {
+		t.Errorf("unexpected first event %+v", first)
+	}
+	if events[1].Event != "" || events[1].Data != "plain" || events[1].ID != "7" || events[1].Retry != -1 {
+		t.Errorf("unexpected second event %+v", events[1])
+	}
+	if events[2].Data != "unterminated" {
+		t.Errorf("expected trailing event to be dispatched, got %+v", events[2])
+	}
+}
+
+func TestSSEDecoder_LargeLine(t *testing.T) {
+	big := strings.Repeat("x", 1<<20)
+	events := readEvents(t, "data: "+big+"\n\ndata: next\n\n")
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if len(events[0].Data) != len(big) {
+		t.Errorf("expected %d bytes of data, got %d", len(big), len(events[0].Data))
+	}
+}
+
+func TestOAIStreamReader_LargeToolCallArguments(t *testing.T) {
+	args := `{\"text\":\"` + strings.Repeat("a", 200000) + `\"}`
+	stream := "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"tool_calls\":[{\"id\":\"call_1\",\"index\":0,\"type\":\"function\",\"function\":{\"name\":\"write\",\"arguments\":\"\"}}]}}]}\n\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"" + args + "\"}}]}}]}\n\n" +
+		"event: message\n" +
+		": a comment between events\n" +
+		"data: {\"choices\":[{\"index\":0,\"finish_reason\":\"tool_calls\",\"delta\":{}}]}\n\n" +
+		"data: [DONE]\n\n"
+	resp := collectStream(t, stream)
+	if len(resp.Choices) != 1 || len(resp.Choices[0].Message.ToolCalls) != 1 {
+		t.Fatalf("expected one tool call, got %+v", resp.Choices)
+	}
+	if got := len(resp.Choices[0].Message.ToolCalls[0].Function.Arguments); got != 200000+len(`{"text":""}`) {
+		t.Errorf("arguments were truncated to %d bytes", got)
+	}
+}
+
+func TestOAIStreamReader_InvalidChunk(t *testing.T) {
+	reader := NewOAIStreamReader(strings.NewReader("data: {\"choices\":[]}\n\ndata: {not json\n\n"))
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("unexpected error on first chunk: %v", err)
+	}
+	if _, err := reader.Next(); err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("expected a decode error, got %v", err)
+	}
+}
+
+func TestOAIStreamReader_MidStreamError(t *testing.T) {
+	cases := map[string]string{
+		"payload":     "data: {\"choices\":[]}\n\ndata: {\"error\":{\"message\":\"model overloaded\",\"type\":\"server_error\"}}\n\n",
+		"error event": "data: {\"choices\":[]}\n\nevent: error\ndata: {\"message\":\"model overloaded\",\"type\":\"server_error\"}\n\n",
+		"string":      "data: {\"choices\":[]}\n\ndata: {\"error\":\"model overloaded\"}\n\n",
+	}
+	for name, stream := range cases {
+		t.Run(name, func(t *testing.T) {
+			reader := NewOAIStreamReader(strings.NewReader(stream))
+			if _, err := reader.Next(); err != nil {
+				t.Fatalf("unexpected error on first chunk: %v", err)
+			}
+			_, err := reader.Next()
+			var streamErr *StreamError
+			if !errors.As(err, &streamErr) {
+				t.Fatalf("expected a StreamError, got %v", err)
+			}
+			if streamErr.Err.Message != "model overloaded" {
+				t.Errorf("expected message 'model overloaded', got %q", streamErr.Err.Message)
+			}
+			if _, err := reader.Next(); !errors.Is(err, io.EOF) {
+				t.Errorf("expected EOF after the error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOAIStreamReader_Done(t *testing.T) {
+	chunk := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}]}\n\n"
+	cases := []struct {
+		name   string
+		stream string
+		chunks int
+		done   bool
+	}{
+		{"done", chunk + chunk + "data: [DONE]\n\n", 2, true},
+		{"nothing after done", chunk + "data: [DONE]\n\n" + chunk, 1, true},
+		{"broken off", chunk + chunk, 2, false},
+		{"error", chunk + "event: error\ndata: {\"message\":\"overloaded\"}\n\n", 1, false},
+		{"empty", "", 0, false},
+	}
+	for _, c := range cases {
+		reader := NewOAIStreamReader(strings.NewReader(c.stream))
+		chunks := 0
+		for {
+			_, err := reader.Next()
+			if err != nil {
+				break
+			}
+			chunks++
+		}
+		if chunks != c.chunks || reader.Done() != c.done {
+			t.Errorf("%s: read %d chunks, done %v, want %d, %v", c.name, chunks, reader.Done(), c.chunks, c.done)
+		}
+	}
+}
+
+func TestOAIStreamReader_MissingBlankLines(t *testing.T) {
+	// Copilot sends consecutive data lines without the blank line between
+	// events, which makes them one event with several payloads
+	stream := "data: {\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":\"Hel\"}}]}\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"lo\"}}]}\n" +
+		"data: {\"choices\":[{\"index\":0,\"finish_reason\":\"stop\",\"delta\":{}}]}\n" +
+		"data: [DONE]\n"
+	resp := collectStream(t, stream)
+	if len(resp.Choices) != 1 || derefString(resp.Choices[0].Message.Content) != "Hello" || resp.Choices[0].FinishReason != "stop" {
+		t.Errorf("unexpected response %+v", resp.Choices)
+	}
+
+	// A single payload spread over several data lines stays whole
+	reader := NewOAIStreamReader(strings.NewReader("data: {\"choices\":\ndata: []}\n\n"))
+	if payload, err := reader.NextPayload(); err != nil || string(payload) != "{\"choices\":\n[]}" {
+		t.Errorf("expected one payload, got %q, %v", payload, err)
+	}
+}
+
+func TestOAIStreamReader_NextPayload(t *testing.T) {
+	stream := "data: {\"object\":\"text_completion\",\"choices\":[{\"text\":\"a\"}]}\n\n" +
+		"data: {\"object\":\"text_completion\",\"choices\":[{\"text\":\"b\"}]}\n\n" +
+		"data: [DONE]\n\n"
+	reader := NewOAIStreamReader(strings.NewReader(stream))
+	var payloads []string
+	for {
+		payload, err := reader.NextPayload()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		payloads = append(payloads, string(payload))
+	}
+	if len(payloads) != 2 || !strings.Contains(payloads[1], `"text":"b"`) || !reader.Done() {
+		t.Errorf("unexpected payloads %q", payloads)
+	}
+}
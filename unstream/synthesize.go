@@ -0,0 +1,156 @@
+package unstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SynthesizeOptions controls how a complete response is split into stream chunks.
+type SynthesizeOptions struct {
+	// ContentChunkSize is the number of runes of content per delta. Values <= 0
+	// send the whole content in a single delta.
+	ContentChunkSize int
+	// ArgumentsChunkSize is the number of runes of tool call arguments per delta.
+	// Values <= 0 send the arguments in a single delta.
+	ArgumentsChunkSize int
+	// IncludeUsage appends a final chunk with empty choices carrying the usage.
+	IncludeUsage bool
+}
+
+// SynthesizeStream converts a non-streaming OAIChatResponse into the sequence of
+// chat.completion.chunk objects an upstream would have streamed for it. This is
+// the inverse of OAIStreamCollector.
+func SynthesizeStream(resp *OAIChatResponse, opts SynthesizeOptions) []OAIStreamChunk {
+	var chunks []OAIStreamChunk
+	newChunk := func(choices []OAIStreamChoice) OAIStreamChunk {
+		return OAIStreamChunk{
+			ID:               resp.ID,
+			Object:           "chat.completion.chunk",
+			Created:          resp.Created,
+			Model:            resp.Model,
+			Choices:          choices,
+			ModelFingerprint: resp.SystemFingerprint,
+		}
+	}
+	single := func(idx int, delta OAIStreamDelta) OAIStreamChunk {
+		return newChunk([]OAIStreamChoice{{Index: idx, Delta: delta}})
+	}
+
+	if len(resp.PromptFilterResults) > 0 {
+		first := newChunk([]OAIStreamChoice{})
+		first.PromptFilterResults = resp.PromptFilterResults
+		chunks = append(chunks, first)
+	}
+
+	choices := append([]OAIChatChoice(nil), resp.Choices...)
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].Index < choices[j].Index })
+	for _, choice := range choices {
+		msg := choice.Message
+		role := msg.Role
+		if role == "" {
+			role = "assistant"
+		}
+		empty := ""
+		chunks = append(chunks, single(choice.Index, OAIStreamDelta{Role: role, Content: &empty}))
+
+		if msg.Content != nil {
+			for _, part := range splitRunes(*msg.Content, opts.ContentChunkSize) {
+				chunks = append(chunks, single(choice.Index, OAIStreamDelta{Content: &part}))
+			}
+		}
+
+		if msg.Refusal != nil && *msg.Refusal != "" {
+			chunks = append(chunks, single(choice.Index, OAIStreamDelta{Refusal: msg.Refusal}))
+		}
+
+		for i, tc := range msg.ToolCalls {
+			typ := tc.Type
+			if typ == "" {
+				typ = "function"
+			}
+			chunks = append(chunks, single(choice.Index, OAIStreamDelta{
+				ToolCalls: []OAIToolCallDelta{{
+					Index:    &i,
+					Id:       tc.Id,
+					Type:     typ,
+					Function: OAIToolCallFunctionDelta{Name: tc.Function.Name},
+				}},
+			}))
+			for _, part := range splitRunes(tc.Function.Arguments, opts.ArgumentsChunkSize) {
+				chunks = append(chunks, single(choice.Index, OAIStreamDelta{
+					ToolCalls: []OAIToolCallDelta{{
+						Index:    &i,
+						Function: OAIToolCallFunctionDelta{Arguments: part},
+					}},
+				}))
+			}
+		}
+
+		finishReason := choice.FinishReason
+		if finishReason == "" {
+			finishReason = "stop"
+			if len(msg.ToolCalls) > 0 {
+				finishReason = "tool_calls"
+			}
+		}
+		// Log probabilities ride on the finish chunk rather than being split
+		// along with the content
+		chunks = append(chunks, newChunk([]OAIStreamChoice{{
+			Index:        choice.Index,
+			FinishReason: &finishReason,
+			Logprobs:     choice.Logprobs,
+		}}))
+	}
+
+	if opts.IncludeUsage && resp.Usage != nil {
+		last := newChunk([]OAIStreamChoice{})
+		usage := *resp.Usage
+		last.Usage = &usage
+		chunks = append(chunks, last)
+	}
+	return chunks
+}
+
+// WriteSSEChunk writes a single chunk as a server-sent event data line.
+func WriteSSEChunk(w io.Writer, chunk *OAIStreamChunk) error {
+	return WriteSSEJSON(w, chunk)
+}
+
+// WriteSSEJSON writes any JSON payload, such as an error, as a data line.
+func WriteSSEJSON(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+	return err
+}
+
+// WriteSSEDone writes the [DONE] sentinel that terminates an OpenAI stream.
+func WriteSSEDone(w io.Writer) error {
+	_, err := io.WriteString(w, "data: [DONE]\n\n")
+	return err
+}
+
+// splitRunes splits s into pieces of at most size runes without breaking
+// multi-byte characters. An empty string yields no pieces.
+func splitRunes(s string, size int) []string {
+	if s == "" {
+		return nil
+	}
+	if size <= 0 {
+		return []string{s}
+	}
+	var parts []string
+	start, n := 0, 0
+	for i := range s {
+		if n == size {
+			parts = append(parts, s[start:i])
+			start, n = i, 0
+		}
+		n++
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,137 @@
+package unstream_test
+
+import (
+	"bytes"
+	. "copilot-proxy/unstream"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSynthesizeStream_RoundTrip(t *testing.T) {
+	content := "Hello! How can I assist you today? 🌍"
+	resp := &OAIChatResponse{
+		ID:      "chatcmpl-1",
+		Object:  "chat.completion",
+		Created: 1747592466,
+		Model:   "o1-2024-12-17",
+		Choices: []OAIChatChoice{{
+			FinishReason: "tool_calls",
+			Index:        0,
+			Message: OAIChatMessage{
+				Role:    "assistant",
+				Content: &content,
+				ToolCalls: []OAIToolCall{{
+					Id:       "call_1",
+					Type:     "function",
+					Function: OAIToolCallFunction{Name: "get_weather", Arguments: `{"location":"San Francisco"}`},
+				}},
+			},
+		}},
+		Usage: &OAIUsage{PromptTokens: 73, CompletionTokens: 16, TotalTokens: 89},
+	}
+
+	chunks := SynthesizeStream(resp, SynthesizeOptions{ContentChunkSize: 5, ArgumentsChunkSize: 4, IncludeUsage: true})
+	collector := NewOAIStreamCollector()
+	for i := range chunks {
+		if chunks[i].Object != "chat.completion.chunk" {
+			t.Fatalf("chunk %d: expected object chat.completion.chunk, got %q", i, chunks[i].Object)
+		}
+		collector.AddChunk(&chunks[i])
+	}
+	last := chunks[len(chunks)-1]
+	if last.Usage == nil || len(last.Choices) != 0 {
+		t.Fatalf("expected final usage chunk with no choices, got %+v", last)
+	}
+
+	got := collector.BuildResponse()
+	if len(got.Choices) != 1 {
+		t.Fatalf("expected 1 choice, got %d", len(got.Choices))
+	}
+	choice := got.Choices[0]
+	if derefString(choice.Message.Content) != content {
+		t.Errorf("expected content %q, got %q", content, derefString(choice.Message.Content))
+	}
+	if len(choice.Message.ToolCalls) != 1 {
+		t.Fatalf("expected 1 tool call, got %d", len(choice.Message.ToolCalls))
+	}
+	tc := choice.Message.ToolCalls[0]
+	if tc.Id != "call_1" || tc.Function.Name != "get_weather" || tc.Function.Arguments != `{"location":"San Francisco"}` {
+		t.Errorf("unexpected tool call %+v", tc)
+	}
+	if choice.FinishReason != "tool_calls" {
+		t.Errorf("expected finish_reason 'tool_calls', got %q", choice.FinishReason)
+	}
+	if got.Usage == nil || got.Usage.TotalTokens != 89 {
+		t.Errorf("expected usage to survive the round trip, got %+v", got.Usage)
+	}
+}
+
+func TestSynthesizeStream_ContentChunking(t *testing.T) {
+	content := "héllo wörld"
+	resp := &OAIChatResponse{
+		ID:      "chatcmpl-2",
+		Choices: []OAIChatChoice{{Message: OAIChatMessage{Role: "assistant", Content: &content}}},
+	}
+	chunks := SynthesizeStream(resp, SynthesizeOptions{ContentChunkSize: 3})
+	var parts []string
+	for _, c := range chunks {
+		for _, ch := range c.Choices {
+			if ch.Delta.Content != nil && *ch.Delta.Content != "" {
+				parts = append(parts, *ch.Delta.Content)
+			}
+		}
+	}
+	want := []string{"hél", "lo ", "wör", "ld"}
+	if strings.Join(parts, "|") != strings.Join(want, "|") {
+		t.Errorf("expected parts %q, got %q", want, parts)
+	}
+	final := chunks[len(chunks)-1]
+	if len(final.Choices) != 1 || final.Choices[0].FinishReason == nil || *final.Choices[0].FinishReason != "stop" {
+		t.Errorf("expected a final stop chunk, got %+v", final)
+	}
+}
+
+func TestWriteSSEChunk(t *testing.T) {
+	var buf bytes.Buffer
+	chunk := OAIStreamChunk{
+		ID:      "chatcmpl-3",
+		Object:  "chat.completion.chunk",
+		Choices: []OAIStreamChoice{{Delta: OAIStreamDelta{ToolCalls: []OAIToolCallDelta{{Function: OAIToolCallFunctionDelta{Arguments: "{}"}}}}}},
+	}
+	if err := WriteSSEChunk(&buf, &chunk); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSSEDone(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n\n")
+	if len(lines) != 3 || lines[1] != "data: [DONE]" {
+		t.Fatalf("unexpected framing %q", buf.String())
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[0], "data: ")), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	tc := decoded["choices"].([]any)[0].(map[string]any)["delta"].(map[string]any)["tool_calls"].([]any)[0].(map[string]any)
+	if _, ok := tc["id"]; ok {
+		t.Errorf("continuation delta must not carry an id, got %v", tc)
+	}
+}
+
+func TestSynthesizeStream_Refusal(t *testing.T) {
+	refusal := "I can't help with that."
+	resp := &OAIChatResponse{
+		ID:      "chatcmpl-4",
+		Choices: []OAIChatChoice{{FinishReason: "stop", Message: OAIChatMessage{Role: "assistant", Refusal: &refusal}}},
+	}
+	collector := NewOAIStreamCollector()
+	chunks := SynthesizeStream(resp, SynthesizeOptions{})
+	for i := range chunks {
+		collector.AddChunk(&chunks[i])
+	}
+	got := collector.BuildResponse().Choices[0].Message
+	if got.Content != nil || derefString(got.Refusal) != refusal {
+		t.Errorf("expected only a refusal, got content %q refusal %q", derefString(got.Content), derefString(got.Refusal))
+	}
+}
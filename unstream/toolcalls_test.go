@@ -0,0 +1,171 @@
+package unstream_test
+
+import (
+	. "copilot-proxy/unstream"
+	"strings"
+	"testing"
+)
+
+type wantCall struct {
+	id, name, args string
+}
+
+func checkToolCalls(t *testing.T, resp *OAIChatResponse, want []wantCall) {
+	t.Helper()
+	if len(resp.Choices) != 1 {
+		t.Fatalf("expected 1 choice, got %d", len(resp.Choices))
+	}
+	calls := resp.Choices[0].Message.ToolCalls
+	if len(calls) != len(want) {
+		t.Fatalf("expected %d tool calls, got %d: %+v", len(want), len(calls), calls)
+	}
+	for i, w := range want {
+		tc := calls[i]
+		if tc.Index != i {
+			t.Errorf("call %d: expected index %d, got %d", i, i, tc.Index)
+		}
+		if w.id != "" && tc.Id != w.id {
+			t.Errorf("call %d: expected id %q, got %q", i, w.id, tc.Id)
+		}
+		if tc.Id == "" {
+			t.Errorf("call %d: expected a generated id", i)
+		}
+		if tc.Type != "function" {
+			t.Errorf("call %d: expected type 'function', got %q", i, tc.Type)
+		}
+		if tc.Function.Name != w.name {
+			t.Errorf("call %d: expected name %q, got %q", i, w.name, tc.Function.Name)
+		}
+		if tc.Function.Arguments != w.args {
+			t.Errorf("call %d: expected arguments %q, got %q", i, w.args, tc.Function.Arguments)
+		}
+	}
+	if resp.Choices[0].FinishReason != "tool_calls" {
+		t.Errorf("expected finish_reason 'tool_calls', got %q", resp.Choices[0].FinishReason)
+	}
+}
+
+func TestOAIStreamCollector_LateToolCallFields(t *testing.T) {
+	stream := `
+data: {"id":"chatcmpl-late","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"function":{"arguments":"{\"path\":"}}]}}]}
+
+data: {"id":"chatcmpl-late","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_late","type":"function","function":{"name":"read_file","arguments":"\"a.go\"}"}}]}}]}
+
+data: {"id":"chatcmpl-late","choices":[{"index":0,"finish_reason":"tool_calls","delta":{}}]}
+
+data: [DONE]
+`
+	checkToolCalls(t, collectStream(t, stream), []wantCall{
+		{id: "call_late", name: "read_file", args: `{"path":"a.go"}`},
+	})
+}
+
+func TestOAIStreamCollector_ReusedIndex(t *testing.T) {
+	stream := `
+data: {"id":"chatcmpl-reuse","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"read_file","arguments":""}}]}}]}
+
+data: {"id":"chatcmpl-reuse","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"path\":\"a.go\"}"}}]}}]}
+
+data: {"id":"chatcmpl-reuse","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_b","type":"function","function":{"name":"read_file","arguments":""}}]}}]}
+
+data: {"id":"chatcmpl-reuse","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"path\":\"b.go\"}"}}]}}]}
+
+data: {"id":"chatcmpl-reuse","choices":[{"index":0,"finish_reason":"tool_calls","delta":{}}]}
+
+data: [DONE]
+`
+	checkToolCalls(t, collectStream(t, stream), []wantCall{
+		{id: "call_a", name: "read_file", args: `{"path":"a.go"}`},
+		{id: "call_b", name: "read_file", args: `{"path":"b.go"}`},
+	})
+}
+
+func TestOAIStreamCollector_MissingIndex(t *testing.T) {
+	stream := `
+data: {"id":"chatcmpl-noidx","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"id":"call_a","type":"function","function":{"name":"list_dir","arguments":"{\"dir\":"}}]}}]}
+
+data: {"id":"chatcmpl-noidx","choices":[{"index":0,"delta":{"tool_calls":[{"function":{"arguments":"\".\"}"}}]}}]}
+
+data: {"id":"chatcmpl-noidx","choices":[{"index":0,"delta":{"tool_calls":[{"id":"call_b","type":"function","function":{"name":"read_file","arguments":"{}"}}]}}]}
+
+data: {"id":"chatcmpl-noidx","choices":[{"index":0,"finish_reason":"tool_calls","delta":{}}]}
+
+data: [DONE]
+`
+	checkToolCalls(t, collectStream(t, stream), []wantCall{
+		{id: "call_a", name: "list_dir", args: `{"dir":"."}`},
+		{id: "call_b", name: "read_file", args: `{}`},
+	})
+}
+
+func TestOAIStreamCollector_MissingID(t *testing.T) {
+	stream := `
+data: {"id":"chatcmpl-noid","choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"function":{"name":"list_dir","arguments":"{}"}},{"index":1,"function":{"name":"read_file","arguments":"{}"}}]}}]}
+
+data: {"id":"chatcmpl-noid","choices":[{"index":0,"finish_reason":"tool_calls","delta":{}}]}
+
+data: [DONE]
+`
+	resp := collectStream(t, stream)
+	checkToolCalls(t, resp, []wantCall{
+		{name: "list_dir", args: `{}`},
+		{name: "read_file", args: `{}`},
+	})
+	calls := resp.Choices[0].Message.ToolCalls
+	if calls[0].Id == calls[1].Id {
+		t.Errorf("expected distinct generated ids, got %q twice", calls[0].Id)
+	}
+}
+
+func TestOAIStreamCollector_ToolCallsAcrossChoices(t *testing.T) {
+	// Claude models behind Copilot stream the text and each tool call as separate choices
+	stream := `
+data: {"id":"msg_1","model":"claude-sonnet-4","choices":[{"index":0,"delta":{"role":"assistant","content":"Let me look."}}]}
+
+data: {"id":"msg_1","model":"claude-sonnet-4","choices":[{"index":0,"finish_reason":"stop","delta":{}}]}
+
+data: {"id":"msg_1","model":"claude-sonnet-4","choices":[{"index":1,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"toolu_a","type":"function","function":{"name":"read_file","arguments":"{\"path\":\"a.go\"}"}}]}}]}
+
+data: {"id":"msg_1","model":"claude-sonnet-4","choices":[{"index":2,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"toolu_b","type":"function","function":{"name":"read_file","arguments":"{\"path\":"}}]}}]}
+
+data: {"id":"msg_1","model":"claude-sonnet-4","choices":[{"index":2,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"b.go\"}"}}]}}]}
+
+data: {"id":"msg_1","model":"claude-sonnet-4","choices":[{"index":2,"finish_reason":"tool_calls","delta":{}}]}
+
+data: [DONE]
+`
+	collector := NewOAIStreamCollector()
+	collector.MergeChoices = true
+	reader := NewOAIStreamReader(strings.NewReader(stream))
+	for {
+		chunk, err := reader.Next()
+		if err != nil {
+			break
+		}
+		collector.AddChunk(chunk)
+	}
+	resp := collector.BuildResponse()
+	checkToolCalls(t, resp, []wantCall{
+		{id: "toolu_a", name: "read_file", args: `{"path":"a.go"}`},
+		{id: "toolu_b", name: "read_file", args: `{"path":"b.go"}`},
+	})
+	if got := derefString(resp.Choices[0].Message.Content); got != "Let me look." {
+		t.Errorf("expected merged content, got %q", got)
+	}
+}
+
+func TestOAIStreamCollector_ChoiceOrder(t *testing.T) {
+	stream := `
+data: {"choices":[{"index":2,"delta":{"role":"assistant","content":"c"}},{"index":0,"delta":{"role":"assistant","content":"a"}},{"index":1,"delta":{"role":"assistant","content":"b"}}]}
+
+data: [DONE]
+`
+	for i := 0; i < 10; i++ {
+		resp := collectStream(t, stream)
+		for j, ch := range resp.Choices {
+			if ch.Index != j {
+				t.Fatalf("expected choices ordered by index, got %d at position %d", ch.Index, j)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"copilot-proxy/unstream"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const copilotAPIBase = "https://api.githubcopilot.com"
+
+func newUpstreamRequest(r *http.Request, body []byte, token string) (*http.Request, error) {
+	req, err := http.NewRequest(r.Method, copilotAPIBase+r.URL.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	copyRequestHeaders(req, r, token)
+	return req, nil
+}
+
+func isJSONResponse(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json")
+}
+
+// upstreamError is a failed upstream call, already translated into an OpenAI
+// shaped error body that can be relayed to the client.
+type upstreamError struct {
+	Status int
+	Err    unstream.OAIError
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream error %d: %s", e.Status, e.Err.Message)
+}
+
+func newUpstreamError(status int, message string) *upstreamError {
+	return &upstreamError{Status: status, Err: unstream.OAIError{Message: message, Type: "upstream_error"}}
+}
+
+// readUpstreamError reads an error response, keeping the upstream status and
+// translating non-OpenAI bodies (plain text, GitHub style messages) into an OAIError.
+func readUpstreamError(resp *http.Response) *upstreamError {
+	body, _ := io.ReadAll(resp.Body)
+	oaiErr := unstream.ParseOAIError(body)
+	if oaiErr.Message == "" {
+		oaiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return &upstreamError{Status: resp.StatusCode, Err: oaiErr}
+}
+
+// writeUpstreamError relays err to the client. Errors that did not come from
+// upstream are reported as 502 Bad Gateway.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	var upErr *upstreamError
+	if !errors.As(err, &upErr) {
+		upErr = newUpstreamError(http.StatusBadGateway, err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(upErr.Status)
+	json.NewEncoder(w).Encode(unstream.OAIErrorResponse{Error: upErr.Err})
+}
+
+// readCompletion reads a chat completion from an upstream response that may be
+// either an SSE stream or a single JSON body. Error statuses, error payloads and
+// streams that end without a completion are returned as *upstreamError.
+// mergeChoices folds streamed choices into one, for requests that asked for a
+// single choice.
+func readCompletion(resp *http.Response, mergeChoices bool) (*unstream.OAIChatResponse, error) {
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, readUpstreamError(resp)
+	}
+	// Sniff the body rather than trusting Content-Type, which some upstreams get wrong
+	body := bufio.NewReader(resp.Body)
+	if isJSONBody(body) {
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			return nil, newUpstreamError(http.StatusBadGateway, "failed to read upstream response: "+err.Error())
+		}
+		var final struct {
+			unstream.OAIChatResponse
+			Error json.RawMessage `json:"error"`
+		}
+		if err := json.Unmarshal(raw, &final); err != nil {
+			return nil, newUpstreamError(http.StatusBadGateway, "invalid upstream response: "+err.Error())
+		}
+		if len(final.Error) > 0 && string(final.Error) != "null" {
+			return nil, &upstreamError{Status: http.StatusBadGateway, Err: unstream.ParseOAIError(final.Error)}
+		}
+		if len(final.Choices) == 0 {
+			return nil, newUpstreamError(http.StatusBadGateway, "upstream response contained no choices")
+		}
+		return &final.OAIChatResponse, nil
+	}
+
+	collector := unstream.NewOAIStreamCollector()
+	collector.MergeChoices = mergeChoices
+	reader := unstream.NewOAIStreamReader(body)
+	chunks := 0
+	for {
+		chunk, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var streamErr *unstream.StreamError
+		if errors.As(err, &streamErr) {
+			log.Printf("Upstream reported an error mid-stream: %s", streamErr.Err.Message)
+			return nil, &upstreamError{Status: http.StatusBadGateway, Err: streamErr.Err}
+		}
+		if err != nil {
+			return nil, newUpstreamError(http.StatusBadGateway, "failed to read upstream stream: "+err.Error())
+		}
+		collector.AddChunk(chunk)
+		chunks++
+	}
+	if chunks == 0 {
+		return nil, newUpstreamError(http.StatusBadGateway, "upstream returned an empty stream")
+	}
+	final := collector.BuildResponse()
+	if len(final.Choices) == 0 {
+		return nil, newUpstreamError(http.StatusBadGateway, "upstream stream ended without a completion")
+	}
+	return final, nil
+}
+
+// isJSONBody reports whether the buffered body starts with a JSON object
+// rather than SSE framing.
+func isJSONBody(body *bufio.Reader) bool {
+	for i := 1; ; i++ {
+		peek, _ := body.Peek(i)
+		if len(peek) < i {
+			return false
+		}
+		switch c := peek[i-1]; c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return c == '{'
+		}
+	}
+}